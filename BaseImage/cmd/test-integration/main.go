@@ -26,10 +26,19 @@ func main() {
 	os.Setenv("CONSUMER_PASSWORD", "mock-test-password")
 	os.Setenv("SESSION_DURATION", "1h")
 	os.Setenv("INTERNAL_API_PORT", "8081")
+	os.Setenv("AUTH_DISABLED", "true")
 
 	// Start proxy server
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	server, err := sessions.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 	go func() {
-		if err := sessions.StartServer(); err != nil {
+		if err := server.ListenAndServe(); err != nil {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -40,5 +49,6 @@ func main() {
 	<-sigChan
 
 	// Cleanup
+	server.Shutdown()
 	mockAPI.Stop()
 } 
\ No newline at end of file
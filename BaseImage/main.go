@@ -1,8 +1,13 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
 	"github.com/joho/godotenv"
@@ -14,52 +19,88 @@ func init() {
 	
 	// Load environment variables
 	if err := loadEnv(); err != nil {
-		log.Printf("Warning: Error loading environment: %v", err)
+		slog.Warn("Error loading environment", "error", err)
 	}
 }
 
+// loadEnv loads a .env file from the working directory, if there is one.
+// Variables already set in the environment take precedence.
 func loadEnv() error {
-	// Try loading from different env files in order of preference
-	envFiles := []string{".env", ".env.test", ".env.example"}
-	
-	var loadedFile string
-	var err error
-	
-	for _, file := range envFiles {
-		if _, err = os.Stat(file); err == nil {
-			if err = godotenv.Load(file); err == nil {
-				loadedFile = file
-				break
-			}
-		}
+	if _, err := os.Stat(".env"); err != nil {
+		slog.Info("No .env file found, using existing environment variables")
+		return nil
 	}
-
-	if loadedFile != "" {
-		log.Printf("Loaded environment from %s", loadedFile)
-	} else {
-		log.Printf("No environment file found, using existing environment variables")
+	if err := godotenv.Load(".env"); err != nil {
+		return err
 	}
+	slog.Info("Loaded environment from .env")
+	return nil
+}
 
-	// Validate required environment variables
-	required := []string{
-		"CONSUMER_NODE_URL",
-		"MARKETPLACE_URL",
-	}
+func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config file; environment variables override its settings")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	flag.Parse()
 
-	for _, env := range required {
-		if os.Getenv(env) == "" {
-			log.Printf("Warning: Required environment variable %s is not set", env)
+	if *checkConfig {
+		if err := sessions.CheckConfig(*configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		fmt.Println("Configuration OK")
+		return
 	}
 
-	return nil
-}
+	slog.Info("Starting NFA Proxy Server")
+
+	cfg, err := sessions.ReadConfig(*configFile)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+	server, err := sessions.NewServer(cfg)
+	if err != nil {
+		slog.Error("Failed to create server", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(server.Logger())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// Reload the configuration on SIGHUP without restarting the server
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			cfg, err := sessions.ReadConfig(*configFile)
+			if err == nil {
+				err = server.Reload(cfg)
+			}
+			if err != nil {
+				slog.Error("Error reloading configuration, keeping the current one", "error", err)
+			}
+		}
+	}()
 
-func main() {
-	log.Printf("Starting NFA Proxy Server...")
-	
 	// Start the proxy server
-	if err := sessions.StartServer(); err != nil {
-		log.Fatal(err)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	case sig := <-sigChan:
+		// Let in-flight streams finish and close sessions so their stake is returned
+		slog.Info("Received signal", "signal", sig.String())
+		if err := server.Shutdown(); err != nil {
+			slog.Error("Error during shutdown", "error", err)
+		}
+		slog.Info("Shutdown complete")
 	}
-}
\ No newline at end of file
+}
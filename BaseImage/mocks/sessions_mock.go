@@ -1,49 +1,143 @@
 package mocks
 
 import (
+	"context"
+	"fmt"
+	"math/big"
 	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
 )
 
+// MockSessionManager implements sessions.SessionManager with overridable functions
 type MockSessionManager struct {
-	GetModelByHandleFn func(modelHandle string) (*ModelInfo, error)
-	CreateSessionFn    func(modelId string, stakeAmount string) (*SessionResponse, error)
-	SendChatMessageFn  func(sessionToken string, modelId string, message string) (*ChatResponse, error)
-}
+	GetModelByHandleFn func(ctx context.Context, modelHandle string) (*sessions.ModelInfo, error)
+	ListModelsFn       func(ctx context.Context) ([]sessions.ModelInfo, error)
+	CreateSessionFn    func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error)
+	GetSessionFn       func(ctx context.Context, sessionToken string) (*sessions.SessionInfo, error)
+	CloseSessionFn     func(ctx context.Context, sessionToken string) error
+	SendChatMessageFn  func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error)
 
-type ModelInfo struct {
-	ID          string
-	Name        string
-	Endpoint    string
-	Description string
-}
-
-type SessionResponse struct {
-	SessionToken string
-	ExpiresAt    time.Time
-}
+	ListBidsFn            func(ctx context.Context, modelId string) ([]sessions.BidInfo, error)
+	CreateSessionForBidFn func(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error)
 
-type ChatResponse struct {
-	Response string
+	GetBalanceFn   func(ctx context.Context) (*sessions.WalletBalance, error)
+	GetAllowanceFn func(ctx context.Context, spender string) (*big.Int, error)
+	ApproveFn      func(ctx context.Context, spender string, amount *big.Int) error
 }
 
 func NewMockSessionManager() *MockSessionManager {
 	return &MockSessionManager{
-		GetModelByHandleFn: func(modelHandle string) (*ModelInfo, error) {
-			return &ModelInfo{
+		GetModelByHandleFn: func(ctx context.Context, modelHandle string) (*sessions.ModelInfo, error) {
+			return &sessions.ModelInfo{
 				ID:   "test-model-id",
 				Name: modelHandle,
 			}, nil
 		},
-		CreateSessionFn: func(modelId string, stakeAmount string) (*SessionResponse, error) {
-			return &SessionResponse{
+		ListModelsFn: func(ctx context.Context) ([]sessions.ModelInfo, error) {
+			return []sessions.ModelInfo{{
+				ID:   "test-model-id",
+				Name: "LMR-Hermes-2-Theta-Llama-3-8B",
+			}}, nil
+		},
+		CreateSessionFn: func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+			return &sessions.SessionResponse{
 				SessionToken: "test-session-token",
 				ExpiresAt:    time.Now().Add(1 * time.Hour),
 			}, nil
 		},
-		SendChatMessageFn: func(sessionToken string, modelId string, message string) (*ChatResponse, error) {
-			return &ChatResponse{
-				Response: "Test response",
+		GetSessionFn: func(ctx context.Context, sessionToken string) (*sessions.SessionInfo, error) {
+			return &sessions.SessionInfo{
+				ID:       sessionToken,
+				Provider: "0x1111111111111111111111111111111111111111",
+				OpenedAt: sessions.NumericString(fmt.Sprintf("%d", time.Now().Unix())),
+			}, nil
+		},
+		CloseSessionFn: func(ctx context.Context, sessionToken string) error {
+			return nil
+		},
+		SendChatMessageFn: func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+			if w != nil {
+				w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"Test response"}}]}` + "\n\n"))
+				w.Flush()
+				return &sessions.ChatResponse{}, nil
+			}
+			finishReason := "stop"
+			return &sessions.ChatResponse{
+				Object: "chat.completion",
+				Choices: []sessions.ChatChoice{{
+					Message:      sessions.ChatMessage{Role: "assistant", Content: "Test response"},
+					FinishReason: &finishReason,
+				}},
+			}, nil
+		},
+		ListBidsFn: func(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+			return []sessions.BidInfo{{
+				ID:             "test-bid-id",
+				Provider:       "0x1111111111111111111111111111111111111111",
+				ModelAgentID:   modelId,
+				PricePerSecond: "100",
+			}}, nil
+		},
+		CreateSessionForBidFn: func(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+			return &sessions.SessionResponse{
+				SessionToken: "test-bid-session-token",
+				ExpiresAt:    time.Now().Add(1 * time.Hour),
 			}, nil
 		},
+		GetBalanceFn: func(ctx context.Context) (*sessions.WalletBalance, error) {
+			return &sessions.WalletBalance{ETH: "1000000000000000000", MOR: "1000000000000000000000"}, nil
+		},
+		GetAllowanceFn: func(ctx context.Context, spender string) (*big.Int, error) {
+			allowance, _ := new(big.Int).SetString("1000000000000000000000", 10)
+			return allowance, nil
+		},
+		ApproveFn: func(ctx context.Context, spender string, amount *big.Int) error {
+			return nil
+		},
 	}
-} 
\ No newline at end of file
+}
+
+func (m *MockSessionManager) GetModelByHandle(ctx context.Context, modelHandle string) (*sessions.ModelInfo, error) {
+	return m.GetModelByHandleFn(ctx, modelHandle)
+}
+
+func (m *MockSessionManager) ListModels(ctx context.Context) ([]sessions.ModelInfo, error) {
+	return m.ListModelsFn(ctx)
+}
+
+func (m *MockSessionManager) CreateSession(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+	return m.CreateSessionFn(ctx, modelId, params)
+}
+
+func (m *MockSessionManager) GetSession(ctx context.Context, sessionToken string) (*sessions.SessionInfo, error) {
+	return m.GetSessionFn(ctx, sessionToken)
+}
+
+func (m *MockSessionManager) CloseSession(ctx context.Context, sessionToken string) error {
+	return m.CloseSessionFn(ctx, sessionToken)
+}
+
+func (m *MockSessionManager) SendChatMessage(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+	return m.SendChatMessageFn(ctx, sessionToken, modelId, chatReq, w)
+}
+
+func (m *MockSessionManager) ListBids(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+	return m.ListBidsFn(ctx, modelId)
+}
+
+func (m *MockSessionManager) CreateSessionForBid(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+	return m.CreateSessionForBidFn(ctx, bidId, params)
+}
+
+func (m *MockSessionManager) GetBalance(ctx context.Context) (*sessions.WalletBalance, error) {
+	return m.GetBalanceFn(ctx)
+}
+
+func (m *MockSessionManager) GetAllowance(ctx context.Context, spender string) (*big.Int, error) {
+	return m.GetAllowanceFn(ctx, spender)
+}
+
+func (m *MockSessionManager) Approve(ctx context.Context, spender string, amount *big.Int) error {
+	return m.ApproveFn(ctx, spender, amount)
+}
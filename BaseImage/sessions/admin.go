@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RequireAdminToken protects admin routes with the ADMIN_TOKEN bearer token.
+// Admin routes are disabled when no token is configured.
+func (s *Server) RequireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := s.config().AdminToken
+		if adminToken == "" {
+			writeOpenAIError(w, http.StatusForbidden, "invalid_request_error", "admin_disabled", "Admin API is disabled, set ADMIN_TOKEN to enable it")
+			return
+		}
+		presented := presentedAPIKey(r)
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) != 1 {
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Incorrect admin token provided.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleProviderStats reports the success and latency stats the proxy
+// observed per provider address, as used by the bid selection policies
+func (s *Server) handleProviderStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"providers": s.providers.Snapshot(),
+	})
+}
+
+// handleSpendReport reports the MOR committed per API key and model.
+//
+// Query parameters:
+//   - tenant: only report this tenant
+//   - period: "day" or "month" for the current UTC day or month
+//   - from, to: RFC 3339 timestamps or YYYY-MM-DD dates bounding the report
+func (s *Server) handleSpendReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	now := time.Now()
+	query := r.URL.Query()
+
+	var from, to time.Time
+	switch query.Get("period") {
+	case "":
+	case "day":
+		from = startOfDay(now)
+	case "month":
+		from = startOfMonth(now)
+	default:
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_period", "period must be day or month")
+		return
+	}
+
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = parseReportTime(value); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_from", err.Error())
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = parseReportTime(value); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_to", err.Error())
+			return
+		}
+	}
+
+	report := BuildSpendReport(s.ledger.Records(from, to), query.Get("tenant"), now)
+	if !from.IsZero() {
+		report.From = &from
+	}
+	if !to.IsZero() {
+		report.To = &to
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", value)
+}
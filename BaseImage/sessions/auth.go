@@ -0,0 +1,321 @@
+package sessions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey is a client key accepted on the /v1 routes
+type APIKey struct {
+	Key           string   `json:"key" yaml:"key"`
+	Tenant        string   `json:"tenant" yaml:"tenant"`
+	Models        []string `json:"models,omitempty" yaml:"models"`                 // Allowed model handles; empty allows every model
+	SpendCap      string   `json:"spend_cap,omitempty" yaml:"spend_cap"`           // Most MOR, in wei, the key may spend; empty means no cap
+	DailyBudget   string   `json:"daily_budget,omitempty" yaml:"daily_budget"`     // Most MOR, in wei, the key may spend per UTC day
+	MonthlyBudget string   `json:"monthly_budget,omitempty" yaml:"monthly_budget"` // Most MOR, in wei, the key may spend per UTC month
+
+	SelectionPolicy string `json:"selection_policy,omitempty" yaml:"selection_policy"` // Bid selection policy; empty lets the consumer node pick
+	Provider        string `json:"provider,omitempty" yaml:"provider"`                 // Provider address for the pinned policy
+
+	MaxConcurrent int `json:"max_concurrent,omitempty" yaml:"max_concurrent"` // Most requests upstream at once; 0 uses queue.max_concurrent_per_key
+
+	RateLimit        `yaml:",inline"` // Requests and tokens per minute; unset quantities use rate_limits.key
+	SessionOverrides `yaml:",inline"` // Session terms for the key's requests, within the configured limits
+}
+
+// ID identifies the key in logs and spend reports without revealing it
+func (k *APIKey) ID() string {
+	sum := sha256.Sum256([]byte(k.Key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// LimitsSpend reports whether the key has a spend cap or budget
+func (k *APIKey) LimitsSpend() bool {
+	return k.SpendCap != "" || k.DailyBudget != "" || k.MonthlyBudget != ""
+}
+
+// AllowsModel reports whether the key may use the model handle
+func (k *APIKey) AllowsModel(handle string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, model := range k.Models {
+		if strings.EqualFold(model, handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeysFile is the format of the API_KEYS_FILE
+type apiKeysFile struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// KeyStore holds the accepted API keys. Keys loaded from a file are reloaded
+// whenever the file changes.
+type KeyStore struct {
+	loadMu  sync.Mutex // Serializes loads
+	mu      sync.RWMutex
+	keys    map[string]*APIKey // Keyed by the hex SHA-256 of the key
+	static  []APIKey           // Keys that do not come from the file
+	path    string
+	modTime time.Time
+	size    int64
+	logger  *slog.Logger
+
+	policies selectionPolicies // Policies keys may select
+	interval *loopInterval     // How often the file is checked for changes
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type apiKeyContextKey struct{}
+
+// NewKeyStore loads the keys file, if any, and watches it for changes
+func NewKeyStore(path string, static []APIKey, reloadInterval time.Duration) (*KeyStore, error) {
+	return newKeyStore(path, static, reloadInterval, builtinPolicies, slog.Default())
+}
+
+func newKeyStore(path string, static []APIKey, reloadInterval time.Duration, policies selectionPolicies, logger *slog.Logger) (*KeyStore, error) {
+	s := &KeyStore{
+		static:   static,
+		path:     path,
+		logger:   logger,
+		policies: policies,
+		interval: newLoopInterval(reloadInterval),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+// Enabled reports whether any key is configured
+func (s *KeyStore) Enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys) > 0
+}
+
+// Lookup returns the key entry for a presented key
+func (s *KeyStore) Lookup(key string) (*APIKey, bool) {
+	sum := sha256.Sum256([]byte(key))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.keys[hex.EncodeToString(sum[:])]
+	return entry, ok
+}
+
+// Reload re-reads the keys file if it changed since the last load
+func (s *KeyStore) Reload() error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	s.mu.RLock()
+	path, modTime, size := s.path, s.modTime, s.size
+	s.mu.RUnlock()
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat API keys file: %v", err)
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return nil
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.logger.Info("Reloaded API keys", "path", path)
+	return nil
+}
+
+// Configure switches the store to a new keys file and static keys, keeping
+// the current keys if the new ones cannot be loaded
+func (s *KeyStore) Configure(path string, static []APIKey) error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	s.mu.Lock()
+	oldPath, oldStatic := s.path, s.static
+	s.path, s.static = path, static
+	s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		s.mu.Lock()
+		s.path, s.static = oldPath, oldStatic
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops watching the keys file
+func (s *KeyStore) Close() {
+	select {
+	case <-s.stop:
+		return
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
+
+// load reads the keys. Callers other than NewKeyStore must hold loadMu.
+func (s *KeyStore) load() error {
+	s.mu.RLock()
+	path := s.path
+	entries := append([]APIKey(nil), s.static...)
+	s.mu.RUnlock()
+
+	var modTime time.Time
+	var size int64
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat API keys file: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read API keys file: %v", err)
+		}
+		var file apiKeysFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse API keys file %s: %v", path, err)
+		}
+		entries = append(entries, file.Keys...)
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	keys := make(map[string]*APIKey, len(entries))
+	for i := range entries {
+		entry := entries[i]
+		if err := validateAPIKey(&entry, s.policies); err != nil {
+			return fmt.Errorf("invalid API key %d: %v", i+1, err)
+		}
+		sum := sha256.Sum256([]byte(entry.Key))
+		keys[hex.EncodeToString(sum[:])] = &entry
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.modTime, s.size = modTime, size
+	return nil
+}
+
+// validateAPIKey checks a key entry. Its selection policy is checked against
+// policies, unless they are nil.
+func validateAPIKey(key *APIKey, policies selectionPolicies) error {
+	if key.Key == "" {
+		return fmt.Errorf("key is empty")
+	}
+	if key.Tenant == "" {
+		return fmt.Errorf("tenant is required")
+	}
+	amounts := map[string]string{
+		"spend_cap":      key.SpendCap,
+		"daily_budget":   key.DailyBudget,
+		"monthly_budget": key.MonthlyBudget,
+	}
+	for name, amount := range amounts {
+		if amount == "" {
+			continue
+		}
+		if _, ok := new(big.Int).SetString(amount, 10); !ok {
+			return fmt.Errorf("%s %q is not an integer amount of wei", name, amount)
+		}
+	}
+	if key.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent %d is negative", key.MaxConcurrent)
+	}
+	if err := key.RateLimit.validate(); err != nil {
+		return err
+	}
+	if key.SelectionPolicy != "" && policies != nil {
+		if _, ok := policies.lookup(key.SelectionPolicy); !ok {
+			return fmt.Errorf("unknown selection_policy %q", key.SelectionPolicy)
+		}
+	}
+	return key.SessionOverrides.validate()
+}
+
+func (s *KeyStore) watch() {
+	defer close(s.done)
+	s.interval.run(s.stop, func() {
+		// Keep serving the previous keys if the file is mid-edit or broken
+		if err := s.Reload(); err != nil {
+			s.logger.Error("Error reloading API keys", "error", err)
+		}
+	})
+}
+
+// RequireAPIKey authenticates requests with a bearer API key of the server
+// and makes the key available to the handler. Basic auth with the key as
+// password is accepted too. Without keys every request is rejected, unless
+// auth.disabled lets them through unauthenticated.
+func (s *Server) RequireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.keys.Enabled() && s.config().AuthDisabled {
+			next(w, r)
+			return
+		}
+
+		presented := presentedAPIKey(r)
+		if presented == "" {
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+				"You didn't provide an API key. Provide it in the Authorization header using Bearer auth (Authorization: Bearer YOUR_KEY).")
+			return
+		}
+
+		key, ok := s.keys.Lookup(presented)
+		if !ok {
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+				"Incorrect API key provided.")
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// apiKeyFromContext returns the authenticated key, or nil when auth.disabled
+// let the request through without one
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+func presentedAPIKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	case strings.HasPrefix(auth, "Basic "):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		if err != nil {
+			return ""
+		}
+		if _, password, ok := strings.Cut(string(decoded), ":"); ok {
+			return password
+		}
+	}
+	return ""
+}
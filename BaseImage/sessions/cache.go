@@ -0,0 +1,420 @@
+package sessions
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Cache results, as reported in the X-Cache header and the cache metrics
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+)
+
+// cacheBucket is the bbolt bucket cached responses are kept in
+var cacheBucket = []byte("responses")
+
+// cachedResponse is a completion kept in the response cache
+type cachedResponse struct {
+	Response *ChatResponse `json:"response"`
+	Created  time.Time     `json:"created"`
+}
+
+// cacheStore holds the encoded cached responses by key. Stores are used under
+// the lock of their responseCache.
+type cacheStore interface {
+	get(key string) ([]byte, error)
+	put(key string, value []byte) error
+	delete(key string) error
+	each(fn func(key string, value []byte)) error
+	close() error
+}
+
+// memoryCacheStore keeps cached responses in memory only
+type memoryCacheStore map[string][]byte
+
+func (m memoryCacheStore) get(key string) ([]byte, error) {
+	return m[key], nil
+}
+
+func (m memoryCacheStore) put(key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryCacheStore) delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func (m memoryCacheStore) each(fn func(key string, value []byte)) error {
+	for key, value := range m {
+		fn(key, value)
+	}
+	return nil
+}
+
+func (m memoryCacheStore) close() error {
+	return nil
+}
+
+// boltCacheStore keeps cached responses in a bbolt file, so they survive
+// restarts
+type boltCacheStore struct {
+	db *bolt.DB
+}
+
+func openBoltCacheStore(path string) (*boltCacheStore, error) {
+	// A second proxy using the file waits for the lock, then fails
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(cacheBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltCacheStore{db: db}, nil
+}
+
+func (b *boltCacheStore) get(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction
+		value = append([]byte(nil), tx.Bucket(cacheBucket).Get([]byte(key))...)
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltCacheStore) put(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltCacheStore) delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltCacheStore) each(fn func(key string, value []byte)) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheBucket).ForEach(func(key, value []byte) error {
+			fn(string(key), value)
+			return nil
+		})
+	})
+}
+
+func (b *boltCacheStore) close() error {
+	return b.db.Close()
+}
+
+// cacheEntry indexes a cached response for expiry and eviction
+type cacheEntry struct {
+	key     string
+	size    int
+	created time.Time
+}
+
+// responseCache keeps the completions of deterministic chat requests, so
+// repeating a request does not cost a session. Entries expire after the TTL,
+// and the least recently used entries are evicted beyond the entry and size
+// limits.
+type responseCache struct {
+	config     func() *Config
+	logger     *slog.Logger
+	maxEntries int
+	maxBytes   int
+
+	mu      sync.Mutex
+	store   cacheStore
+	lru     *list.List // Entries, most recently used first
+	entries map[string]*list.Element
+	size    int // Encoded size of all entries
+}
+
+// newResponseCache opens the response cache, loading the responses kept in
+// cache.file. It returns nil when the cache is disabled.
+func newResponseCache(cfg *Config, config func() *Config, logger *slog.Logger) (*responseCache, error) {
+	if !cfg.CacheEnabled {
+		return nil, nil
+	}
+
+	var store cacheStore = memoryCacheStore{}
+	if cfg.CacheFile != "" {
+		boltStore, err := openBoltCacheStore(cfg.CacheFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open response cache %s: %v", cfg.CacheFile, err)
+		}
+		store = boltStore
+	}
+	c := &responseCache{
+		config:     config,
+		logger:     logger,
+		maxEntries: cfg.CacheMaxEntries,
+		maxBytes:   cfg.CacheMaxBytes,
+		store:      store,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	if err := c.load(); err != nil {
+		store.close()
+		return nil, fmt.Errorf("failed to load response cache %s: %v", cfg.CacheFile, err)
+	}
+	return c, nil
+}
+
+// load indexes the responses in the store, oldest last, dropping expired
+// and undecodable ones
+func (c *responseCache) load() error {
+	var loaded, stale []cacheEntry
+	err := c.store.each(func(key string, value []byte) {
+		var cached cachedResponse
+		entry := cacheEntry{key: key, size: len(value)}
+		if err := json.Unmarshal(value, &cached); err != nil || cached.Response == nil || c.expired(cached.Created) {
+			stale = append(stale, entry)
+			return
+		}
+		entry.created = cached.Created
+		loaded = append(loaded, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range stale {
+		if err := c.store.delete(entry.key); err != nil {
+			return err
+		}
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].created.After(loaded[j].created)
+	})
+	for _, entry := range loaded {
+		entry := entry
+		c.entries[entry.key] = c.lru.PushBack(&entry)
+		c.size += entry.size
+	}
+	c.evict()
+	if len(loaded) > 0 {
+		c.logger.Info("Loaded cached responses", "entries", c.lru.Len(), "bytes", c.size)
+	}
+	return nil
+}
+
+func (c *responseCache) expired(created time.Time) bool {
+	return time.Since(created) >= c.config().CacheTTL
+}
+
+// Get returns the cached response for key
+func (c *responseCache) Get(key string) (*ChatResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if c.expired(entry.created) {
+		c.remove(element)
+		return nil, false
+	}
+
+	value, err := c.store.get(key)
+	var cached cachedResponse
+	if err == nil {
+		err = json.Unmarshal(value, &cached)
+	}
+	if err != nil || cached.Response == nil {
+		c.logger.Warn("Error reading cached response", "error", err)
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return cached.Response, true
+}
+
+// Put caches resp under key, evicting the least recently used responses
+// beyond the limits
+func (c *responseCache) Put(key string, resp *ChatResponse) {
+	now := time.Now()
+	value, err := json.Marshal(cachedResponse{Response: resp, Created: now})
+	if err != nil {
+		c.logger.Warn("Error encoding response for the cache", "error", err)
+		return
+	}
+	if len(value) > c.maxBytes {
+		c.logger.Debug("Response too large to cache", "bytes", len(value))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if err := c.store.put(key, value); err != nil {
+		c.logger.Warn("Error caching response", "error", err)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: len(value), created: now})
+	c.size += len(value)
+	c.evict()
+}
+
+// evict drops the least recently used entries until the cache fits its limits
+func (c *responseCache) evict() {
+	for c.lru.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	if err := c.store.delete(entry.key); err != nil {
+		c.logger.Warn("Error removing cached response", "error", err)
+	}
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// Len returns the number of cached responses
+func (c *responseCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Close closes the cache file
+func (c *responseCache) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.close(); err != nil {
+		c.logger.Warn("Error closing response cache", "error", err)
+	}
+}
+
+// cacheable reports whether the response to chatReq may be cached: only
+// requests sampling with temperature 0 are, and clients can opt out with
+// Cache-Control: no-store
+func cacheable(r *http.Request, chatReq *ChatCompletionRequest) bool {
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-store") {
+		return false
+	}
+	return chatReq.Temperature != nil && *chatReq.Temperature == 0
+}
+
+// cacheKey hashes the tenant, the model and everything in the request that
+// shapes the completion. Whether it is streamed and the proxy-only session
+// terms do not count, and the JSON is canonicalized so member order and
+// spacing do not either. tenant is empty when responses are shared.
+func cacheKey(tenant, modelID string, chatReq *ChatCompletionRequest) (string, error) {
+	req := *chatReq
+	req.Stream = false
+	req.StreamOptions = nil
+	body, err := req.UpstreamBody(modelID)
+	if err != nil {
+		return "", err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var canonical interface{}
+	if err := decoder.Decode(&canonical); err != nil {
+		return "", err
+	}
+	// Maps are encoded with sorted keys
+	if body, err = json.Marshal(canonical); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(tenant+"\x00"), body...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeCachedResponse replays a cached completion in the form the request
+// asked for
+func writeCachedResponse(w http.ResponseWriter, resp *ChatResponse, chatReq *ChatCompletionRequest) {
+	if !chatReq.Stream {
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "streaming_unsupported", "Streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	writeCachedStream(struct {
+		http.ResponseWriter
+		http.Flusher
+	}{w, flusher}, resp, chatReq)
+}
+
+// writeCachedStream replays a cached completion as an SSE stream: a chunk
+// with the message of each choice, a chunk with its finish reason, the usage
+// when the client asked for it, and [DONE]
+func writeCachedStream(w StreamWriter, resp *ChatResponse, chatReq *ChatCompletionRequest) {
+	chunk := func(choices []ChunkChoice, usage *Usage) {
+		data, _ := json.Marshal(ChatCompletionChunk{
+			ID:                resp.ID,
+			Object:            "chat.completion.chunk",
+			Created:           resp.Created,
+			Model:             resp.Model,
+			SystemFingerprint: resp.SystemFingerprint,
+			Choices:           choices,
+			Usage:             usage,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+
+	for _, choice := range resp.Choices {
+		delta := ChunkDelta{Role: choice.Message.Role, Content: choice.Message.Content}
+		if len(choice.Message.ToolCalls) > 0 {
+			json.Unmarshal(choice.Message.ToolCalls, &delta.ToolCalls)
+			for i := range delta.ToolCalls {
+				delta.ToolCalls[i].Index = i
+			}
+		}
+		chunk([]ChunkChoice{{Index: choice.Index, Delta: delta}}, nil)
+		chunk([]ChunkChoice{{Index: choice.Index, FinishReason: choice.FinishReason}}, nil)
+	}
+
+	var options struct {
+		IncludeUsage bool `json:"include_usage"`
+	}
+	json.Unmarshal(chatReq.StreamOptions, &options)
+	if options.IncludeUsage && resp.Usage != nil {
+		chunk([]ChunkChoice{}, resp.Usage)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	w.Flush()
+}
@@ -0,0 +1,727 @@
+package sessions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the proxy configuration. It is read from the YAML file named by
+// CONFIG_FILE, if any, with environment variables taking precedence over the
+// file.
+type Config struct {
+	File string // Config file the configuration was read from; empty for environment only
+
+	ConsumerNodeURL string
+	MarketplaceURL  string
+	InternalAPIPort string
+	AuthToken       string
+
+	// Consumer node credentials
+	CredentialsSource string // auto, env, cookie_file or secrets_file
+	CookieFile        string // Cookie file the consumer node writes
+	SecretsFile       string // YAML or JSON file with username and password
+
+	Session       SessionParams // Terms sessions are opened on unless a key or request asks otherwise
+	SessionLimits SessionLimits // Bounds on the terms keys and requests may ask for
+
+	// Session pool settings
+	SessionRenewBefore   time.Duration // Renew pooled sessions this long before they expire
+	PoolSessionsByCaller bool          // Keep a separate pooled session per API key rather than per tenant
+
+	// Timeouts
+	SessionOpenTimeout       time.Duration // Per attempt to open or close a session
+	SessionReadyTimeout      time.Duration
+	SessionReadyPollInterval time.Duration
+	ShutdownTimeout          time.Duration // How long in-flight requests may run on shutdown
+
+	// Retry policy for consumer node calls
+	RetryAttempts int           // Attempts to list models or open a session
+	RetryBackoff  time.Duration // Delay after the first failed attempt, growing linearly
+
+	ModelRefreshInterval time.Duration     // How often the model registry is reloaded
+	ModelAliases         map[string]string // Extra names for model handles
+
+	// API key settings
+	APIKeys               []APIKey // Keys from the config file
+	APIKeysFile           string
+	APIKeysReloadInterval time.Duration
+	AuthDisabled          bool // Serve the /v1 routes without API keys when none are configured
+
+	LedgerFile string // Append-only file the spend ledger is kept in
+	AdminToken string // Bearer token for the /admin routes
+
+	SelectionPolicy string // Bid selection policy for requests that do not choose one
+
+	// Wallet settings
+	DiamondContract       string        // Contract sessions are staked with; funds are checked before opening sessions when set
+	AutoApproveCeiling    string        // Most allowance, in wei of MOR, granted the diamond contract automatically; empty to never approve
+	WalletMonitorInterval time.Duration // How often the wallet balance is checked; 0 disables the checks unless alert webhooks are set
+
+	// Alert settings
+	AlertWebhooks             []string      // URLs alerts are POSTed to
+	AlertMinETHBalance        string        // Wallet ETH balance, in wei, below which an alert fires; empty for none
+	AlertMinMORBalance        string        // Wallet MOR balance, in wei, below which an alert fires; empty for none
+	AlertSessionFailureRate   float64       // Share of session opens failing within the window that fires an alert; 0 disables
+	AlertSessionFailureWindow time.Duration // Window the session open failure rate is measured over
+	AlertBudgetThreshold      float64       // Share of an API key budget spent that fires an alert; 0 disables
+
+	// Request queue settings
+	MaxConcurrentPerModel int           // Most requests upstream at once per model; 0 for no limit
+	MaxConcurrentPerKey   int           // Most requests upstream at once per API key, unless the key sets its own; 0 for no limit
+	QueueSize             int           // Most requests waiting for their turn; more are rejected
+	QueueMaxWait          time.Duration // How long a request waits for its turn
+
+	// Rate limit settings
+	RateLimitKey               RateLimit            // Limit per API key, unless the key sets its own
+	RateLimitIP                RateLimit            // Limit per client IP
+	RateLimitModel             RateLimit            // Limit per model, unless RateLimitModels sets one
+	RateLimitModels            map[string]RateLimit // Limits per model handle
+	RateLimitTrustForwardedFor bool                 // Take the client IP from X-Forwarded-For, for proxies behind a load balancer
+	RateLimitForwardedForHops  int                  // Position of the client IP in X-Forwarded-For, counted from the right
+
+	// Response cache settings
+	CacheEnabled    bool          // Answer repeated deterministic requests from the cache
+	CacheShared     bool          // Share cached responses across tenants
+	CacheFile       string        // bbolt file cached responses are kept in; empty keeps them in memory
+	CacheTTL        time.Duration // How long a cached response is served
+	CacheMaxEntries int           // Most responses kept
+	CacheMaxBytes   int           // Most encoded size of the responses kept
+
+	// Failover settings
+	SessionFailover      bool // Ask the consumer node to fail over between providers itself
+	BidFailoverAttempts  int  // Alternative bids tried when no provider accepts a session
+	StreamResumeAttempts int  // Times a broken stream is resumed on a new session
+
+	// Logging settings
+	LogLevel   string // debug, info, warn or error
+	LogFormat  string // json or text
+	LogContent bool   // Log prompt and completion content instead of redacting it
+
+	// Tracing settings
+	TracingEndpoint    string  // OTLP/HTTP collector spans are exported to; tracing is off when empty
+	TracingServiceName string  // service.name of the exported spans
+	TracingSampleRatio float64 // Share of new traces that are sampled
+}
+
+// configFile is the format of the CONFIG_FILE. Settings left out keep their
+// defaults.
+type configFile struct {
+	Server struct {
+		Port       string `yaml:"port"`
+		AdminToken string `yaml:"admin_token"`
+	} `yaml:"server"`
+
+	Upstream struct {
+		ConsumerNodeURL string `yaml:"consumer_node_url"`
+		MarketplaceURL  string `yaml:"marketplace_url"`
+		AuthToken       string `yaml:"auth_token"`
+		SessionFailover bool   `yaml:"session_failover"`
+
+		CredentialsSource string `yaml:"credentials_source"`
+		CookieFile        string `yaml:"cookie_file"`
+		SecretsFile       string `yaml:"secrets_file"`
+	} `yaml:"upstream"`
+
+	Auth struct {
+		Disabled           bool          `yaml:"disabled"`
+		KeysFile           string        `yaml:"keys_file"`
+		KeysReloadInterval time.Duration `yaml:"keys_reload_interval"`
+		Keys               []APIKey      `yaml:"keys"`
+	} `yaml:"auth"`
+
+	Ledger struct {
+		File string `yaml:"file"`
+	} `yaml:"ledger"`
+
+	Models struct {
+		RefreshInterval time.Duration     `yaml:"refresh_interval"`
+		Aliases         map[string]string `yaml:"aliases"`
+	} `yaml:"models"`
+
+	Sessions struct {
+		Duration        time.Duration `yaml:"duration"`
+		Fee             string        `yaml:"fee"`
+		Stake           string        `yaml:"stake"`
+		DirectPayment   bool          `yaml:"direct_payment"`
+		RenewBefore     time.Duration `yaml:"renew_before"`
+		PoolByCaller    bool          `yaml:"pool_by_caller"`
+		SelectionPolicy string        `yaml:"selection_policy"`
+		Limits          struct {
+			MinDuration        time.Duration `yaml:"min_duration"`
+			MaxDuration        time.Duration `yaml:"max_duration"`
+			MaxFee             string        `yaml:"max_fee"`
+			MaxStake           string        `yaml:"max_stake"`
+			AllowDirectPayment bool          `yaml:"allow_direct_payment"`
+		} `yaml:"limits"`
+	} `yaml:"sessions"`
+
+	Timeouts struct {
+		SessionOpen              time.Duration `yaml:"session_open"`
+		SessionReady             time.Duration `yaml:"session_ready"`
+		SessionReadyPollInterval time.Duration `yaml:"session_ready_poll_interval"`
+		Shutdown                 time.Duration `yaml:"shutdown"`
+	} `yaml:"timeouts"`
+
+	Retry struct {
+		Attempts             int           `yaml:"attempts"`
+		Backoff              time.Duration `yaml:"backoff"`
+		BidFailoverAttempts  int           `yaml:"bid_failover_attempts"`
+		StreamResumeAttempts int           `yaml:"stream_resume_attempts"`
+	} `yaml:"retry"`
+
+	Wallet struct {
+		DiamondContract    string        `yaml:"diamond_contract"`
+		AutoApproveCeiling string        `yaml:"auto_approve_ceiling"`
+		MonitorInterval    time.Duration `yaml:"monitor_interval"`
+	} `yaml:"wallet"`
+
+	Queue struct {
+		MaxConcurrentPerModel int           `yaml:"max_concurrent_per_model"`
+		MaxConcurrentPerKey   int           `yaml:"max_concurrent_per_key"`
+		Size                  int           `yaml:"size"`
+		MaxWait               time.Duration `yaml:"max_wait"`
+	} `yaml:"queue"`
+
+	RateLimits struct {
+		Key               RateLimit            `yaml:"key"`
+		IP                RateLimit            `yaml:"ip"`
+		Model             RateLimit            `yaml:"model"`
+		Models            map[string]RateLimit `yaml:"models"`
+		TrustForwardedFor bool                 `yaml:"trust_forwarded_for"`
+		ForwardedForHops  int                  `yaml:"forwarded_for_hops"`
+	} `yaml:"rate_limits"`
+
+	Cache struct {
+		Enabled    bool          `yaml:"enabled"`
+		Shared     bool          `yaml:"shared"`
+		File       string        `yaml:"file"`
+		TTL        time.Duration `yaml:"ttl"`
+		MaxEntries int           `yaml:"max_entries"`
+		MaxBytes   int           `yaml:"max_bytes"`
+	} `yaml:"cache"`
+
+	Alerts struct {
+		Webhooks             []string      `yaml:"webhooks"`
+		MinETHBalance        string        `yaml:"min_eth_balance"`
+		MinMORBalance        string        `yaml:"min_mor_balance"`
+		SessionFailureRate   float64       `yaml:"session_failure_rate"`
+		SessionFailureWindow time.Duration `yaml:"session_failure_window"`
+		BudgetThreshold      float64       `yaml:"budget_threshold"`
+	} `yaml:"alerts"`
+
+	Logging struct {
+		Level   string `yaml:"level"`
+		Format  string `yaml:"format"`
+		Content bool   `yaml:"content"`
+	} `yaml:"logging"`
+
+	Tracing struct {
+		Endpoint    string  `yaml:"endpoint"`
+		ServiceName string  `yaml:"service_name"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	} `yaml:"tracing"`
+}
+
+// defaultConfigFile holds the defaults of every setting
+func defaultConfigFile() configFile {
+	var f configFile
+	f.Server.Port = "8081"
+	f.Upstream.CredentialsSource = credentialsAuto
+	f.Upstream.CookieFile = ".cookie"
+	f.Auth.KeysReloadInterval = 10 * time.Second
+	f.Models.RefreshInterval = 5 * time.Minute
+	f.Sessions.Duration = time.Hour
+	f.Sessions.Fee = defaultSessionFee
+	f.Sessions.RenewBefore = 5 * time.Minute
+	f.Sessions.Limits.MinDuration = time.Minute
+	f.Sessions.Limits.MaxDuration = 24 * time.Hour
+	f.Sessions.Limits.AllowDirectPayment = true
+	f.Timeouts.SessionOpen = 60 * time.Second
+	f.Timeouts.SessionReady = 30 * time.Second
+	f.Timeouts.SessionReadyPollInterval = 500 * time.Millisecond
+	f.Timeouts.Shutdown = 25 * time.Second
+	f.Retry.Attempts = 3
+	f.Retry.Backoff = time.Second
+	f.Retry.BidFailoverAttempts = 3
+	f.Queue.Size = 100
+	f.Queue.MaxWait = 30 * time.Second
+	f.RateLimits.ForwardedForHops = 1
+	f.Cache.TTL = time.Hour
+	f.Cache.MaxEntries = 1000
+	f.Cache.MaxBytes = 64 << 20
+	f.Alerts.SessionFailureRate = 0.5
+	f.Alerts.SessionFailureWindow = 5 * time.Minute
+	f.Alerts.BudgetThreshold = 0.9
+	f.Logging.Level = "info"
+	f.Logging.Format = logFormatJSON
+	f.Tracing.ServiceName = "nfa-proxy"
+	f.Tracing.SampleRatio = 1
+	return f
+}
+
+// ReadConfig reads and validates the configuration from path, which may be
+// empty, and the environment. It has no side effects, so it is safe to use
+// for checking a configuration.
+func ReadConfig(path string) (*Config, error) {
+	file := defaultConfigFile()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	cfg, err := file.config(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// config builds the configuration from the file settings, overriding them
+// with the environment variables that are set
+func (f *configFile) config(path string) (*Config, error) {
+	cfg := &Config{
+		File:            path,
+		ConsumerNodeURL: stringFromEnv("CONSUMER_NODE_URL", f.Upstream.ConsumerNodeURL),
+		MarketplaceURL:  stringFromEnv("MARKETPLACE_URL", f.Upstream.MarketplaceURL),
+		InternalAPIPort: stringFromEnv("INTERNAL_API_PORT", f.Server.Port),
+		AuthToken:       stringFromEnv("AUTH_TOKEN", f.Upstream.AuthToken),
+
+		CredentialsSource: stringFromEnv("CONSUMER_CREDENTIALS_SOURCE", f.Upstream.CredentialsSource),
+		CookieFile:        stringFromEnv("COOKIE_FILE_PATH", f.Upstream.CookieFile),
+		SecretsFile:       stringFromEnv("CONSUMER_SECRETS_FILE", f.Upstream.SecretsFile),
+
+		ModelAliases:    f.Models.Aliases,
+		APIKeys:         f.Auth.Keys,
+		APIKeysFile:     stringFromEnv("API_KEYS_FILE", f.Auth.KeysFile),
+		LedgerFile:      stringFromEnv("LEDGER_FILE", f.Ledger.File),
+		AdminToken:      stringFromEnv("ADMIN_TOKEN", f.Server.AdminToken),
+		SelectionPolicy: stringFromEnv("SELECTION_POLICY", f.Sessions.SelectionPolicy),
+
+		DiamondContract:    stringFromEnv("DIAMOND_CONTRACT", f.Wallet.DiamondContract),
+		AutoApproveCeiling: stringFromEnv("AUTO_APPROVE_CEILING", f.Wallet.AutoApproveCeiling),
+
+		CacheFile: stringFromEnv("CACHE_FILE", f.Cache.File),
+
+		RateLimitModels: f.RateLimits.Models,
+
+		AlertWebhooks:      listFromEnv("ALERT_WEBHOOK_URLS", f.Alerts.Webhooks),
+		AlertMinETHBalance: stringFromEnv("ALERT_MIN_ETH_BALANCE", f.Alerts.MinETHBalance),
+		AlertMinMORBalance: stringFromEnv("ALERT_MIN_MOR_BALANCE", f.Alerts.MinMORBalance),
+
+		LogLevel:  stringFromEnv("LOG_LEVEL", f.Logging.Level),
+		LogFormat: stringFromEnv("LOG_FORMAT", f.Logging.Format),
+
+		TracingEndpoint:    stringFromEnv("OTEL_EXPORTER_OTLP_ENDPOINT", f.Tracing.Endpoint),
+		TracingServiceName: stringFromEnv("OTEL_SERVICE_NAME", f.Tracing.ServiceName),
+		Session: SessionParams{
+			MaxFee: stringFromEnv("SESSION_FEE", f.Sessions.Fee),
+			Stake:  stringFromEnv("SESSION_STAKE", f.Sessions.Stake),
+		},
+		SessionLimits: SessionLimits{
+			MaxFee:   stringFromEnv("SESSION_MAX_FEE", f.Sessions.Limits.MaxFee),
+			MaxStake: stringFromEnv("SESSION_MAX_STAKE", f.Sessions.Limits.MaxStake),
+		},
+	}
+
+	durations := []struct {
+		name  string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{"SESSION_DURATION", &cfg.Session.Duration, f.Sessions.Duration},
+		{"SESSION_MIN_DURATION", &cfg.SessionLimits.MinDuration, f.Sessions.Limits.MinDuration},
+		{"SESSION_MAX_DURATION", &cfg.SessionLimits.MaxDuration, f.Sessions.Limits.MaxDuration},
+		{"SESSION_RENEW_BEFORE", &cfg.SessionRenewBefore, f.Sessions.RenewBefore},
+		{"SESSION_OPEN_TIMEOUT", &cfg.SessionOpenTimeout, f.Timeouts.SessionOpen},
+		{"SESSION_READY_TIMEOUT", &cfg.SessionReadyTimeout, f.Timeouts.SessionReady},
+		{"SESSION_READY_POLL_INTERVAL", &cfg.SessionReadyPollInterval, f.Timeouts.SessionReadyPollInterval},
+		{"SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout, f.Timeouts.Shutdown},
+		{"RETRY_BACKOFF", &cfg.RetryBackoff, f.Retry.Backoff},
+		{"MODEL_REFRESH_INTERVAL", &cfg.ModelRefreshInterval, f.Models.RefreshInterval},
+		{"API_KEYS_RELOAD_INTERVAL", &cfg.APIKeysReloadInterval, f.Auth.KeysReloadInterval},
+		{"WALLET_MONITOR_INTERVAL", &cfg.WalletMonitorInterval, f.Wallet.MonitorInterval},
+		{"ALERT_SESSION_FAILURE_WINDOW", &cfg.AlertSessionFailureWindow, f.Alerts.SessionFailureWindow},
+		{"CACHE_TTL", &cfg.CacheTTL, f.Cache.TTL},
+		{"QUEUE_MAX_WAIT", &cfg.QueueMaxWait, f.Queue.MaxWait},
+	}
+	var err error
+	for _, d := range durations {
+		if *d.value, err = durationFromEnv(d.name, d.def); err != nil {
+			return nil, err
+		}
+	}
+
+	ints := []struct {
+		name  string
+		value *int
+		def   int
+	}{
+		{"RETRY_ATTEMPTS", &cfg.RetryAttempts, f.Retry.Attempts},
+		{"BID_FAILOVER_ATTEMPTS", &cfg.BidFailoverAttempts, f.Retry.BidFailoverAttempts},
+		{"STREAM_RESUME_ATTEMPTS", &cfg.StreamResumeAttempts, f.Retry.StreamResumeAttempts},
+		{"MAX_CONCURRENT_PER_MODEL", &cfg.MaxConcurrentPerModel, f.Queue.MaxConcurrentPerModel},
+		{"MAX_CONCURRENT_PER_KEY", &cfg.MaxConcurrentPerKey, f.Queue.MaxConcurrentPerKey},
+		{"QUEUE_SIZE", &cfg.QueueSize, f.Queue.Size},
+		{"CACHE_MAX_ENTRIES", &cfg.CacheMaxEntries, f.Cache.MaxEntries},
+		{"CACHE_MAX_BYTES", &cfg.CacheMaxBytes, f.Cache.MaxBytes},
+		{"RATE_LIMIT_KEY_RPM", &cfg.RateLimitKey.RequestsPerMinute, f.RateLimits.Key.RequestsPerMinute},
+		{"RATE_LIMIT_KEY_TPM", &cfg.RateLimitKey.TokensPerMinute, f.RateLimits.Key.TokensPerMinute},
+		{"RATE_LIMIT_IP_RPM", &cfg.RateLimitIP.RequestsPerMinute, f.RateLimits.IP.RequestsPerMinute},
+		{"RATE_LIMIT_IP_TPM", &cfg.RateLimitIP.TokensPerMinute, f.RateLimits.IP.TokensPerMinute},
+		{"RATE_LIMIT_MODEL_RPM", &cfg.RateLimitModel.RequestsPerMinute, f.RateLimits.Model.RequestsPerMinute},
+		{"RATE_LIMIT_MODEL_TPM", &cfg.RateLimitModel.TokensPerMinute, f.RateLimits.Model.TokensPerMinute},
+		{"RATE_LIMIT_FORWARDED_FOR_HOPS", &cfg.RateLimitForwardedForHops, f.RateLimits.ForwardedForHops},
+	}
+	for _, i := range ints {
+		if *i.value, err = intFromEnv(i.name, i.def); err != nil {
+			return nil, err
+		}
+	}
+
+	floats := []struct {
+		name  string
+		value *float64
+		def   float64
+	}{
+		{"TRACING_SAMPLE_RATIO", &cfg.TracingSampleRatio, f.Tracing.SampleRatio},
+		{"ALERT_SESSION_FAILURE_RATE", &cfg.AlertSessionFailureRate, f.Alerts.SessionFailureRate},
+		{"ALERT_BUDGET_THRESHOLD", &cfg.AlertBudgetThreshold, f.Alerts.BudgetThreshold},
+	}
+	for _, fl := range floats {
+		if *fl.value, err = floatFromEnv(fl.name, fl.def); err != nil {
+			return nil, err
+		}
+	}
+
+	bools := []struct {
+		name  string
+		value *bool
+		def   bool
+	}{
+		{"SESSION_DIRECT_PAYMENT", &cfg.Session.DirectPayment, f.Sessions.DirectPayment},
+		{"SESSION_ALLOW_DIRECT_PAYMENT", &cfg.SessionLimits.AllowDirectPayment, f.Sessions.Limits.AllowDirectPayment},
+		{"AUTH_DISABLED", &cfg.AuthDisabled, f.Auth.Disabled},
+		{"SESSION_POOL_BY_CALLER", &cfg.PoolSessionsByCaller, f.Sessions.PoolByCaller},
+		{"SESSION_FAILOVER", &cfg.SessionFailover, f.Upstream.SessionFailover},
+		{"LOG_CONTENT", &cfg.LogContent, f.Logging.Content},
+		{"CACHE_ENABLED", &cfg.CacheEnabled, f.Cache.Enabled},
+		{"CACHE_SHARED", &cfg.CacheShared, f.Cache.Shared},
+		{"RATE_LIMIT_TRUST_FORWARDED_FOR", &cfg.RateLimitTrustForwardedFor, f.RateLimits.TrustForwardedFor},
+	}
+	for _, b := range bools {
+		if *b.value, err = boolFromEnv(b.name, b.def); err != nil {
+			return nil, err
+		}
+	}
+
+	// Balance alerts need balance checks, so configuring a webhook turns them on
+	if cfg.WalletMonitorInterval == 0 && len(cfg.AlertWebhooks) > 0 {
+		cfg.WalletMonitorInterval = defaultAlertMonitorInterval
+	}
+	return cfg, nil
+}
+
+// validate reports every invalid setting at once
+func (c *Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	if c.ConsumerNodeURL == "" {
+		problems = append(problems, "upstream.consumer_node_url (CONSUMER_NODE_URL) is required")
+	} else if u, err := url.Parse(c.ConsumerNodeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("upstream.consumer_node_url %q is not an http(s) URL", c.ConsumerNodeURL))
+	}
+	switch c.CredentialsSource {
+	case "", credentialsAuto, credentialsEnv:
+	case credentialsCookieFile:
+		check(c.CookieFile != "", "upstream.cookie_file (COOKIE_FILE_PATH) is required for the cookie_file credentials source")
+	case credentialsSecretsFile:
+		check(c.SecretsFile != "", "upstream.secrets_file (CONSUMER_SECRETS_FILE) is required for the secrets_file credentials source")
+	default:
+		problems = append(problems, fmt.Sprintf("upstream.credentials_source %q must be auto, env, cookie_file or secrets_file", c.CredentialsSource))
+	}
+	port, err := strconv.Atoi(c.InternalAPIPort)
+	check(err == nil && port > 0 && port < 65536, "server.port %q is not a valid port", c.InternalAPIPort)
+
+	amounts := map[string]string{
+		"sessions.fee":                c.Session.MaxFee,
+		"sessions.stake":              c.Session.Stake,
+		"sessions.limits.max_fee":     c.SessionLimits.MaxFee,
+		"sessions.limits.max_stake":   c.SessionLimits.MaxStake,
+		"wallet.auto_approve_ceiling": c.AutoApproveCeiling,
+		"alerts.min_eth_balance":      c.AlertMinETHBalance,
+		"alerts.min_mor_balance":      c.AlertMinMORBalance,
+	}
+	for name, amount := range amounts {
+		check(amount == "" || isWeiAmount(amount), "%s %q is not an integer amount of wei", name, amount)
+	}
+	check(c.Session.Duration > 0, "sessions.duration must be positive")
+	if err := c.SessionLimits.Validate(c.Session); err != nil {
+		problems = append(problems, fmt.Sprintf("default session parameters are out of limits: %v", err))
+	}
+
+	check(c.DiamondContract == "" || addressPattern.MatchString(c.DiamondContract), "wallet.diamond_contract %q is not an address", c.DiamondContract)
+	check(c.AutoApproveCeiling == "" || c.DiamondContract != "", "wallet.diamond_contract (DIAMOND_CONTRACT) is required for wallet.auto_approve_ceiling")
+
+	check(c.WalletMonitorInterval >= 0, "wallet.monitor_interval must not be negative")
+	for i, webhook := range c.AlertWebhooks {
+		u, err := url.Parse(webhook)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "alerts.webhooks entry %d is not an http(s) URL", i+1)
+	}
+	check(c.AlertSessionFailureRate >= 0 && c.AlertSessionFailureRate <= 1, "alerts.session_failure_rate must be between 0 and 1")
+	check(c.AlertSessionFailureWindow > 0, "alerts.session_failure_window must be positive")
+	check(c.AlertBudgetThreshold >= 0 && c.AlertBudgetThreshold <= 1, "alerts.budget_threshold must be between 0 and 1")
+
+	check(c.MaxConcurrentPerModel >= 0, "queue.max_concurrent_per_model must not be negative")
+	check(c.MaxConcurrentPerKey >= 0, "queue.max_concurrent_per_key must not be negative")
+	check(c.QueueSize >= 0, "queue.size must not be negative")
+	check(c.QueueMaxWait > 0, "queue.max_wait must be positive")
+	rateLimits := map[string]RateLimit{
+		"rate_limits.key":   c.RateLimitKey,
+		"rate_limits.ip":    c.RateLimitIP,
+		"rate_limits.model": c.RateLimitModel,
+	}
+	for handle, limit := range c.RateLimitModels {
+		rateLimits[fmt.Sprintf("rate_limits.models[%q]", handle)] = limit
+	}
+	for name, limit := range rateLimits {
+		if err := limit.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	check(c.RateLimitForwardedForHops >= 1, "rate_limits.forwarded_for_hops must be at least 1")
+	check(c.CacheTTL > 0, "cache.ttl must be positive")
+	check(c.CacheMaxEntries > 0, "cache.max_entries must be positive")
+	check(c.CacheMaxBytes > 0, "cache.max_bytes must be positive")
+
+	check(c.SessionOpenTimeout > 0, "timeouts.session_open must be positive")
+	check(c.SessionReadyTimeout >= 0, "timeouts.session_ready must not be negative")
+	check(c.SessionReadyPollInterval >= 0, "timeouts.session_ready_poll_interval must not be negative")
+	check(c.ShutdownTimeout >= 0, "timeouts.shutdown must not be negative")
+	check(c.RetryAttempts >= 1, "retry.attempts must be at least 1")
+	check(c.RetryBackoff >= 0, "retry.backoff must not be negative")
+	check(c.BidFailoverAttempts >= 0, "retry.bid_failover_attempts must not be negative")
+	check(c.StreamResumeAttempts >= 0, "retry.stream_resume_attempts must not be negative")
+	check(c.ModelRefreshInterval > 0, "models.refresh_interval must be positive")
+	check(c.LogLevel == "" || validLogLevel(c.LogLevel), "logging.level %q must be debug, info, warn or error", c.LogLevel)
+	check(c.LogFormat == "" || c.LogFormat == logFormatJSON || c.LogFormat == logFormatText, "logging.format %q must be json or text", c.LogFormat)
+	if c.TracingEndpoint != "" {
+		u, err := url.Parse(c.TracingEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing.endpoint %q is not an http(s) URL", c.TracingEndpoint)
+	}
+	check(c.TracingSampleRatio >= 0 && c.TracingSampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	for alias, handle := range c.ModelAliases {
+		check(alias != "" && handle != "", "models.aliases entry %q: %q must name a model handle", alias, handle)
+	}
+	for i := range c.APIKeys {
+		if err := validateAPIKey(&c.APIKeys[i], nil); err != nil {
+			problems = append(problems, fmt.Sprintf("auth.keys[%d]: %v", i, err))
+		}
+		key := &c.APIKeys[i]
+		check(!key.LimitsSpend() || key.Stake != "" || c.Session.Stake != "",
+			"auth.keys[%d]: a spend cap or budget needs a stake, set on the key or as sessions.stake", i)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// staticKeys are the API keys that do not come from the keys file
+func (c *Config) staticKeys() []APIKey {
+	keys := append([]APIKey(nil), c.APIKeys...)
+	if c.AuthToken != "" {
+		keys = append(keys, APIKey{Key: c.AuthToken, Tenant: "default"})
+	}
+	return keys
+}
+
+// checkKeys fails when no API keys are configured, unless authentication is
+// explicitly disabled
+func (c *Config) checkKeys(keys *KeyStore) error {
+	if keys.Enabled() || c.AuthDisabled {
+		return nil
+	}
+	return fmt.Errorf("no API keys configured: set auth.keys, auth.keys_file (API_KEYS_FILE) or AUTH_TOKEN, or set auth.disabled (AUTH_DISABLED) to serve /v1 routes without authentication")
+}
+
+// checkPolicies fails when the default selection policy is not one of policies.
+// The API keys' policies are checked as the keys are loaded.
+func (c *Config) checkPolicies(policies selectionPolicies) error {
+	if _, ok := policies.lookup(c.SelectionPolicy); c.SelectionPolicy != "" && !ok {
+		return fmt.Errorf("invalid configuration: sessions.selection_policy %q is not a known selection policy", c.SelectionPolicy)
+	}
+	return nil
+}
+
+// modelRateLimit returns the rate limit of the model with handle
+func (c *Config) modelRateLimit(handle string) RateLimit {
+	if limit, ok := c.RateLimitModels[handle]; ok {
+		return limit.or(c.RateLimitModel)
+	}
+	return c.RateLimitModel
+}
+
+// resolveModel returns the model handle an alias stands for, or the handle itself
+func (c *Config) resolveModel(handle string) string {
+	if target, ok := c.ModelAliases[handle]; ok {
+		return target
+	}
+	for alias, target := range c.ModelAliases {
+		if strings.EqualFold(alias, handle) {
+			return target
+		}
+	}
+	return handle
+}
+
+// restartRequired names the settings that differ from old but are only
+// applied when the proxy starts
+func (c *Config) restartRequired(old *Config) []string {
+	var changed []string
+	settings := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"server.port", old.InternalAPIPort, c.InternalAPIPort},
+		{"upstream.credentials_source", old.CredentialsSource, c.CredentialsSource},
+		{"upstream.cookie_file", old.CookieFile, c.CookieFile},
+		{"upstream.secrets_file", old.SecretsFile, c.SecretsFile},
+		{"ledger.file", old.LedgerFile, c.LedgerFile},
+		{"logging.level", old.LogLevel, c.LogLevel},
+		{"logging.format", old.LogFormat, c.LogFormat},
+		{"logging.content", old.LogContent, c.LogContent},
+		{"tracing.endpoint", old.TracingEndpoint, c.TracingEndpoint},
+		{"tracing.service_name", old.TracingServiceName, c.TracingServiceName},
+		{"tracing.sample_ratio", old.TracingSampleRatio, c.TracingSampleRatio},
+		{"cache.enabled", old.CacheEnabled, c.CacheEnabled},
+		{"cache.file", old.CacheFile, c.CacheFile},
+		{"cache.max_entries", old.CacheMaxEntries, c.CacheMaxEntries},
+		{"cache.max_bytes", old.CacheMaxBytes, c.CacheMaxBytes},
+	}
+	for _, setting := range settings {
+		if setting.old != setting.new {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// CheckConfig validates the configuration in path and the environment,
+// including the API keys file, without starting anything
+func CheckConfig(path string) error {
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.checkPolicies(builtinPolicies); err != nil {
+		return err
+	}
+	keys, err := NewKeyStore(cfg.APIKeysFile, cfg.staticKeys(), 0)
+	if err != nil {
+		return err
+	}
+	defer keys.Close()
+	return cfg.checkKeys(keys)
+}
+
+// stringFromEnv returns an environment variable, falling back to def when unset
+func stringFromEnv(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// listFromEnv splits a comma-separated environment variable, falling back to
+// def when unset
+func listFromEnv(name string, def []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// boolFromEnv parses a boolean environment variable, falling back to def when unset
+func boolFromEnv(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q is not a boolean", name, value)
+	}
+	return b, nil
+}
+
+// intFromEnv parses a non-negative integer environment variable, falling back to def when unset
+func intFromEnv(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a non-negative integer", name, value)
+	}
+	return n, nil
+}
+
+// floatFromEnv parses a float environment variable, falling back to def when unset
+func floatFromEnv(name string, def float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q is not a number", name, value)
+	}
+	return f, nil
+}
+
+// durationFromEnv parses a duration environment variable, falling back to def when unset
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,213 @@
+package sessions
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Credentials sources, as set by upstream.credentials_source
+const (
+	credentialsAuto        = "auto"
+	credentialsEnv         = "env"
+	credentialsCookieFile  = "cookie_file"
+	credentialsSecretsFile = "secrets_file"
+)
+
+// Credentials are the Basic Auth credentials of the consumer node
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// String hides the password, so credentials never end up in logs
+func (c Credentials) String() string {
+	return c.Username + ":[REDACTED]"
+}
+
+// CredentialsProvider supplies the consumer node credentials. Implementations
+// must be safe for concurrent use.
+type CredentialsProvider interface {
+	// Credentials returns the current credentials
+	Credentials() (Credentials, error)
+	// Refresh reloads the credentials after the consumer node rejected them
+	Refresh() (Credentials, error)
+}
+
+// StaticCredentials always returns the same credentials
+type StaticCredentials Credentials
+
+func (c StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(c), nil
+}
+
+func (c StaticCredentials) Refresh() (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// EnvCredentials reads CONSUMER_USERNAME and CONSUMER_PASSWORD
+type EnvCredentials struct{}
+
+func (EnvCredentials) Credentials() (Credentials, error) {
+	username := os.Getenv("CONSUMER_USERNAME")
+	if username == "" {
+		return Credentials{}, fmt.Errorf("CONSUMER_USERNAME environment variable is required")
+	}
+	password := os.Getenv("CONSUMER_PASSWORD")
+	if password == "" {
+		return Credentials{}, fmt.Errorf("CONSUMER_PASSWORD environment variable is required")
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
+
+func (e EnvCredentials) Refresh() (Credentials, error) {
+	return e.Credentials()
+}
+
+// fileCredentials reads credentials from a file, re-reading it whenever its
+// modification time or size changes
+type fileCredentials struct {
+	path    string
+	kind    string // Describes the file in errors
+	private bool   // Warn when the file is readable by other users
+	parse   func(data []byte) (Credentials, error)
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	cached  *Credentials
+	modTime time.Time
+	size    int64
+}
+
+// NewCookieFileCredentials reads the cookie file the consumer node writes,
+// which holds "username:password". A rotated cookie is picked up on the next
+// request.
+func NewCookieFileCredentials(path string) CredentialsProvider {
+	return newCookieFileCredentials(path, slog.Default())
+}
+
+func newCookieFileCredentials(path string, logger *slog.Logger) CredentialsProvider {
+	return &fileCredentials{path: path, kind: "cookie file", parse: parseCookie, logger: logger}
+}
+
+// NewSecretsFileCredentials reads a YAML or JSON file with username and
+// password keys, such as a mounted secret. Changes are picked up on the next
+// request.
+func NewSecretsFileCredentials(path string) CredentialsProvider {
+	return newSecretsFileCredentials(path, slog.Default())
+}
+
+func newSecretsFileCredentials(path string, logger *slog.Logger) CredentialsProvider {
+	return &fileCredentials{path: path, kind: "secrets file", private: true, parse: parseSecretsFile, logger: logger}
+}
+
+func (f *fileCredentials) Credentials() (Credentials, error) {
+	return f.load(false)
+}
+
+func (f *fileCredentials) Refresh() (Credentials, error) {
+	return f.load(true)
+}
+
+// load returns the cached credentials unless the file changed or force is set
+func (f *fileCredentials) load(force bool) (Credentials, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to stat %s: %v", f.kind, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !force && f.cached != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return *f.cached, nil
+	}
+
+	if f.private && info.Mode().Perm()&0077 != 0 {
+		f.logger.Warn("Credentials file is accessible by other users", "kind", f.kind, "path", f.path, "mode", info.Mode().Perm().String())
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to read %s: %v", f.kind, err)
+	}
+	credentials, err := f.parse(data)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("invalid %s %s: %v", f.kind, f.path, err)
+	}
+	if f.cached != nil && *f.cached != credentials {
+		f.logger.Info("Credentials file changed", "kind", f.kind, "path", f.path)
+	}
+	f.cached = &credentials
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return credentials, nil
+}
+
+func parseCookie(data []byte) (Credentials, error) {
+	username, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok || username == "" || password == "" {
+		return Credentials{}, fmt.Errorf("expected username:password")
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
+
+func parseSecretsFile(data []byte) (Credentials, error) {
+	var secrets struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	}
+	if err := yaml.Unmarshal(data, &secrets); err != nil {
+		// The parser error may quote the file, so it is not passed on
+		return Credentials{}, fmt.Errorf("expected YAML or JSON with username and password")
+	}
+	if secrets.Username == "" || secrets.Password == "" {
+		return Credentials{}, fmt.Errorf("username and password are required")
+	}
+	return Credentials{Username: secrets.Username, Password: secrets.Password}, nil
+}
+
+// chainCredentials uses the first provider that has credentials
+type chainCredentials []CredentialsProvider
+
+func (c chainCredentials) Credentials() (Credentials, error) {
+	return c.first(CredentialsProvider.Credentials)
+}
+
+func (c chainCredentials) Refresh() (Credentials, error) {
+	return c.first(CredentialsProvider.Refresh)
+}
+
+func (c chainCredentials) first(get func(CredentialsProvider) (Credentials, error)) (Credentials, error) {
+	problems := make([]string, 0, len(c))
+	for _, provider := range c {
+		credentials, err := get(provider)
+		if err == nil {
+			return credentials, nil
+		}
+		problems = append(problems, err.Error())
+	}
+	return Credentials{}, fmt.Errorf("no consumer node credentials found: %s", strings.Join(problems, "; "))
+}
+
+// credentialsProvider returns the provider upstream.credentials_source
+// selects. The automatic choice tries the secrets file, if one is set, then
+// the cookie file, then the environment.
+func (c *Config) credentialsProvider(logger *slog.Logger) CredentialsProvider {
+	switch c.CredentialsSource {
+	case credentialsEnv:
+		return EnvCredentials{}
+	case credentialsCookieFile:
+		return newCookieFileCredentials(c.CookieFile, logger)
+	case credentialsSecretsFile:
+		return newSecretsFileCredentials(c.SecretsFile, logger)
+	}
+
+	var chain chainCredentials
+	if c.SecretsFile != "" {
+		chain = append(chain, newSecretsFileCredentials(c.SecretsFile, logger))
+	}
+	return append(chain, newCookieFileCredentials(c.CookieFile, logger), EnvCredentials{})
+}
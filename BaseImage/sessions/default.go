@@ -0,0 +1,26 @@
+package sessions
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// StartServer serves a server created from CONFIG_FILE and the environment.
+// The server's logger becomes the process default, so the log package writes
+// through it.
+//
+// Deprecated: Use ReadConfig, NewServer and Server.ListenAndServe.
+func StartServer() error {
+	cfg, err := ReadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	defer s.Close()
+	slog.SetDefault(s.Logger())
+	return s.ListenAndServe()
+}
@@ -0,0 +1,110 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Errors the proxy reports with their own status and code, matched with
+// errors.Is
+var (
+	ErrModelNotFound         = errors.New("model not found")
+	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrInsufficientAllowance = errors.New("insufficient allowance")
+	ErrNoProvider            = errors.New("no provider accepting session")
+	ErrUpstreamTimeout       = errors.New("upstream timeout")
+	ErrBudgetExceeded        = errors.New("budget exceeded")
+	ErrQueueFull             = errors.New("request queue is full")
+	ErrQueueTimeout          = errors.New("timed out waiting in the request queue")
+	ErrRateLimited           = errors.New("rate limit exceeded")
+)
+
+// kindError marks an error as one of the errors above without changing its
+// message
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// timeoutError marks err as an upstream timeout when a deadline ran out
+func timeoutError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return withKind(ErrUpstreamTimeout, err)
+	}
+	return err
+}
+
+// errorResponse returns the HTTP status, OpenAI error type and error code
+// clients get for err
+func errorResponse(err error) (int, string, string) {
+	switch {
+	case errors.Is(err, ErrBudgetExceeded):
+		return http.StatusTooManyRequests, "insufficient_quota", "budget_exceeded"
+	case errors.Is(err, ErrQueueFull):
+		return http.StatusTooManyRequests, "rate_limit_error", "queue_full"
+	case errors.Is(err, ErrQueueTimeout):
+		return http.StatusTooManyRequests, "rate_limit_error", "queue_timeout"
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded"
+	case errors.Is(err, ErrInsufficientFunds):
+		return http.StatusPaymentRequired, "insufficient_quota", "insufficient_funds"
+	case errors.Is(err, ErrInsufficientAllowance):
+		return http.StatusPaymentRequired, "insufficient_quota", "insufficient_allowance"
+	case errors.Is(err, ErrModelNotFound):
+		return http.StatusNotFound, "invalid_request_error", "model_not_found"
+	case errors.Is(err, ErrNoProvider):
+		return http.StatusServiceUnavailable, "api_error", "no_provider"
+	case errors.Is(err, ErrSessionNotReady):
+		return http.StatusServiceUnavailable, "api_error", "session_not_ready"
+	case errors.Is(err, ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout, "api_error", "upstream_timeout"
+	case errors.Is(err, ErrStreamInterrupted):
+		return http.StatusBadGateway, "api_error", "stream_interrupted"
+	}
+	return http.StatusBadGateway, "api_error", "upstream_error"
+}
+
+// writeError writes err in the OpenAI format with the status and code of its
+// kind, and Retry-After headers for errors that say when to retry. The OpenAI
+// SDKs prefer retry-after-ms, which keeps sub-second waits precise.
+func writeError(w http.ResponseWriter, err error, message string) {
+	var retry interface{ RetryAfter() time.Duration }
+	if errors.As(err, &retry) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter().Seconds()))))
+		w.Header().Set("retry-after-ms", strconv.FormatInt(int64(math.Ceil(float64(retry.RetryAfter())/float64(time.Millisecond))), 10))
+	}
+	status, errType, code := errorResponse(err)
+	writeOpenAIError(w, status, errType, code, message)
+}
+
+// writeStreamError reports err as an SSE event carrying an OpenAI error, for
+// failures after the stream started and the status was sent
+func writeStreamError(w StreamWriter, err error, message string) {
+	_, errType, code := errorResponse(err)
+	data, _ := json.Marshal(OpenAIError{Error: OpenAIErrorDetail{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	w.Flush()
+}
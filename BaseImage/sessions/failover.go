@@ -0,0 +1,329 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrStreamInterrupted is returned, wrapped, when an upstream stream ends
+// before the completion finished. The partial completion is returned with it.
+var ErrStreamInterrupted = errors.New("stream interrupted")
+
+// BidInfo is a provider's on-chain offer to serve a model
+type BidInfo struct {
+	ID             string        `json:"Id"`
+	Provider       string        `json:"Provider"`
+	ModelAgentID   string        `json:"ModelAgentId"`
+	PricePerSecond NumericString `json:"PricePerSecond"`
+	Nonce          NumericString `json:"Nonce"`
+	CreatedAt      NumericString `json:"CreatedAt"`
+	DeletedAt      NumericString `json:"DeletedAt"`
+}
+
+// ListBids returns the active bids for a model
+func (c *consumerClient) ListBids(ctx context.Context, modelId string) ([]BidInfo, error) {
+	url := fmt.Sprintf("%s/blockchain/models/%s/bids", c.config().ConsumerNodeURL, modelId)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.setBasicAuth(req); err != nil {
+		return nil, fmt.Errorf("failed to set auth: %v", err)
+	}
+
+	client := c.httpClient(&http.Client{Timeout: 10 * time.Second})
+	resp, err := c.do(client, req, upstreamBids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to consumer node: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bid lookup failed, status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var bidsResp struct {
+		Bids []BidInfo `json:"bids"`
+	}
+	if err := json.Unmarshal(respBody, &bidsResp); err != nil {
+		return nil, fmt.Errorf("failed to decode bids response: %v", err)
+	}
+
+	bids := make([]BidInfo, 0, len(bidsResp.Bids))
+	for _, bid := range bidsResp.Bids {
+		if bid.DeletedAt.IsZero() {
+			bids = append(bids, bid)
+		}
+	}
+	return bids, nil
+}
+
+// CreateSessionForBid opens a session with the provider of a specific bid.
+// Unlike CreateSession it makes a single attempt, as callers move on to the
+// next bid on failure.
+func (c *consumerClient) CreateSessionForBid(ctx context.Context, bidId string, params SessionParams) (*SessionResponse, error) {
+	cfg := c.config()
+	url := fmt.Sprintf("%s/blockchain/bids/%s/session", cfg.ConsumerNodeURL, bidId)
+
+	body, err := json.Marshal(params.payload())
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if err := c.setBasicAuth(req); err != nil {
+		return nil, fmt.Errorf("failed to set auth: %v", err)
+	}
+
+	client := c.httpClient(&http.Client{Timeout: cfg.SessionOpenTimeout})
+	resp, err := c.do(client, req, upstreamBidSession)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to consumer node: %w", timeoutError(err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var eResp ErrorResponse
+		if json.Unmarshal(respBody, &eResp) == nil && eResp.Error != "" {
+			return nil, fmt.Errorf("failed to create session: %w", consumerNodeError(eResp.Error))
+		}
+		return nil, fmt.Errorf("failed to create session, status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var sessionResp struct {
+		SessionID string `json:"sessionID"`
+	}
+	if err := json.Unmarshal(respBody, &sessionResp); err != nil {
+		return nil, fmt.Errorf("failed to decode session response: %v", err)
+	}
+
+	c.logger.InfoContext(ctx, "Created session", "session", sessionResp.SessionID, "bid", bidId)
+	return &SessionResponse{
+		SessionToken: sessionResp.SessionID,
+		ExpiresAt:    time.Now().Add(params.Duration),
+	}, nil
+}
+
+// openOnBids opens a session on the first of up to attempts bids that accepts.
+// cause is the error that made the consumer node's own pick fail, if any;
+// every bid tried after a failure counts as a failover.
+func (p *SessionPool) openOnBids(ctx context.Context, key sessionKey, req sessionRequest, bids []BidInfo, attempts int, cause error) (*SessionResponse, error) {
+	lastErr := cause
+	tried := 0
+	for _, bid := range bids {
+		if tried == attempts {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		tried++
+
+		if lastErr != nil {
+			p.s.logger.InfoContext(ctx, "Failing over to another bid", "bid", bid.ID, "provider", bid.Provider, "model", key.ModelID)
+			p.s.metrics.failovers.WithLabelValues(req.modelLabel(), "bid").Inc()
+		}
+		session, err := p.s.manager.CreateSessionForBid(ctx, bid.ID, req.Params)
+		if err == nil {
+			session.Provider = bid.Provider
+			session.BidID = bid.ID
+			return session, nil
+		}
+		p.s.logger.WarnContext(ctx, "Error opening session on bid", "bid", bid.ID, "error", err)
+		if ctx.Err() == nil {
+			p.s.providers.RecordFailure(bid.Provider)
+		}
+		lastErr = err
+	}
+	if tried == 0 {
+		return nil, cause
+	}
+	return nil, fmt.Errorf("%w for model %s after trying %d bids: %w", ErrNoProvider, key.ModelID, tried, lastErr)
+}
+
+// streamChat streams a completion to w. When STREAM_RESUME_ATTEMPTS is set and
+// the upstream stream breaks off, the session is discarded and the completion
+// resumed on a new one, so the client keeps receiving a single stream.
+func (s *Server) streamChat(ctx context.Context, key sessionKey, sessReq sessionRequest, session *SessionResponse, chatReq *ChatCompletionRequest, w StreamWriter) (*ChatResponse, error) {
+	req := chatReq
+	var partial strings.Builder
+	relay := &resumableWriter{StreamWriter: w}
+	for attempt := 0; ; attempt++ {
+		sent := time.Now()
+		timed := &firstWriteWriter{StreamWriter: relay}
+		resp, err := s.manager.SendChatMessage(ctx, session.SessionToken, key.ModelID, req, timed)
+		s.providers.recordOutcome(ctx, session, sent, timed.first, err)
+		if err == nil && partial.Len() > 0 && resp != nil && len(resp.Choices) == 1 {
+			// The client received the whole completion, so report all of it
+			resp.Choices[0].Message.Content = partial.String() + resp.Choices[0].Message.Content
+		}
+		if err == nil || !errors.Is(err, ErrStreamInterrupted) || ctx.Err() != nil || attempt >= s.config().StreamResumeAttempts {
+			return resp, err
+		}
+		content, ok := partialContent(resp)
+		if !ok {
+			return resp, err
+		}
+		partial.WriteString(content)
+
+		s.logger.WarnContext(ctx, "Stream broke off, resuming on a new session",
+			"session", session.SessionToken, "error", err, "characters", partial.Len())
+		s.metrics.failovers.WithLabelValues(sessReq.modelLabel(), "stream_resume").Inc()
+		s.pool.Discard(key, session.SessionToken)
+
+		next, acquireErr := s.pool.Acquire(ctx, key, sessReq)
+		if acquireErr != nil {
+			s.logger.ErrorContext(ctx, "Error opening a session to resume the stream", "error", acquireErr)
+			return resp, err
+		}
+		session = next
+		req = resumeRequest(chatReq, partial.String())
+		relay.resumed = true
+	}
+}
+
+// resumableWriter relays a stream that may be resumed on a new session. Once
+// resumed, the new upstream's chunks are rewritten to continue the first
+// ones: they keep the completion's id and created time, and chunks that only
+// repeat the assistant role are dropped, so clients assemble one completion.
+type resumableWriter struct {
+	StreamWriter
+	resumed bool
+	id      json.RawMessage
+	created json.RawMessage
+}
+
+// Write relays the SSE events in b, rewriting them once the stream resumed
+func (w *resumableWriter) Write(b []byte) (int, error) {
+	var out bytes.Buffer
+	for _, event := range strings.SplitAfter(string(b), "\n\n") {
+		data, ok := strings.CutPrefix(event, "data: ")
+		if !ok || strings.HasPrefix(data, "[DONE]") {
+			out.WriteString(event)
+			continue
+		}
+		var chunk map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			out.WriteString(event)
+			continue
+		}
+		if !w.resumed {
+			if w.id == nil {
+				w.id, w.created = chunk["id"], chunk["created"]
+			}
+			out.WriteString(event)
+			continue
+		}
+		if !continueChunk(chunk, w.id, w.created) {
+			continue
+		}
+		rewritten, err := json.Marshal(chunk)
+		if err != nil {
+			out.WriteString(event)
+			continue
+		}
+		fmt.Fprintf(&out, "data: %s\n\n", rewritten)
+	}
+	if _, err := w.StreamWriter.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// continueChunk rewrites a chunk of a resumed stream to carry the original id
+// and created time, without the assistant role. It reports false for chunks
+// left with nothing to relay.
+func continueChunk(chunk map[string]json.RawMessage, id, created json.RawMessage) bool {
+	if id != nil {
+		chunk["id"] = id
+	}
+	if created != nil {
+		chunk["created"] = created
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(chunk["choices"], &choices); err != nil {
+		return true
+	}
+	empty := len(choices) > 0
+	for _, choice := range choices {
+		var delta map[string]json.RawMessage
+		if err := json.Unmarshal(choice["delta"], &delta); err == nil {
+			delete(delta, "role")
+			choice["delta"], _ = json.Marshal(delta)
+		}
+		for _, value := range delta {
+			empty = empty && isEmptyJSON(value)
+		}
+		empty = empty && isEmptyJSON(choice["finish_reason"])
+	}
+	chunk["choices"], _ = json.Marshal(choices)
+	return !empty || !isEmptyJSON(chunk["usage"])
+}
+
+// isEmptyJSON reports whether value is missing, null or an empty string
+func isEmptyJSON(value json.RawMessage) bool {
+	switch string(value) {
+	case "", "null", `""`:
+		return true
+	}
+	return false
+}
+
+// firstWriteWriter notes when the first chunk of a stream was written
+type firstWriteWriter struct {
+	StreamWriter
+	first time.Time
+}
+
+func (w *firstWriteWriter) Write(b []byte) (int, error) {
+	if w.first.IsZero() {
+		w.first = time.Now()
+	}
+	return w.StreamWriter.Write(b)
+}
+
+// resumeRequest continues an interrupted completion: the conversation is sent
+// again with the assistant output received so far as the final message
+func resumeRequest(chatReq *ChatCompletionRequest, partial string) *ChatCompletionRequest {
+	resumed := *chatReq
+	resumed.Messages = append(append([]ChatMessage(nil), chatReq.Messages...), ChatMessage{
+		Role:    "assistant",
+		Content: partial,
+	})
+	return &resumed
+}
+
+// partialContent returns the assistant text of an interrupted completion and
+// whether the completion can be resumed from it. Completions with several
+// choices or tool calls cannot be continued from text alone.
+func partialContent(resp *ChatResponse) (string, bool) {
+	if resp == nil || len(resp.Choices) == 0 {
+		return "", true
+	}
+	if len(resp.Choices) > 1 || len(resp.Choices[0].Message.ToolCalls) > 0 {
+		return "", false
+	}
+	return resp.Choices[0].Message.Content, true
+}
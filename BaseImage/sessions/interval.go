@@ -0,0 +1,63 @@
+package sessions
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// loopInterval is the period of a background loop. A configuration reload can
+// change it while the loop runs.
+type loopInterval struct {
+	d     atomic.Int64
+	reset chan struct{}
+}
+
+func newLoopInterval(d time.Duration) *loopInterval {
+	i := &loopInterval{reset: make(chan struct{}, 1)}
+	i.d.Store(int64(d))
+	return i
+}
+
+// Get returns the current interval
+func (i *loopInterval) Get() time.Duration {
+	return time.Duration(i.d.Load())
+}
+
+// Set changes the interval, waking the loop so the new one applies right away
+func (i *loopInterval) Set(d time.Duration) {
+	if i.d.Swap(int64(d)) == int64(d) {
+		return
+	}
+	select {
+	case i.reset <- struct{}{}:
+	default:
+	}
+}
+
+// run calls fn every interval until stop is closed. Nothing runs while the
+// interval is not positive.
+func (i *loopInterval) run(stop <-chan struct{}, fn func()) {
+	for {
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if d := i.Get(); d > 0 {
+			timer = time.NewTimer(d)
+			tick = timer.C
+		}
+
+		stopped := false
+		select {
+		case <-stop:
+			stopped = true
+		case <-i.reset:
+		case <-tick:
+			fn()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package sessions
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SpendRecord is the ledger entry for one blockchain session. Amounts are in
+// wei of MOR; the spend of a session is its fee, plus its stake until the
+// session is closed and the stake returned.
+type SpendRecord struct {
+	SessionID       string     `json:"session_id"`
+	Tenant          string     `json:"tenant"`
+	KeyID           string     `json:"key_id"`
+	Model           string     `json:"model"`
+	ModelID         string     `json:"model_id"`
+	Stake           string     `json:"stake"`
+	Fee             string     `json:"fee"`
+	DurationSeconds int64      `json:"duration_seconds"` // Requested session duration
+	DirectPayment   bool       `json:"direct_payment,omitempty"`
+	OpenedAt        time.Time  `json:"opened_at"`
+	ClosedAt        *time.Time `json:"closed_at,omitempty"`
+}
+
+// Spend returns the MOR the session costs or still holds
+func (r *SpendRecord) Spend() *big.Int {
+	return new(big.Int).Add(r.lockedStake(), parseWei(r.Fee))
+}
+
+// lockedStake returns the stake not yet returned by closing the session
+func (r *SpendRecord) lockedStake() *big.Int {
+	if r.ClosedAt != nil {
+		return new(big.Int)
+	}
+	return parseWei(r.Stake)
+}
+
+// ledgerEvent is a line of the ledger file
+type ledgerEvent struct {
+	Event string `json:"event"` // "open" or "close"
+	SpendRecord
+}
+
+// BudgetExceededError is returned when opening a session would take a key
+// past its spend cap or one of its budgets
+type BudgetExceededError struct {
+	Tenant    string
+	Period    string // "daily", "monthly" or "lifetime"
+	Limit     *big.Int
+	Spent     *big.Int
+	Requested *big.Int
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s budget of %s wei for tenant %s exceeded: %s wei spent, session needs %s wei",
+		e.Period, e.Limit, e.Tenant, e.Spent, e.Requested)
+}
+
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// Ledger records the MOR committed to every session, attributed to the API
+// key that opened it. Records are appended to a file when one is configured
+// so totals survive restarts.
+type Ledger struct {
+	mu       sync.Mutex
+	records  []*SpendRecord
+	open     map[string]*SpendRecord // Sessions not yet closed, by session ID
+	reserved map[*BudgetReservation]struct{}
+	file     *os.File
+	logger   *slog.Logger
+}
+
+// BudgetReservation holds an amount against a key's budgets while its session
+// is being opened, so concurrent opens cannot overrun a budget together
+type BudgetReservation struct {
+	l      *Ledger
+	keyID  string
+	amount *big.Int
+	at     time.Time
+}
+
+// NewLedger creates a ledger, replaying and appending to path when it is set
+func NewLedger(path string) (*Ledger, error) {
+	return newLedger(path, slog.Default())
+}
+
+func newLedger(path string, logger *slog.Logger) (*Ledger, error) {
+	l := &Ledger{
+		open:     make(map[string]*SpendRecord),
+		reserved: make(map[*BudgetReservation]struct{}),
+		logger:   logger,
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	if err := l.replay(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger file: %v", err)
+	}
+	l.file = file
+	return l, nil
+}
+
+// BudgetUsage is what a key spent of one of its budgets
+type BudgetUsage struct {
+	Period string    // "daily", "monthly" or "lifetime"
+	Since  time.Time // Start of the period; zero for the lifetime spend cap
+	Limit  *big.Int
+	Spent  *big.Int
+}
+
+// CheckBudget returns a BudgetExceededError if committing amount would take
+// the key past its spend cap or budgets
+func (l *Ledger) CheckBudget(key *APIKey, amount *big.Int, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkBudgetLocked(key, amount, now)
+}
+
+// Reserve checks the key's budgets like CheckBudget and holds amount against
+// them until the reservation is opened or released
+func (l *Ledger) Reserve(key *APIKey, amount *big.Int, now time.Time) (*BudgetReservation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkBudgetLocked(key, amount, now); err != nil {
+		return nil, err
+	}
+	r := &BudgetReservation{l: l, amount: amount, at: now}
+	if key != nil {
+		r.keyID = key.ID()
+	}
+	l.reserved[r] = struct{}{}
+	return r, nil
+}
+
+// Open records the opened session in place of the reservation
+func (r *BudgetReservation) Open(record SpendRecord) {
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+
+	delete(r.l.reserved, r)
+	r.l.recordOpenLocked(record)
+}
+
+// Release drops the reservation if it was not opened
+func (r *BudgetReservation) Release() {
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+
+	delete(r.l.reserved, r)
+}
+
+func (l *Ledger) checkBudgetLocked(key *APIKey, amount *big.Int, now time.Time) error {
+	for _, usage := range l.budgetUsageLocked(key, now) {
+		if new(big.Int).Add(usage.Spent, amount).Cmp(usage.Limit) > 0 {
+			return &BudgetExceededError{
+				Tenant:    key.Tenant,
+				Period:    usage.Period,
+				Limit:     usage.Limit,
+				Spent:     usage.Spent,
+				Requested: amount,
+			}
+		}
+	}
+	return nil
+}
+
+// BudgetUsage returns what the key spent of each budget it has, as of now
+func (l *Ledger) BudgetUsage(key *APIKey, now time.Time) []BudgetUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.budgetUsageLocked(key, now)
+}
+
+func (l *Ledger) budgetUsageLocked(key *APIKey, now time.Time) []BudgetUsage {
+	if key == nil {
+		return nil
+	}
+
+	limits := []struct {
+		period string
+		limit  string
+		since  time.Time
+	}{
+		{"daily", key.DailyBudget, startOfDay(now)},
+		{"monthly", key.MonthlyBudget, startOfMonth(now)},
+		{"lifetime", key.SpendCap, time.Time{}},
+	}
+
+	var usage []BudgetUsage
+	for _, limit := range limits {
+		if limit.limit == "" {
+			continue
+		}
+		usage = append(usage, BudgetUsage{
+			Period: limit.period,
+			Since:  limit.since,
+			Limit:  parseWei(limit.limit),
+			Spent:  l.spentLocked(key.ID(), limit.since),
+		})
+	}
+	return usage
+}
+
+// newSpendRecord describes a session opened for req
+func newSpendRecord(sessionID string, req sessionRequest, openedAt time.Time) SpendRecord {
+	record := SpendRecord{
+		SessionID:       sessionID,
+		Stake:           req.Params.Stake,
+		Fee:             req.Params.MaxFee,
+		DurationSeconds: int64(req.Params.Duration.Seconds()),
+		DirectPayment:   req.Params.DirectPayment,
+		OpenedAt:        openedAt,
+	}
+	if req.Model != nil {
+		record.Model = req.Model.Name
+		record.ModelID = req.Model.ID
+	}
+	if req.APIKey != nil {
+		record.Tenant = req.APIKey.Tenant
+		record.KeyID = req.APIKey.ID()
+	}
+	return record
+}
+
+// RecordOpen adds an opened session to the ledger
+func (l *Ledger) RecordOpen(record SpendRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recordOpenLocked(record)
+}
+
+func (l *Ledger) recordOpenLocked(record SpendRecord) {
+	l.records = append(l.records, &record)
+	l.open[record.SessionID] = &record
+	l.appendLocked(ledgerEvent{Event: "open", SpendRecord: record})
+}
+
+// RecordClose marks a session closed
+func (l *Ledger) RecordClose(sessionID string, closedAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, ok := l.open[sessionID]
+	if !ok {
+		return
+	}
+	delete(l.open, sessionID)
+	record.ClosedAt = &closedAt
+	l.appendLocked(ledgerEvent{Event: "close", SpendRecord: SpendRecord{SessionID: sessionID, ClosedAt: &closedAt}})
+}
+
+// Records returns the sessions opened in [from, to). A zero bound is open.
+func (l *Ledger) Records(from, to time.Time) []SpendRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var records []SpendRecord
+	for _, record := range l.records {
+		if inPeriod(record.OpenedAt, from, to) {
+			records = append(records, *record)
+		}
+	}
+	return records
+}
+
+// Close closes the ledger file
+func (l *Ledger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *Ledger) spentLocked(keyID string, since time.Time) *big.Int {
+	spent := new(big.Int)
+	for _, record := range l.records {
+		if record.KeyID == keyID && !record.OpenedAt.Before(since) {
+			spent.Add(spent, record.Spend())
+		}
+	}
+	for r := range l.reserved {
+		if r.keyID == keyID && !r.at.Before(since) {
+			spent.Add(spent, r.amount)
+		}
+	}
+	return spent
+}
+
+func (l *Ledger) appendLocked(event ledgerEvent) {
+	if l.file == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		l.logger.Error("Error encoding ledger event", "error", err)
+		return
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		l.logger.Error("Error writing ledger event", "session", event.SessionID, "error", err)
+	}
+}
+
+func (l *Ledger) replay(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open ledger file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var event ledgerEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("invalid ledger entry on line %d: %v", line, err)
+		}
+		switch event.Event {
+		case "open":
+			record := event.SpendRecord
+			l.records = append(l.records, &record)
+			l.open[record.SessionID] = &record
+		case "close":
+			if record, ok := l.open[event.SessionID]; ok {
+				record.ClosedAt = event.ClosedAt
+				delete(l.open, event.SessionID)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// SpendTotals sums the spend of a set of sessions
+type SpendTotals struct {
+	Sessions        int    `json:"sessions"`
+	Stake           string `json:"stake"`        // Staked by the sessions, returned when they close
+	LockedStake     string `json:"locked_stake"` // Stake of the sessions still open
+	Fee             string `json:"fee"`
+	Total           string `json:"total"`            // Fee plus locked stake
+	DurationSeconds int64  `json:"duration_seconds"` // Time sessions were open, up to now for open ones
+}
+
+// KeySpend is the spend attributed to one API key
+type KeySpend struct {
+	Tenant string                 `json:"tenant"`
+	KeyID  string                 `json:"key_id"`
+	Totals SpendTotals            `json:"totals"`
+	Models map[string]SpendTotals `json:"models"`
+}
+
+// SpendReport is the response of the admin spend endpoint
+type SpendReport struct {
+	From   *time.Time  `json:"from,omitempty"`
+	To     *time.Time  `json:"to,omitempty"`
+	Totals SpendTotals `json:"totals"`
+	Keys   []KeySpend  `json:"keys"`
+}
+
+// spendAccumulator adds up SpendTotals with exact amounts
+type spendAccumulator struct {
+	sessions int
+	stake    big.Int
+	locked   big.Int
+	fee      big.Int
+	duration time.Duration
+}
+
+func (a *spendAccumulator) add(record SpendRecord, now time.Time) {
+	a.sessions++
+	a.stake.Add(&a.stake, parseWei(record.Stake))
+	a.locked.Add(&a.locked, record.lockedStake())
+	a.fee.Add(&a.fee, parseWei(record.Fee))
+	closedAt := now
+	if record.ClosedAt != nil {
+		closedAt = *record.ClosedAt
+	}
+	a.duration += closedAt.Sub(record.OpenedAt)
+}
+
+func (a *spendAccumulator) totals() SpendTotals {
+	return SpendTotals{
+		Sessions:        a.sessions,
+		Stake:           a.stake.String(),
+		LockedStake:     a.locked.String(),
+		Fee:             a.fee.String(),
+		Total:           new(big.Int).Add(&a.locked, &a.fee).String(),
+		DurationSeconds: int64(a.duration.Seconds()),
+	}
+}
+
+// BuildSpendReport totals records per key and model, optionally limited to a tenant
+func BuildSpendReport(records []SpendRecord, tenant string, now time.Time) SpendReport {
+	type keyAccumulator struct {
+		tenant string
+		keyID  string
+		totals spendAccumulator
+		models map[string]*spendAccumulator
+	}
+
+	var total spendAccumulator
+	keys := make(map[string]*keyAccumulator)
+	for _, record := range records {
+		if tenant != "" && record.Tenant != tenant {
+			continue
+		}
+		id := record.Tenant + "/" + record.KeyID
+		acc, ok := keys[id]
+		if !ok {
+			acc = &keyAccumulator{tenant: record.Tenant, keyID: record.KeyID, models: make(map[string]*spendAccumulator)}
+			keys[id] = acc
+		}
+		model, ok := acc.models[record.Model]
+		if !ok {
+			model = &spendAccumulator{}
+			acc.models[record.Model] = model
+		}
+		total.add(record, now)
+		acc.totals.add(record, now)
+		model.add(record, now)
+	}
+
+	report := SpendReport{Totals: total.totals(), Keys: make([]KeySpend, 0, len(keys))}
+	for _, acc := range keys {
+		spend := KeySpend{
+			Tenant: acc.tenant,
+			KeyID:  acc.keyID,
+			Totals: acc.totals.totals(),
+			Models: make(map[string]SpendTotals, len(acc.models)),
+		}
+		for model, modelAcc := range acc.models {
+			spend.Models[model] = modelAcc.totals()
+		}
+		report.Keys = append(report.Keys, spend)
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		if report.Keys[i].Tenant != report.Keys[j].Tenant {
+			return report.Keys[i].Tenant < report.Keys[j].Tenant
+		}
+		return report.Keys[i].KeyID < report.Keys[j].KeyID
+	})
+	return report
+}
+
+// parseWei parses a wei amount, treating empty or invalid values as zero
+func parseWei(amount string) *big.Int {
+	value, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return value
+}
+
+func inPeriod(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !t.Before(to) {
+		return false
+	}
+	return true
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,219 @@
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats, as set by logging.format
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+const redacted = "[REDACTED]"
+
+// Attribute keys whose values are never logged
+var secretKeyParts = []string{"authorization", "password", "secret", "private_key", "privatekey", "api_key", "apikey", "cookie", "credentials"}
+
+// Attribute keys holding prompt or completion content, logged only when
+// logging.content is set
+var contentKeys = map[string]bool{
+	"prompt":        true,
+	"messages":      true,
+	"content":       true,
+	"completion":    true,
+	"request_body":  true,
+	"response_body": true,
+}
+
+// Headers whose values are never logged
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+var (
+	// Bare 64 digit hex strings are wallet private keys. Session IDs and
+	// transaction hashes have the same length but carry a 0x prefix.
+	privateKeyPattern = regexp.MustCompile(`\b[0-9a-fA-F]{64}\b`)
+	authSchemePattern = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+
+	// Request IDs clients may choose; others are replaced so they cannot
+	// inject into logs or upstream headers
+	requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+)
+
+// NewLogger creates a logger writing to w at the configured level and in the
+// configured format, with secrets and, unless logging.content is set, prompt
+// and completion content redacted
+func NewLogger(w io.Writer, cfg *Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(cfg.LogLevel)}
+	var handler slog.Handler
+	if cfg.LogFormat == logFormatText {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(NewRedactingHandler(handler, cfg.LogContent))
+}
+
+// NewRedactingHandler wraps a handler so that auth headers, credentials and
+// private keys never reach it, and prompt and completion content only does
+// when logContent is set. Records logged with a request's context carry its
+// request_id and, when it is traced, trace_id.
+func NewRedactingHandler(handler slog.Handler, logContent bool) slog.Handler {
+	return &redactingHandler{handler: handler, logContent: logContent}
+}
+
+type redactingHandler struct {
+	handler    slog.Handler
+	logContent bool
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	record := slog.NewRecord(r.Time, r.Level, scrub(r.Message), r.PC)
+	if id := RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		record.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = h.redact(a)
+	}
+	return &redactingHandler{handler: h.handler.WithAttrs(redactedAttrs), logContent: h.logContent}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{handler: h.handler.WithGroup(name), logContent: h.logContent}
+}
+
+// redact returns the attribute as it may be logged
+func (h *redactingHandler) redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+	switch {
+	case isSecretKey(key):
+		return slog.String(a.Key, redacted)
+	case contentKeys[key] && !h.logContent:
+		return slog.String(a.Key, fmt.Sprintf("[REDACTED %d bytes]", len(a.Value.String())))
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, scrub(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redactedGroup := make([]slog.Attr, len(group))
+		for i, member := range group {
+			redactedGroup[i] = h.redact(member)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redactedGroup...)}
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case http.Header:
+			return slog.Any(a.Key, redactedHeaders(v))
+		case error:
+			return slog.String(a.Key, scrub(v.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, scrub(v.String()))
+		}
+	}
+	return a
+}
+
+func isSecretKey(key string) bool {
+	if key == "token" || strings.HasSuffix(key, "_token") {
+		return true
+	}
+	for _, part := range secretKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub removes private keys and Bearer or Basic credentials from a string
+func scrub(s string) string {
+	s = privateKeyPattern.ReplaceAllString(s, redacted)
+	return authSchemePattern.ReplaceAllString(s, "$1 "+redacted)
+}
+
+// redactedHeaders returns a copy of header that is safe to log
+func redactedHeaders(header http.Header) http.Header {
+	redactedHeader := header.Clone()
+	for _, name := range secretHeaders {
+		if redactedHeader.Get(name) != "" {
+			redactedHeader.Set(name, redacted)
+		}
+	}
+	return redactedHeader
+}
+
+// parseLogLevel maps a logging.level setting to a slog level
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID of the proxy request ctx belongs to, or
+// an empty string
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID tags a request with the ID in its X-Request-ID header, or a
+// new one if it has none. The ID is returned in the response, attached to
+// everything logged for the request and sent on to the consumer node.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if RequestIDFromContext(r.Context()) != "" {
+		return r
+	}
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
@@ -0,0 +1,323 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// statusClientClosedRequest is recorded for requests the client abandoned
+const statusClientClosedRequest = 499
+
+// unknownModel labels requests for models that are not registered, so client
+// input cannot create new series
+const unknownModel = "unknown"
+
+// Upstream endpoints, as used in the endpoint label
+const (
+	upstreamModels       = "models"
+	upstreamSessionOpen  = "session_open"
+	upstreamSessionGet   = "session_get"
+	upstreamSessionClose = "session_close"
+	upstreamChat         = "chat"
+	upstreamBids         = "bids"
+	upstreamBidSession   = "bid_session"
+	upstreamBalance      = "balance"
+	upstreamAllowance    = "allowance"
+	upstreamApprove      = "approve"
+)
+
+// serverMetrics are the Prometheus collectors of a Server. Each server has
+// its own registry, so servers embedded in one process report separately.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requestsTotal         *prometheus.CounterVec
+	requestDuration       *prometheus.HistogramVec
+	timeToFirstToken      *prometheus.HistogramVec
+	tokensStreamed        *prometheus.CounterVec
+	sessionCreateAttempts *prometheus.CounterVec
+	sessionCreateRetries  *prometheus.CounterVec
+	sessionCreateFailures *prometheus.CounterVec
+	requestsCancelled     *prometheus.CounterVec
+	failovers             *prometheus.CounterVec
+	upstreamResponses     *prometheus.CounterVec
+	walletBalance         *prometheus.GaugeVec
+	alertsFired           *prometheus.CounterVec
+	alertWebhookErrors    prometheus.Counter
+	queueDepth            *prometheus.GaugeVec
+	queueWait             *prometheus.HistogramVec
+	queueRejections       *prometheus.CounterVec
+	rateLimited           *prometheus.CounterVec
+	cacheRequests         *prometheus.CounterVec
+}
+
+// newServerMetrics creates the collectors of s, including gauges that read
+// its scheduler, cache, pool and model registry when scraped
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_requests_total",
+			Help: "Chat completion requests by model and HTTP status code.",
+		}, []string{"model", "code"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfa_proxy_request_duration_seconds",
+			Help:    "Time to serve chat completion requests, including streaming.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+		}, []string{"model"}),
+
+		timeToFirstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfa_proxy_time_to_first_token_seconds",
+			Help:    "Time from receiving a streaming request to relaying its first chunk.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30},
+		}, []string{"model"}),
+
+		tokensStreamed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_streamed_tokens_total",
+			Help: "Completion tokens streamed to clients, from reported usage or one per chunk when usage is not reported.",
+		}, []string{"model"}),
+
+		sessionCreateAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_session_create_attempts_total",
+			Help: "Requests made to the consumer node to open a session.",
+		}, []string{"model"}),
+
+		sessionCreateRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_session_create_retries_total",
+			Help: "Session open requests retried after a failed attempt.",
+		}, []string{"model"}),
+
+		sessionCreateFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_session_create_failures_total",
+			Help: "Sessions that could not be opened, by reason.",
+		}, []string{"model", "reason"}),
+
+		requestsCancelled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_requests_cancelled_total",
+			Help: "Chat completion requests abandoned by the client, by the stage they were in.",
+		}, []string{"model", "stage"}),
+
+		failovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_failovers_total",
+			Help: "Failovers by kind: \"bid\" for sessions opened on an alternative bid, \"stream_resume\" for streams resumed on a new session.",
+		}, []string{"model", "kind"}),
+
+		upstreamResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_upstream_responses_total",
+			Help: "Consumer node responses by endpoint and status code; code is \"error\" when no response was received.",
+		}, []string{"endpoint", "code"}),
+
+		walletBalance: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfa_proxy_wallet_balance",
+			Help: "Consumer node wallet balance in whole tokens, by asset, as of the last balance check.",
+		}, []string{"asset"}),
+
+		alertsFired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_alerts_total",
+			Help: "Alerts fired, by alert.",
+		}, []string{"alert"}),
+
+		alertWebhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nfa_proxy_alert_webhook_errors_total",
+			Help: "Alert webhook deliveries that failed.",
+		}),
+
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfa_proxy_queue_depth",
+			Help: "Chat completion requests waiting for their turn to go upstream.",
+		}, []string{"model"}),
+
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfa_proxy_queue_wait_seconds",
+			Help:    "Time requests waited in the queue before going upstream or giving up.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"model"}),
+
+		queueRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_queue_rejections_total",
+			Help: "Requests turned away by the queue, by reason: \"full\" or \"timeout\".",
+		}, []string{"model", "reason"}),
+
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_rate_limited_total",
+			Help: "Requests rejected by a rate limit, by scope (\"key\", \"ip\" or \"model\") and limit (\"requests\" or \"tokens\").",
+		}, []string{"scope", "limit"}),
+
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfa_proxy_cache_requests_total",
+			Help: "Cacheable chat completion requests by result: \"hit\" when answered from the response cache, \"miss\" otherwise.",
+		}, []string{"model", "result"}),
+	}
+
+	upstreamInFlight := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nfa_proxy_upstream_requests_in_flight",
+		Help: "Chat completion requests admitted by the queue and not yet done.",
+	}, func() float64 {
+		return float64(s.scheduler.Status().Running)
+	})
+
+	cachedResponses := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nfa_proxy_cached_responses",
+		Help: "Responses held in the response cache.",
+	}, func() float64 {
+		return float64(s.cache.Len())
+	})
+
+	activeSessions := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nfa_proxy_active_sessions",
+		Help: "Blockchain sessions currently held in the session pool.",
+	}, func() float64 {
+		return float64(s.pool.Len())
+	})
+
+	registryRefreshAge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nfa_proxy_model_registry_refresh_age_seconds",
+		Help: "Seconds since the model list was last refreshed successfully; NaN before the first refresh.",
+	}, func() float64 {
+		status := s.registry.Status()
+		if status.LastRefresh == nil {
+			return math.NaN()
+		}
+		return time.Since(*status.LastRefresh).Seconds()
+	})
+
+	m.registry.MustRegister(
+		m.requestsTotal,
+		m.requestDuration,
+		m.timeToFirstToken,
+		m.tokensStreamed,
+		m.sessionCreateAttempts,
+		m.sessionCreateRetries,
+		m.sessionCreateFailures,
+		m.requestsCancelled,
+		m.failovers,
+		m.upstreamResponses,
+		m.walletBalance,
+		m.alertsFired,
+		m.alertWebhookErrors,
+		m.queueDepth,
+		m.queueWait,
+		m.queueRejections,
+		m.rateLimited,
+		upstreamInFlight,
+		m.cacheRequests,
+		cachedResponses,
+		activeSessions,
+		registryRefreshAge,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler serves the metrics in the Prometheus text format
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// doUpstream sends a request to the consumer node, counting the response
+func (m *serverMetrics) doUpstream(client *http.Client, req *http.Request, endpoint string) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		m.upstreamResponses.WithLabelValues(endpoint, "error").Inc()
+		return nil, err
+	}
+	m.upstreamResponses.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// requestMetrics records the outcome of a chat completion request. Model is
+// updated by the handler once the requested model is resolved.
+type requestMetrics struct {
+	collectors *serverMetrics
+	ctx        context.Context
+	logger     *slog.Logger
+	start      time.Time
+	model      string
+	status     int
+	chunks     int64 // Stream chunks relayed to the client
+	first      time.Time
+}
+
+func newRequestMetrics(ctx context.Context, logger *slog.Logger, collectors *serverMetrics) *requestMetrics {
+	return &requestMetrics{collectors: collectors, ctx: ctx, logger: logger, start: time.Now(), model: unknownModel, status: http.StatusOK}
+}
+
+// observe records the request once it is done. usage is nil when the
+// response did not report token counts.
+func (m *requestMetrics) observe(usage *Usage) {
+	duration := time.Since(m.start)
+	m.collectors.requestsTotal.WithLabelValues(m.model, strconv.Itoa(m.status)).Inc()
+	m.collectors.requestDuration.WithLabelValues(m.model).Observe(duration.Seconds())
+
+	attrs := []any{"model", m.model, "status", m.status, "duration", duration.Round(time.Millisecond).String()}
+	if usage != nil {
+		attrs = append(attrs, "prompt_tokens", usage.PromptTokens, "completion_tokens", usage.CompletionTokens)
+	}
+	m.logger.InfoContext(m.ctx, "Chat completion", attrs...)
+
+	if m.chunks == 0 {
+		return
+	}
+	m.collectors.timeToFirstToken.WithLabelValues(m.model).Observe(m.first.Sub(m.start).Seconds())
+	if usage != nil && usage.CompletionTokens > 0 {
+		m.collectors.tokensStreamed.WithLabelValues(m.model).Add(float64(usage.CompletionTokens))
+	} else {
+		m.collectors.tokensStreamed.WithLabelValues(m.model).Add(float64(m.chunks))
+	}
+}
+
+// cancelled records that the client hung up while the request was in stage.
+// The request is counted with status 499.
+func (m *requestMetrics) cancelled(stage string) {
+	m.status = statusClientClosedRequest
+	m.collectors.requestsCancelled.WithLabelValues(m.model, stage).Inc()
+	m.logger.InfoContext(m.ctx, "Client disconnected, upstream work cancelled",
+		"stage", stage, "model", m.model, "after", time.Since(m.start).Round(time.Millisecond).String())
+}
+
+// metricsResponseWriter records the status code and stream chunks written by
+// the chat completion handler
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	metrics     *requestMetrics
+	wroteHeader bool
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.metrics.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the SSE data events relayed to the client, apart from the
+// final [DONE] and error events
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if bytes.HasPrefix(b, []byte("data: ")) && !bytes.HasPrefix(b, []byte("data: [DONE]")) && !bytes.HasPrefix(b, []byte(`data: {"error"`)) {
+		if w.metrics.chunks == 0 {
+			w.metrics.first = time.Now()
+		}
+		w.metrics.chunks++
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
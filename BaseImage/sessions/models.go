@@ -0,0 +1,125 @@
+package sessions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenAIModel describes a model in the OpenAI models API format, extended with
+// the on-chain model details
+type OpenAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+
+	// Morpheus extensions
+	BlockchainID string   `json:"blockchain_id"`
+	Tags         []string `json:"tags"`
+	Fee          string   `json:"fee"`
+	Stake        string   `json:"stake"`
+}
+
+// OpenAIModelList is the response of GET /v1/models
+type OpenAIModelList struct {
+	Object string        `json:"object"`
+	Data   []OpenAIModel `json:"data"`
+}
+
+// toOpenAIModel translates an on-chain model. Clients address models by
+// handle, so the handle is used as the OpenAI model ID.
+func toOpenAIModel(model ModelInfo) OpenAIModel {
+	created, _ := strconv.ParseInt(string(model.CreatedAt), 10, 64)
+	tags := model.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return OpenAIModel{
+		ID:           model.Name,
+		Object:       "model",
+		Created:      created,
+		OwnedBy:      model.Owner,
+		BlockchainID: model.ID,
+		Tags:         tags,
+		Fee:          string(model.Fee),
+		Stake:        string(model.Stake),
+	}
+}
+
+// handleModels lists the available models in the OpenAI format, optionally
+// filtered by the tag query parameter
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	models, err := s.manager.ListModels(r.Context())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Error listing models", "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "upstream_error", fmt.Sprintf("Error listing models: %v", err))
+		return
+	}
+
+	key := apiKeyFromContext(r.Context())
+	tag := r.URL.Query().Get("tag")
+	list := OpenAIModelList{Object: "list", Data: make([]OpenAIModel, 0, len(models))}
+	for _, model := range models {
+		if key != nil && !key.AllowsModel(model.Name) {
+			continue
+		}
+		if tag == "" || hasTag(model, tag) {
+			list.Data = append(list.Data, toOpenAIModel(model))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleModel describes a single model, looked up by handle or blockchain ID
+func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/models/")
+	if id == "" {
+		s.handleModels(w, r)
+		return
+	}
+
+	models, err := s.manager.ListModels(r.Context())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Error listing models", "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "upstream_error", fmt.Sprintf("Error listing models: %v", err))
+		return
+	}
+
+	key := apiKeyFromContext(r.Context())
+	for _, model := range models {
+		if key != nil && !key.AllowsModel(model.Name) {
+			continue
+		}
+		if strings.EqualFold(model.Name, id) || strings.EqualFold(model.ID, id) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(toOpenAIModel(model))
+			return
+		}
+	}
+
+	writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "model_not_found", fmt.Sprintf("The model '%s' does not exist", id))
+}
+
+func hasTag(model ModelInfo, tag string) bool {
+	for _, t := range model.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
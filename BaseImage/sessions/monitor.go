@@ -0,0 +1,299 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Alerts sent to the alert webhooks
+const (
+	alertWalletBalanceLow      = "wallet_balance_low"
+	alertSessionFailureRate    = "session_failure_rate"
+	alertBudgetNearlyExhausted = "budget_nearly_exhausted"
+)
+
+// Alert states
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// minSessionOpensForAlert is how many sessions must have been opened in the
+// failure window before their failure rate can raise an alert, so a single
+// failure after a quiet spell does not
+const minSessionOpensForAlert = 5
+
+// webhookTimeout bounds each alert webhook delivery
+const webhookTimeout = 10 * time.Second
+
+// defaultAlertMonitorInterval is how often the wallet balance is checked when
+// alert webhooks are configured without a monitor interval
+const defaultAlertMonitorInterval = 5 * time.Minute
+
+// Alert is the JSON body POSTed to every alert webhook
+type Alert struct {
+	Alert   string            `json:"alert"`  // wallet_balance_low, session_failure_rate or budget_nearly_exhausted
+	Status  string            `json:"status"` // firing or resolved
+	Message string            `json:"message"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+// monitor watches the wallet balance, session open failures and budgets, and
+// notifies the alert webhooks when one crosses its threshold. Alerts fire
+// once when a threshold is crossed and resolve when it is crossed back.
+type monitor struct {
+	s      *Server
+	client *http.Client
+
+	mu       sync.Mutex
+	firing   map[string]bool      // Alerts that fired and did not resolve, by alert and subject
+	opens    []sessionOpen        // Session opens within the failure window
+	budgets  map[string]time.Time // Start of the budget period last alerted on, by tenant and period
+	delivery sync.WaitGroup
+
+	interval *loopInterval // How often the wallet balance is checked
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// sessionOpen is the outcome of opening a session
+type sessionOpen struct {
+	at     time.Time
+	failed bool
+}
+
+func newMonitor(s *Server, interval time.Duration) *monitor {
+	m := &monitor{
+		s:        s,
+		client:   &http.Client{Timeout: webhookTimeout},
+		firing:   make(map[string]bool),
+		budgets:  make(map[string]time.Time),
+		interval: newLoopInterval(interval),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go m.pollLoop()
+	return m
+}
+
+func (m *monitor) pollLoop() {
+	defer close(m.done)
+	if m.interval.Get() > 0 {
+		m.checkBalance(context.Background())
+	}
+	m.interval.run(m.stop, func() { m.checkBalance(context.Background()) })
+}
+
+// checkBalance updates the wallet balance metrics and alerts on a balance
+// below its threshold
+func (m *monitor) checkBalance(ctx context.Context) {
+	balance, err := m.s.manager.GetBalance(ctx)
+	if err != nil {
+		m.s.logger.Warn("Error checking the wallet balance", "error", err)
+		return
+	}
+
+	cfg := m.s.config()
+	assets := []struct {
+		name      string
+		balance   NumericString
+		threshold string
+	}{
+		{"ETH", balance.ETH, cfg.AlertMinETHBalance},
+		{"MOR", balance.MOR, cfg.AlertMinMORBalance},
+	}
+	for _, asset := range assets {
+		wei := parseWei(string(asset.balance))
+		m.s.metrics.walletBalance.WithLabelValues(asset.name).Set(weiToTokens(wei))
+		if asset.threshold == "" {
+			continue
+		}
+		threshold := parseWei(asset.threshold)
+		m.update(alertWalletBalanceLow, asset.name, wei.Cmp(threshold) < 0, Alert{
+			Message: fmt.Sprintf("Wallet %s balance of %s wei is below %s wei", asset.name, wei, threshold),
+			Labels:  map[string]string{"asset": asset.name, "balance": wei.String(), "threshold": threshold.String()},
+		})
+	}
+}
+
+// recordSessionOpen notes whether opening a session failed and alerts when
+// the failure rate over the window reaches its threshold
+func (m *monitor) recordSessionOpen(failed bool) {
+	cfg := m.s.config()
+	if cfg.AlertSessionFailureRate == 0 {
+		return
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	kept := m.opens[:0]
+	for _, open := range m.opens {
+		if now.Sub(open.at) < cfg.AlertSessionFailureWindow {
+			kept = append(kept, open)
+		}
+	}
+	m.opens = append(kept, sessionOpen{at: now, failed: failed})
+	var failures int
+	for _, open := range m.opens {
+		if open.failed {
+			failures++
+		}
+	}
+	opens := len(m.opens)
+	m.mu.Unlock()
+
+	if opens < minSessionOpensForAlert {
+		return
+	}
+	rate := float64(failures) / float64(opens)
+	m.update(alertSessionFailureRate, "", rate >= cfg.AlertSessionFailureRate, Alert{
+		Message: fmt.Sprintf("%d of the last %d sessions failed to open within %s", failures, opens, cfg.AlertSessionFailureWindow),
+		Labels: map[string]string{
+			"failures": fmt.Sprint(failures),
+			"opens":    fmt.Sprint(opens),
+			"window":   cfg.AlertSessionFailureWindow.String(),
+		},
+	})
+}
+
+// checkBudgets alerts once per budget period when a key has spent its share
+// of a budget past the alert threshold
+func (m *monitor) checkBudgets(key *APIKey, now time.Time) {
+	cfg := m.s.config()
+	if key == nil || cfg.AlertBudgetThreshold == 0 {
+		return
+	}
+	for _, usage := range m.s.ledger.BudgetUsage(key, now) {
+		threshold := new(big.Float).Mul(new(big.Float).SetInt(usage.Limit), big.NewFloat(cfg.AlertBudgetThreshold))
+		if new(big.Float).SetInt(usage.Spent).Cmp(threshold) < 0 {
+			continue
+		}
+
+		subject := key.Tenant + "/" + usage.Period
+		m.mu.Lock()
+		since, alerted := m.budgets[subject]
+		alerted = alerted && since.Equal(usage.Since)
+		m.budgets[subject] = usage.Since
+		m.mu.Unlock()
+		if alerted {
+			continue
+		}
+
+		m.send(Alert{
+			Alert:   alertBudgetNearlyExhausted,
+			Status:  alertFiring,
+			Message: fmt.Sprintf("Tenant %s has spent %s of its %s budget of %s wei", key.Tenant, usage.Spent, usage.Period, usage.Limit),
+			Labels: map[string]string{
+				"tenant": key.Tenant,
+				"period": usage.Period,
+				"spent":  usage.Spent.String(),
+				"limit":  usage.Limit.String(),
+			},
+		})
+	}
+}
+
+// update fires the alert for subject when active and it is not firing yet,
+// and resolves it when it is no longer active
+func (m *monitor) update(name, subject string, active bool, alert Alert) {
+	id := name + "/" + subject
+	m.mu.Lock()
+	changed := m.firing[id] != active
+	m.firing[id] = active
+	m.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	alert.Alert = name
+	alert.Status = alertResolved
+	if active {
+		alert.Status = alertFiring
+	}
+	m.send(alert)
+}
+
+// send logs the alert and POSTs it to the alert webhooks in the background
+func (m *monitor) send(alert Alert) {
+	alert.Time = time.Now().UTC()
+	if alert.Status == alertFiring {
+		m.s.metrics.alertsFired.WithLabelValues(alert.Alert).Inc()
+		m.s.logger.Warn("Alert firing", "alert", alert.Alert, "message", alert.Message)
+	} else {
+		m.s.logger.Info("Alert resolved", "alert", alert.Alert, "message", alert.Message)
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		m.s.logger.Error("Error encoding alert", "alert", alert.Alert, "error", err)
+		return
+	}
+	for _, webhook := range m.s.config().AlertWebhooks {
+		m.delivery.Add(1)
+		go func(webhook string) {
+			defer m.delivery.Done()
+			if err := m.deliver(webhook, body); err != nil {
+				m.s.metrics.alertWebhookErrors.Inc()
+				m.s.logger.Warn("Error delivering alert", "alert", alert.Alert, "webhook", webhookHost(webhook), "error", err)
+			}
+		}(webhook)
+	}
+}
+
+func (m *monitor) deliver(webhook string, body []byte) error {
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		// Drop the URL the error quotes, its path often holds a secret
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookHost identifies a webhook in logs by its host alone, as webhook URLs
+// often carry a token in their path or query
+func webhookHost(webhook string) string {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// Close stops polling and waits for pending webhook deliveries
+func (m *monitor) Close() {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	<-m.done
+	m.delivery.Wait()
+}
+
+// weiToTokens converts an amount in wei to whole tokens, for metrics
+func weiToTokens(wei *big.Int) float64 {
+	tokens, _ := new(big.Float).Quo(new(big.Float).SetInt(wei), big.NewFloat(1e18)).Float64()
+	return tokens
+}
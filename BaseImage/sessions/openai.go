@@ -0,0 +1,425 @@
+package sessions
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// proxyOnlyFields are ChatCompletionRequest fields consumed by the proxy and
+// never forwarded to the consumer node
+var proxyOnlyFields = []string{"stake_amount", "session_duration", "direct_payment", "max_fee"}
+
+// ChatCompletionRequest is an OpenAI chat completion request. Fields the proxy
+// does not model are kept in Extra and forwarded verbatim.
+type ChatCompletionRequest struct {
+	Model               string             `json:"model"`
+	Messages            []ChatMessage      `json:"messages"`
+	Stream              bool               `json:"stream"`
+	StreamOptions       json.RawMessage    `json:"stream_options,omitempty"`
+	Temperature         *float64           `json:"temperature,omitempty"`
+	TopP                *float64           `json:"top_p,omitempty"`
+	N                   *int               `json:"n,omitempty"`
+	Stop                json.RawMessage    `json:"stop,omitempty"` // String or array of strings
+	MaxTokens           *int               `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int               `json:"max_completion_tokens,omitempty"`
+	PresencePenalty     *float64           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64           `json:"frequency_penalty,omitempty"`
+	LogitBias           map[string]float64 `json:"logit_bias,omitempty"`
+	Logprobs            *bool              `json:"logprobs,omitempty"`
+	TopLogprobs         *int               `json:"top_logprobs,omitempty"`
+	Seed                *int64             `json:"seed,omitempty"`
+	User                string             `json:"user,omitempty"`
+	Tools               json.RawMessage    `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage    `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool              `json:"parallel_tool_calls,omitempty"`
+	ResponseFormat      json.RawMessage    `json:"response_format,omitempty"`
+
+	// Proxy-only fields, see SessionOverrides
+	StakeAmount     string `json:"stake_amount,omitempty"`     // Amount to stake in wei
+	SessionDuration string `json:"session_duration,omitempty"` // Duration such as "30m", or seconds
+	DirectPayment   *bool  `json:"direct_payment,omitempty"`
+	MaxFee          string `json:"max_fee,omitempty"` // Most session fee in wei
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type chatCompletionRequestFields ChatCompletionRequest
+
+func (r *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	var fields chatCompletionRequestFields
+	extra, err := unmarshalWithExtra(data, &fields)
+	if err != nil {
+		return err
+	}
+	*r = ChatCompletionRequest(fields)
+	r.Extra = extra
+	return nil
+}
+
+func (r ChatCompletionRequest) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(chatCompletionRequestFields(r), r.Extra)
+}
+
+// UpstreamBody encodes the request for the consumer node, addressing the model
+// by its blockchain ID and dropping proxy-only fields.
+func (r ChatCompletionRequest) UpstreamBody(modelId string) ([]byte, error) {
+	r.Model = modelId
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range proxyOnlyFields {
+		delete(fields, name)
+	}
+	return json.Marshal(fields)
+}
+
+// ChatMessage is a single message of an OpenAI conversation. Content holds
+// plain text content; ContentParts holds content sent as an array of parts.
+type ChatMessage struct {
+	Role         string          `json:"role"`
+	Content      string          `json:"-"`
+	ContentParts json.RawMessage `json:"-"`
+	Name         string          `json:"name,omitempty"`
+	ToolCalls    json.RawMessage `json:"tool_calls,omitempty"`
+	ToolCallID   string          `json:"tool_call_id,omitempty"`
+	FunctionCall json.RawMessage `json:"function_call,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type plain ChatMessage
+	var fields struct {
+		plain
+		RawContent json.RawMessage `json:"content"`
+	}
+	extra, err := unmarshalWithExtra(data, &fields)
+	if err != nil {
+		return err
+	}
+	*m = ChatMessage(fields.plain)
+	m.Extra = extra
+
+	content := strings.TrimSpace(string(fields.RawContent))
+	switch {
+	case content == "" || content == "null":
+	case strings.HasPrefix(content, "["):
+		m.ContentParts = fields.RawContent
+	default:
+		if err := json.Unmarshal(fields.RawContent, &m.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	type plain ChatMessage
+	fields := struct {
+		plain
+		RawContent json.RawMessage `json:"content"`
+	}{plain: plain(m)}
+
+	switch {
+	case len(m.ContentParts) > 0:
+		fields.RawContent = m.ContentParts
+	case m.Content == "" && (len(m.ToolCalls) > 0 || len(m.FunctionCall) > 0):
+		fields.RawContent = json.RawMessage("null")
+	default:
+		content, err := json.Marshal(m.Content)
+		if err != nil {
+			return nil, err
+		}
+		fields.RawContent = content
+	}
+	return marshalWithExtra(fields, m.Extra)
+}
+
+// unmarshalWithExtra decodes data into v and returns the object members that
+// do not map to one of v's fields
+func unmarshalWithExtra(data []byte, v interface{}) (map[string]json.RawMessage, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	known := jsonFieldNames(reflect.TypeOf(v).Elem())
+	var extra map[string]json.RawMessage
+	for name, value := range all {
+		// encoding/json matches member names case-insensitively
+		if known[strings.ToLower(name)] {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]json.RawMessage)
+		}
+		extra[name] = value
+	}
+	return extra, nil
+}
+
+// marshalWithExtra encodes v and merges the extra members into the object.
+// Members of v take precedence.
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		if _, ok := all[name]; !ok {
+			all[name] = value
+		}
+	}
+	return json.Marshal(all)
+}
+
+var jsonFieldNamesCache sync.Map // reflect.Type -> map[string]bool
+
+// jsonFieldNames returns the lower-cased JSON member names of a struct type,
+// including those of embedded structs
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	if names, ok := jsonFieldNamesCache.Load(t); ok {
+		return names.(map[string]bool)
+	}
+
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			for name := range jsonFieldNames(field.Type) {
+				names[name] = true
+			}
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[strings.ToLower(name)] = true
+	}
+
+	jsonFieldNamesCache.Store(t, names)
+	return names
+}
+
+// ChatResponse is an OpenAI chat.completion object
+type ChatResponse struct {
+	ID                string       `json:"id"`
+	Object            string       `json:"object"`
+	Created           int64        `json:"created"`
+	Model             string       `json:"model"`
+	SystemFingerprint string       `json:"system_fingerprint,omitempty"`
+	Choices           []ChatChoice `json:"choices"`
+	Usage             *Usage       `json:"usage,omitempty"`
+}
+
+// ChatChoice is a single completion choice
+type ChatChoice struct {
+	Index        int             `json:"index"`
+	Message      ChatMessage     `json:"message"`
+	FinishReason *string         `json:"finish_reason"`
+	Logprobs     json.RawMessage `json:"logprobs,omitempty"`
+}
+
+// Usage reports the tokens consumed by a completion
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatCompletionChunk is a single chat.completion.chunk streamed over SSE
+type ChatCompletionChunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
+}
+
+// ChunkChoice carries the delta of a choice in a streamed chunk
+type ChunkChoice struct {
+	Index        int        `json:"index"`
+	Delta        ChunkDelta `json:"delta"`
+	FinishReason *string    `json:"finish_reason"`
+}
+
+// ChunkDelta is the incremental message content of a streamed chunk
+type ChunkDelta struct {
+	Role      string          `json:"role,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// ToolCallDelta is a fragment of a tool call; fragments sharing an index are
+// concatenated
+type ToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+// completionBuilder assembles a chat.completion from streamed chunks
+type completionBuilder struct {
+	resp      ChatResponse
+	content   map[int]*strings.Builder
+	roles     map[int]string
+	finish    map[int]*string
+	toolCalls map[int][]ToolCallDelta
+}
+
+func newCompletionBuilder() *completionBuilder {
+	return &completionBuilder{
+		content:   make(map[int]*strings.Builder),
+		roles:     make(map[int]string),
+		finish:    make(map[int]*string),
+		toolCalls: make(map[int][]ToolCallDelta),
+	}
+}
+
+// Add merges a chunk into the completion
+func (b *completionBuilder) Add(chunk *ChatCompletionChunk) {
+	if b.resp.ID == "" {
+		b.resp.ID = chunk.ID
+		b.resp.Created = chunk.Created
+		b.resp.Model = chunk.Model
+		b.resp.SystemFingerprint = chunk.SystemFingerprint
+	}
+	if chunk.Usage != nil {
+		b.resp.Usage = chunk.Usage
+	}
+
+	for _, choice := range chunk.Choices {
+		if _, ok := b.content[choice.Index]; !ok {
+			b.content[choice.Index] = &strings.Builder{}
+		}
+		b.content[choice.Index].WriteString(choice.Delta.Content)
+		if choice.Delta.Role != "" {
+			b.roles[choice.Index] = choice.Delta.Role
+		}
+		if choice.FinishReason != nil {
+			b.finish[choice.Index] = choice.FinishReason
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			b.addToolCall(choice.Index, call)
+		}
+	}
+}
+
+func (b *completionBuilder) addToolCall(choice int, delta ToolCallDelta) {
+	calls := b.toolCalls[choice]
+	for i := range calls {
+		if calls[i].Index == delta.Index {
+			if delta.ID != "" {
+				calls[i].ID = delta.ID
+			}
+			if delta.Type != "" {
+				calls[i].Type = delta.Type
+			}
+			calls[i].Function.Name += delta.Function.Name
+			calls[i].Function.Arguments += delta.Function.Arguments
+			return
+		}
+	}
+	b.toolCalls[choice] = append(calls, delta)
+}
+
+// Finished reports whether a chunk carried a finish reason
+func (b *completionBuilder) Finished() bool {
+	return len(b.finish) > 0
+}
+
+// Content returns the text assembled so far for the first choice
+func (b *completionBuilder) Content() string {
+	if content, ok := b.content[0]; ok {
+		return content.String()
+	}
+	return ""
+}
+
+// Response returns the assembled chat.completion
+func (b *completionBuilder) Response() *ChatResponse {
+	resp := b.resp
+	resp.Object = "chat.completion"
+	resp.Choices = make([]ChatChoice, 0, len(b.content))
+	for index := 0; index < len(b.content); index++ {
+		content, ok := b.content[index]
+		if !ok {
+			continue
+		}
+		role := b.roles[index]
+		if role == "" {
+			role = "assistant"
+		}
+		choice := ChatChoice{
+			Index:        index,
+			Message:      ChatMessage{Role: role, Content: content.String()},
+			FinishReason: b.finish[index],
+		}
+		if calls := b.toolCalls[index]; len(calls) > 0 {
+			type toolCall struct {
+				ID       string      `json:"id"`
+				Type     string      `json:"type"`
+				Function interface{} `json:"function"`
+			}
+			merged := make([]toolCall, len(calls))
+			for i, call := range calls {
+				merged[i] = toolCall{ID: call.ID, Type: call.Type, Function: call.Function}
+			}
+			choice.Message.ToolCalls, _ = json.Marshal(merged)
+		}
+		resp.Choices = append(resp.Choices, choice)
+	}
+	return &resp
+}
+
+// OpenAIError is the error body returned by OpenAI-compatible endpoints
+type OpenAIError struct {
+	Error OpenAIErrorDetail `json:"error"`
+}
+
+// OpenAIErrorDetail describes an error in the OpenAI format
+type OpenAIErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// writeOpenAIError writes an error in the OpenAI format
+func writeOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OpenAIError{Error: OpenAIErrorDetail{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}})
+}
@@ -0,0 +1,230 @@
+package sessions
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Session parameter headers. Each overrides the matching request body field.
+const (
+	sessionDurationHeader = "X-Morpheus-Session-Duration"
+	directPaymentHeader   = "X-Morpheus-Direct-Payment"
+	maxFeeHeader          = "X-Morpheus-Max-Fee"
+	stakeHeader           = "X-Morpheus-Stake"
+)
+
+// defaultSessionFee is the fee, in wei of MOR, offered when opening a session
+const defaultSessionFee = "300000000000"
+
+// SessionParams are the terms a session is opened on
+type SessionParams struct {
+	Duration      time.Duration
+	DirectPayment bool   // Pay the provider directly instead of staking
+	MaxFee        string // Most fee, in wei of MOR, offered to open the session
+	Stake         string // Stake, in wei of MOR; empty lets the consumer node choose
+}
+
+// spend is the MOR the session commits
+func (p SessionParams) spend() *big.Int {
+	return new(big.Int).Add(parseWei(p.Stake), parseWei(p.MaxFee))
+}
+
+// key identifies the terms in the session pool, so requests asking for
+// different terms never share a session
+func (p SessionParams) key() string {
+	return fmt.Sprintf("%d:%t:%s:%s", int64(p.Duration.Seconds()), p.DirectPayment, p.MaxFee, p.Stake)
+}
+
+// payload is the session terms in the consumer node's session request format
+func (p SessionParams) payload() map[string]interface{} {
+	return map[string]interface{}{
+		"sessionDuration": fmt.Sprintf("%d", int64(p.Duration.Seconds())),
+		"directPayment":   p.DirectPayment,
+		"fee":             p.MaxFee,
+		"stake":           p.Stake,
+	}
+}
+
+// SessionLimits bound the session parameters requests and API keys may ask for
+type SessionLimits struct {
+	MinDuration        time.Duration
+	MaxDuration        time.Duration
+	MaxFee             string // Empty for no limit
+	MaxStake           string // Empty for no limit
+	AllowDirectPayment bool
+}
+
+// Validate checks that params are within the limits
+func (l SessionLimits) Validate(p SessionParams) error {
+	if p.Duration < l.MinDuration {
+		return fmt.Errorf("session duration %s is below the minimum of %s", p.Duration, l.MinDuration)
+	}
+	if l.MaxDuration > 0 && p.Duration > l.MaxDuration {
+		return fmt.Errorf("session duration %s is above the maximum of %s", p.Duration, l.MaxDuration)
+	}
+	if p.DirectPayment && !l.AllowDirectPayment {
+		return fmt.Errorf("direct payment sessions are not allowed")
+	}
+	if l.MaxFee != "" && parseWei(p.MaxFee).Cmp(parseWei(l.MaxFee)) > 0 {
+		return fmt.Errorf("session fee %s is above the maximum of %s wei", p.MaxFee, l.MaxFee)
+	}
+	if l.MaxStake != "" && parseWei(p.Stake).Cmp(parseWei(l.MaxStake)) > 0 {
+		return fmt.Errorf("session stake %s is above the maximum of %s wei", p.Stake, l.MaxStake)
+	}
+	return nil
+}
+
+// SessionOverrides are session parameters asked for by an API key or a
+// request. Empty fields keep the parameters resolved so far.
+type SessionOverrides struct {
+	Duration      string `json:"session_duration,omitempty" yaml:"session_duration"` // Duration such as "30m", or seconds
+	DirectPayment *bool  `json:"direct_payment,omitempty" yaml:"direct_payment"`
+	MaxFee        string `json:"max_fee,omitempty" yaml:"max_fee"` // In wei of MOR
+	Stake         string `json:"stake,omitempty" yaml:"stake"`     // In wei of MOR
+}
+
+// validate checks that the overrides are well formed
+func (o SessionOverrides) validate() error {
+	_, err := o.apply(SessionParams{})
+	return err
+}
+
+// apply returns params with the overrides applied
+func (o SessionOverrides) apply(params SessionParams) (SessionParams, error) {
+	if o.Duration != "" {
+		duration, err := parseSessionDuration(o.Duration)
+		if err != nil {
+			return params, err
+		}
+		params.Duration = duration
+	}
+	if o.DirectPayment != nil {
+		params.DirectPayment = *o.DirectPayment
+	}
+	if o.MaxFee != "" {
+		if !isWeiAmount(o.MaxFee) {
+			return params, fmt.Errorf("max fee %q is not an integer amount of wei", o.MaxFee)
+		}
+		params.MaxFee = o.MaxFee
+	}
+	if o.Stake != "" {
+		if !isWeiAmount(o.Stake) {
+			return params, fmt.Errorf("stake %q is not an integer amount of wei", o.Stake)
+		}
+		params.Stake = o.Stake
+	}
+	return params, nil
+}
+
+// within returns the limits further bounded by the terms the overrides set:
+// requests may ask for shorter sessions, lower fees or stakes than an API key,
+// and for direct payment only when the key does not rule it out
+func (o SessionOverrides) within(limits SessionLimits) (SessionLimits, error) {
+	terms, err := o.apply(SessionParams{})
+	if err != nil {
+		return limits, err
+	}
+	if o.Duration != "" && (limits.MaxDuration == 0 || terms.Duration < limits.MaxDuration) {
+		limits.MaxDuration = terms.Duration
+	}
+	if o.DirectPayment != nil && !*o.DirectPayment {
+		limits.AllowDirectPayment = false
+	}
+	if o.MaxFee != "" && (limits.MaxFee == "" || parseWei(o.MaxFee).Cmp(parseWei(limits.MaxFee)) < 0) {
+		limits.MaxFee = o.MaxFee
+	}
+	if o.Stake != "" && (limits.MaxStake == "" || parseWei(o.Stake).Cmp(parseWei(limits.MaxStake)) < 0) {
+		limits.MaxStake = o.Stake
+	}
+	return limits, nil
+}
+
+// overridesFromHeaders reads the X-Morpheus-* session parameter headers
+func overridesFromHeaders(header http.Header) (SessionOverrides, error) {
+	overrides := SessionOverrides{
+		Duration: header.Get(sessionDurationHeader),
+		MaxFee:   header.Get(maxFeeHeader),
+		Stake:    header.Get(stakeHeader),
+	}
+	if value := header.Get(directPaymentHeader); value != "" {
+		direct, err := strconv.ParseBool(value)
+		if err != nil {
+			return overrides, fmt.Errorf("invalid %s header: %q is not a boolean", directPaymentHeader, value)
+		}
+		overrides.DirectPayment = &direct
+	}
+	return overrides, nil
+}
+
+// sessionParamsFromRequest resolves the terms of the session a request is
+// served on: the configured defaults, then the API key's settings, then the
+// request body's extension fields, then the X-Morpheus-* headers. The result
+// must be within the configured limits, and the terms the key sets are a
+// ceiling for what its requests ask for. Keys with a spend cap or budget need
+// an explicit stake, as the one the consumer node would pick is not known
+// when the session is counted against them.
+func sessionParamsFromRequest(r *http.Request, chatReq *ChatCompletionRequest, cfg *Config) (SessionParams, error) {
+	var layers []SessionOverrides
+	key := apiKeyFromContext(r.Context())
+	if key != nil {
+		layers = append(layers, key.SessionOverrides)
+	}
+	layers = append(layers, SessionOverrides{
+		Duration:      chatReq.SessionDuration,
+		DirectPayment: chatReq.DirectPayment,
+		MaxFee:        chatReq.MaxFee,
+		Stake:         chatReq.StakeAmount,
+	})
+	fromHeaders, err := overridesFromHeaders(r.Header)
+	if err != nil {
+		return SessionParams{}, err
+	}
+	layers = append(layers, fromHeaders)
+
+	params := cfg.Session
+	for _, overrides := range layers {
+		if params, err = overrides.apply(params); err != nil {
+			return SessionParams{}, err
+		}
+	}
+	limits := cfg.SessionLimits
+	if key != nil {
+		if limits, err = key.SessionOverrides.within(limits); err != nil {
+			return SessionParams{}, err
+		}
+	}
+	if err := limits.Validate(params); err != nil {
+		return SessionParams{}, err
+	}
+	if key != nil && key.LimitsSpend() && params.Stake == "" {
+		return SessionParams{}, fmt.Errorf("a stake is required for API keys with a spend cap or budget")
+	}
+	return params, nil
+}
+
+// parseSessionDuration parses a duration such as "30m", or a number of seconds
+func parseSessionDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("session duration %q must be positive", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("session duration %q is neither a duration nor a number of seconds", value)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("session duration %q must be positive", value)
+	}
+	return duration, nil
+}
+
+// isWeiAmount reports whether amount is a non-negative integer
+func isWeiAmount(amount string) bool {
+	value, ok := new(big.Int).SetString(amount, 10)
+	return ok && value.Sign() >= 0
+}
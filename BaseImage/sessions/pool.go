@@ -0,0 +1,378 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// minSessionRemaining is the least time a pooled session must have left to be handed out
+const minSessionRemaining = 30 * time.Second
+
+// sessionKey identifies a pooled session. Caller is empty when auth is
+// disabled; Selection is empty unless a bid selection policy is used.
+type sessionKey struct {
+	ModelID   string
+	Caller    string
+	Selection string
+	Terms     string // SessionParams key
+}
+
+// sessionRequest describes the session a chat request needs
+type sessionRequest struct {
+	Model     *ModelInfo
+	Params    SessionParams
+	APIKey    *APIKey // Key the session's spend is attributed to; nil when auth is disabled
+	Selection bidSelection
+}
+
+func (r sessionRequest) modelLabel() string {
+	if r.Model == nil {
+		return unknownModel
+	}
+	return r.Model.Name
+}
+
+// pooledSession holds the live session for a key. Its mutex is held while the
+// session is opened or renewed so concurrent requests share a single open.
+// An entry is removed from the pool once it holds no session; requests that
+// were waiting on a removed entry start over with a new one.
+type pooledSession struct {
+	mu       sync.Mutex
+	session  *SessionResponse
+	request  sessionRequest
+	lastUsed time.Time
+	openedAt time.Time
+	removed  bool
+}
+
+// SessionPool reuses a Server's blockchain sessions across chat requests
+// until they expire, renewing busy sessions ahead of expiry.
+type SessionPool struct {
+	s        *Server
+	mu       sync.Mutex
+	sessions map[sessionKey]*pooledSession
+	interval *loopInterval // How often expiring sessions are checked
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newSessionPool creates a pool for the server and starts its renewal loop.
+// The renewal window and readiness probes follow the server's configuration.
+func newSessionPool(s *Server) *SessionPool {
+	p := &SessionPool{
+		s:        s,
+		sessions: make(map[sessionKey]*pooledSession),
+		interval: newLoopInterval(renewInterval(s.config().SessionRenewBefore)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.renewLoop()
+	return p
+}
+
+// Acquire returns a live session for the key, opening a new one when there is
+// none or the current one is about to expire. Opening stops if ctx is done.
+func (p *SessionPool) Acquire(ctx context.Context, key sessionKey, req sessionRequest) (*SessionResponse, error) {
+	for {
+		p.mu.Lock()
+		entry, ok := p.sessions[key]
+		if !ok {
+			entry = &pooledSession{}
+			p.sessions[key] = entry
+		}
+		p.mu.Unlock()
+
+		entry.mu.Lock()
+		if entry.removed {
+			entry.mu.Unlock()
+			continue
+		}
+		session, err := p.acquire(ctx, key, entry, req)
+		entry.mu.Unlock()
+		return session, err
+	}
+}
+
+// acquire returns the entry's session, opening one if needed. The caller must
+// hold entry.mu.
+func (p *SessionPool) acquire(ctx context.Context, key sessionKey, entry *pooledSession, req sessionRequest) (*SessionResponse, error) {
+	entry.lastUsed = time.Now()
+	if entry.session != nil && time.Until(entry.session.ExpiresAt) > minSessionRemaining {
+		p.s.logger.DebugContext(ctx, "Reusing session", "session", entry.session.SessionToken, "model", key.ModelID)
+		return entry.session, nil
+	}
+
+	if err := p.open(ctx, key, entry, req); err != nil {
+		if entry.session == nil {
+			p.remove(key, entry)
+		}
+		return nil, err
+	}
+	return entry.session, nil
+}
+
+// remove drops the entry from the pool. The caller must hold entry.mu.
+func (p *SessionPool) remove(key sessionKey, entry *pooledSession) {
+	entry.removed = true
+	p.mu.Lock()
+	if p.sessions[key] == entry {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+}
+
+// Discard closes the key's session if it is still the one given, so the next
+// Acquire opens a new one. Used when a session stops working mid-request.
+func (p *SessionPool) Discard(key sessionKey, sessionToken string) {
+	p.mu.Lock()
+	entry, ok := p.sessions[key]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.session != nil && entry.session.SessionToken == sessionToken {
+		p.s.logger.Info("Discarding session", "session", sessionToken, "model", key.ModelID)
+		go p.closeSession(key, sessionToken)
+		entry.session = nil
+		p.remove(key, entry)
+	}
+}
+
+// Len returns the number of pooled sessions, counting ones being opened
+func (p *SessionPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, entry := range p.sessions {
+		if entry.mu.TryLock() {
+			if entry.session != nil {
+				n++
+			}
+			entry.mu.Unlock()
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the renewal loop and closes every pooled session
+func (p *SessionPool) Close() {
+	select {
+	case <-p.stop:
+		return
+	default:
+		close(p.stop)
+	}
+	<-p.done
+
+	p.mu.Lock()
+	entries := p.sessions
+	p.sessions = make(map[sessionKey]*pooledSession)
+	p.mu.Unlock()
+
+	for key, entry := range entries {
+		entry.mu.Lock()
+		if entry.session != nil {
+			p.closeSession(key, entry.session.SessionToken)
+			entry.session = nil
+		}
+		entry.removed = true
+		entry.mu.Unlock()
+	}
+}
+
+// open replaces the entry's session with a freshly opened one. The caller must
+// hold entry.mu.
+func (p *SessionPool) open(ctx context.Context, key sessionKey, entry *pooledSession, req sessionRequest) error {
+	now := time.Now()
+	reservation, err := p.s.ledger.Reserve(req.APIKey, req.Params.spend(), now)
+	if err != nil {
+		p.s.metrics.sessionCreateFailures.WithLabelValues(req.modelLabel(), "budget").Inc()
+		return err
+	}
+	defer reservation.Release()
+	if err := p.s.checkFunds(ctx, req.Params.spend()); err != nil {
+		p.s.metrics.sessionCreateFailures.WithLabelValues(req.modelLabel(), failureReason(ctx, "funds")).Inc()
+		return err
+	}
+
+	createCtx, createSpan := startSpan(ctx, p.s.tracer, "session.create", trace.WithAttributes(attribute.String("model_id", key.ModelID)))
+	session, err := p.create(createCtx, key, req)
+	endSpan(createSpan, err)
+	if err != nil {
+		p.s.metrics.sessionCreateFailures.WithLabelValues(req.modelLabel(), failureReason(ctx, "create")).Inc()
+		if ctx.Err() == nil {
+			p.s.monitor.recordSessionOpen(true)
+		}
+		return err
+	}
+	reservation.Open(newSpendRecord(session.SessionToken, req, now))
+	p.s.monitor.checkBudgets(req.APIKey, now)
+
+	// Close sessions that never become usable so the stake is returned
+	readyCtx, readySpan := startSpan(ctx, p.s.tracer, "session.ready", trace.WithAttributes(attribute.String("session", session.SessionToken)))
+	cfg := p.s.config()
+	readiness := SessionReadiness{Timeout: cfg.SessionReadyTimeout, PollInterval: cfg.SessionReadyPollInterval}
+	info, err := waitForSessionReady(readyCtx, p.s.manager, p.s.logger, session.SessionToken, readiness)
+	endSpan(readySpan, err)
+	if info != nil && session.Provider == "" && info.Provider != zeroAddress {
+		session.Provider = info.Provider
+		session.BidID = info.BidID
+	}
+	if err != nil {
+		p.s.metrics.sessionCreateFailures.WithLabelValues(req.modelLabel(), failureReason(ctx, "not_ready")).Inc()
+		if ctx.Err() == nil {
+			p.s.providers.RecordFailure(session.Provider)
+			p.s.monitor.recordSessionOpen(true)
+		}
+		go p.closeSession(key, session.SessionToken)
+		return err
+	}
+
+	if old := entry.session; old != nil {
+		go p.closeSession(key, old.SessionToken)
+	}
+	entry.session = session
+	entry.request = req
+	entry.openedAt = time.Now()
+	p.s.monitor.recordSessionOpen(false)
+	p.s.logger.InfoContext(ctx, "Pooled session", "session", session.SessionToken, "model", key.ModelID, "expires_at", session.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// create opens a session on the bid preferred by the request's selection
+// policy, or lets the consumer node pick one and fails over to the model's
+// other bids when no provider accepts
+func (p *SessionPool) create(ctx context.Context, key sessionKey, req sessionRequest) (*SessionResponse, error) {
+	failoverAttempts := p.s.config().BidFailoverAttempts
+	if policy := req.Selection.Policy; policy != nil {
+		bids, err := p.s.manager.ListBids(ctx, key.ModelID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bids: %v", err)
+		}
+		ordered := policy.Order(bids, SelectionInput{Provider: req.Selection.Provider, Stats: p.s.providers.Snapshot()})
+		if len(ordered) == 0 {
+			return nil, fmt.Errorf("%w: no bid for model %s matches the %s selection policy", ErrNoProvider, key.ModelID, policy.Name())
+		}
+		attempts := failoverAttempts
+		if attempts < 1 {
+			attempts = 1
+		}
+		return p.openOnBids(ctx, key, req, ordered, attempts, nil)
+	}
+
+	session, err := p.s.manager.CreateSession(ctx, key.ModelID, req.Params)
+	if !errors.Is(err, ErrNoProvider) || failoverAttempts == 0 {
+		return session, err
+	}
+	bids, listErr := p.s.manager.ListBids(ctx, key.ModelID)
+	if listErr != nil {
+		p.s.logger.WarnContext(ctx, "Error listing bids", "model", key.ModelID, "error", listErr)
+		return nil, err
+	}
+	return p.openOnBids(ctx, key, req, bids, failoverAttempts, err)
+}
+
+// closeSession closes a session regardless of the request that opened it, so
+// the stake is returned even when that client hung up
+func (p *SessionPool) closeSession(key sessionKey, sessionToken string) {
+	if err := p.s.manager.CloseSession(context.Background(), sessionToken); err != nil {
+		p.s.logger.Error("Error closing session", "session", sessionToken, "model", key.ModelID, "error", err)
+		return
+	}
+	p.s.ledger.RecordClose(sessionToken, time.Now())
+}
+
+func (p *SessionPool) renewLoop() {
+	defer close(p.done)
+	p.interval.run(p.stop, p.renewExpiring)
+}
+
+// renewInterval is how often sessions are checked for renewal, often enough
+// to catch them inside the renewal window
+func renewInterval(renewBefore time.Duration) time.Duration {
+	interval := renewBefore / 4
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// renewExpiring renews sessions that were used since they were opened and
+// will expire within the renewal window. Idle sessions are closed and dropped
+// from the pool instead, as are sessions that expired.
+func (p *SessionPool) renewExpiring() {
+	p.mu.Lock()
+	entries := make(map[sessionKey]*pooledSession, len(p.sessions))
+	for key, entry := range p.sessions {
+		entries[key] = entry
+	}
+	p.mu.Unlock()
+
+	renewBefore := p.s.config().SessionRenewBefore
+	for key, entry := range entries {
+		// Skip entries a request is currently opening
+		if !entry.mu.TryLock() {
+			continue
+		}
+		if entry.session == nil {
+			p.remove(key, entry)
+			entry.mu.Unlock()
+			continue
+		}
+		if time.Until(entry.session.ExpiresAt) > renewBefore {
+			entry.mu.Unlock()
+			continue
+		}
+
+		if entry.lastUsed.After(entry.openedAt) {
+			p.s.logger.Info("Renewing session ahead of expiry", "session", entry.session.SessionToken, "model", key.ModelID)
+			if err := p.open(context.Background(), key, entry, entry.request); err != nil {
+				p.s.logger.Error("Error renewing session", "model", key.ModelID, "error", err)
+			}
+		}
+		if time.Until(entry.session.ExpiresAt) <= minSessionRemaining {
+			p.s.logger.Info("Closing idle session", "session", entry.session.SessionToken, "model", key.ModelID)
+			go p.closeSession(key, entry.session.SessionToken)
+			entry.session = nil
+			p.remove(key, entry)
+		}
+		entry.mu.Unlock()
+	}
+}
+
+// failureReason labels a session open failure, telling cancellations apart
+func failureReason(ctx context.Context, reason string) string {
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	return reason
+}
+
+// callerFromRequest identifies the caller a pooled session belongs to, from
+// the authenticated API key only. Tenants never share sessions, and with
+// sessions pooled by caller neither do keys; with auth disabled, every request
+// shares the sessions.
+func callerFromRequest(r *http.Request, cfg *Config) string {
+	key := apiKeyFromContext(r.Context())
+	switch {
+	case key == nil:
+		return ""
+	case cfg.PoolSessionsByCaller:
+		return key.Tenant + "/" + key.ID()
+	default:
+		return key.Tenant
+	}
+}
@@ -0,0 +1,346 @@
+package sessions
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit scopes, as used in errors and the scope label
+const (
+	rateScopeKey   = "key"
+	rateScopeIP    = "ip"
+	rateScopeModel = "model"
+)
+
+// Rate limited quantities, as used in headers and errors
+const (
+	rateRequests = "requests"
+	rateTokens   = "tokens"
+)
+
+// rateBucketSweepInterval is how often buckets that refilled completely are
+// dropped, as they behave like new ones
+const rateBucketSweepInterval = time.Minute
+
+// RateLimit is a requests and tokens per minute limit; 0 leaves a quantity
+// unlimited
+type RateLimit struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty" yaml:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute,omitempty" yaml:"tokens_per_minute"`
+}
+
+// RateLimitError is returned when a request would exceed a rate limit. It
+// matches ErrRateLimited and tells the client when to retry.
+type RateLimitError struct {
+	Scope string // "key", "ip" or "model"
+	Limit string // "requests" or "tokens"
+	Rate  int    // Per minute
+	Retry time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %d %s per minute per %s reached, retry after %s", e.Rate, e.Limit, e.Scope, e.Retry.Round(time.Millisecond))
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// RetryAfter returns how long the client should wait before retrying
+func (e *RateLimitError) RetryAfter() time.Duration {
+	return e.Retry
+}
+
+// tokenBucket holds up to capacity, refilling at capacity per minute. Its
+// level can drop below zero when a request used more tokens than it reserved.
+type tokenBucket struct {
+	capacity float64
+	level    float64
+	updated  time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.level = math.Min(b.capacity, b.level+now.Sub(b.updated).Minutes()*b.capacity)
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds n, or is full when n exceeds
+// its capacity
+func (b *tokenBucket) wait(n float64) time.Duration {
+	missing := math.Min(n, b.capacity) - b.level
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.capacity * float64(time.Minute))
+}
+
+// rateLimit is the limit on one quantity in one scope
+type rateLimit struct {
+	scope  string
+	limit  string
+	rate   int
+	bucket *tokenBucket
+}
+
+// rateLimiter enforces token bucket rate limits per API key, client IP and
+// model
+type rateLimiter struct {
+	config  func() *Config
+	metrics *serverMetrics
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // By scope, ID and quantity
+	swept   time.Time
+}
+
+func newRateLimiter(config func() *Config, metrics *serverMetrics) *rateLimiter {
+	return &rateLimiter{config: config, metrics: metrics, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// rateReservation is what an admitted request took from the token buckets,
+// settled once its usage is known
+type rateReservation struct {
+	limiter  *rateLimiter
+	reserved int
+	tokens   []*tokenBucket
+}
+
+// rateLimitHeaders are the x-ratelimit-* headers of a request, describing the
+// most restrictive limit on requests and on tokens
+type rateLimitHeaders map[string]string
+
+// Allow takes one request and tokens from the buckets of every scope the
+// request falls in. A request over any limit takes nothing and gets a
+// RateLimitError. It is called twice for a chat request: for no model before
+// the request is decoded, which only counts against the request limits of the
+// key and IP, and for its model once that is known, which counts against the
+// request limit of the model and every token limit.
+func (l *rateLimiter) Allow(r *http.Request, key *APIKey, model string, tokens int) (*rateReservation, rateLimitHeaders, error) {
+	cfg := l.config()
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= rateBucketSweepInterval {
+		l.sweep(now)
+	}
+
+	type scope struct {
+		scope string
+		id    string
+		limit RateLimit
+	}
+	scopes := []scope{{rateScopeIP, cfg.clientIP(r), cfg.RateLimitIP}}
+	if key != nil {
+		scopes = append(scopes, scope{rateScopeKey, key.ID(), key.RateLimit.or(cfg.RateLimitKey)})
+	}
+	if model != "" {
+		scopes = append(scopes, scope{rateScopeModel, model, cfg.modelRateLimit(model)})
+	}
+
+	var limits []rateLimit
+	for _, scope := range scopes {
+		quantities := []struct {
+			limit string
+			rate  int
+		}{
+			{rateRequests, scope.limit.RequestsPerMinute},
+			{rateTokens, scope.limit.TokensPerMinute},
+		}
+		for _, q := range quantities {
+			requestStage := scope.scope != rateScopeModel && q.limit == rateRequests
+			if q.rate == 0 || requestStage != (model == "") {
+				continue
+			}
+			limit := rateLimit{scope: scope.scope, limit: q.limit, rate: q.rate, bucket: l.bucket(scope.scope, scope.id, q.limit, q.rate, now)}
+			limits = append(limits, limit)
+		}
+	}
+
+	amount := func(limit rateLimit) float64 {
+		if limit.limit == rateTokens {
+			return float64(tokens)
+		}
+		return 1
+	}
+	for _, limit := range limits {
+		if wait := limit.bucket.wait(amount(limit)); wait > 0 {
+			l.metrics.rateLimited.WithLabelValues(limit.scope, limit.limit).Inc()
+			return nil, l.headers(limits), &RateLimitError{Scope: limit.scope, Limit: limit.limit, Rate: limit.rate, Retry: wait}
+		}
+	}
+
+	reservation := &rateReservation{limiter: l, reserved: tokens}
+	for _, limit := range limits {
+		limit.bucket.level -= amount(limit)
+		if limit.limit == rateTokens {
+			reservation.tokens = append(reservation.tokens, limit.bucket)
+		}
+	}
+	return reservation, l.headers(limits), nil
+}
+
+// bucket returns the bucket for a quantity in a scope, resizing it when the
+// limit changed
+func (l *rateLimiter) bucket(scope, id, limit string, rate int, now time.Time) *tokenBucket {
+	name := scope + "\x00" + id + "\x00" + limit
+	bucket, ok := l.buckets[name]
+	if !ok {
+		bucket = &tokenBucket{capacity: float64(rate), level: float64(rate), updated: now}
+		l.buckets[name] = bucket
+	}
+	bucket.refill(now)
+	if bucket.capacity != float64(rate) {
+		bucket.capacity = float64(rate)
+		bucket.level = math.Min(bucket.level, bucket.capacity)
+	}
+	return bucket
+}
+
+// sweep drops the buckets that refilled completely
+func (l *rateLimiter) sweep(now time.Time) {
+	for name, bucket := range l.buckets {
+		if bucket.refill(now); bucket.level >= bucket.capacity {
+			delete(l.buckets, name)
+		}
+	}
+	l.swept = now
+}
+
+// headers describes the limit with the least left of each quantity in the
+// OpenAI format
+func (l *rateLimiter) headers(limits []rateLimit) rateLimitHeaders {
+	headers := make(rateLimitHeaders)
+	for _, quantity := range []string{rateRequests, rateTokens} {
+		var tightest *rateLimit
+		for i, limit := range limits {
+			if limit.limit == quantity && (tightest == nil || limit.bucket.level < tightest.bucket.level) {
+				tightest = &limits[i]
+			}
+		}
+		if tightest == nil {
+			continue
+		}
+		bucket := tightest.bucket
+		reset := time.Duration((bucket.capacity - bucket.level) / bucket.capacity * float64(time.Minute))
+		headers["x-ratelimit-limit-"+quantity] = strconv.Itoa(tightest.rate)
+		headers["x-ratelimit-remaining-"+quantity] = strconv.Itoa(int(math.Max(0, math.Floor(bucket.level))))
+		headers["x-ratelimit-reset-"+quantity] = reset.Round(time.Millisecond).String()
+	}
+	return headers
+}
+
+// set writes the headers to w, keeping those of a quantity w already
+// describes a tighter limit on
+func (h rateLimitHeaders) set(w http.ResponseWriter) {
+	for _, quantity := range []string{rateRequests, rateTokens} {
+		remaining, ok := h["x-ratelimit-remaining-"+quantity]
+		if !ok {
+			continue
+		}
+		if set, err := strconv.Atoi(w.Header().Get("x-ratelimit-remaining-" + quantity)); err == nil {
+			if left, _ := strconv.Atoi(remaining); set <= left {
+				continue
+			}
+		}
+		for _, name := range []string{"x-ratelimit-limit-", "x-ratelimit-remaining-", "x-ratelimit-reset-"} {
+			w.Header().Set(name+quantity, h[name+quantity])
+		}
+	}
+}
+
+// Settle charges the tokens the request used in place of the ones it
+// reserved. usage is nil when the response did not report token counts, in
+// which case the reservation stands.
+func (r *rateReservation) Settle(usage *Usage) {
+	if r == nil || usage == nil || len(r.tokens) == 0 {
+		return
+	}
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	for _, bucket := range r.tokens {
+		bucket.level -= float64(usage.TotalTokens - r.reserved)
+	}
+}
+
+// Refund returns the tokens the request reserved, for requests answered
+// without going upstream
+func (r *rateReservation) Refund() {
+	r.Settle(&Usage{})
+}
+
+// or returns the limit with the quantities l leaves unset taken from def
+func (l RateLimit) or(def RateLimit) RateLimit {
+	if l.RequestsPerMinute == 0 {
+		l.RequestsPerMinute = def.RequestsPerMinute
+	}
+	if l.TokensPerMinute == 0 {
+		l.TokensPerMinute = def.TokensPerMinute
+	}
+	return l
+}
+
+func (l RateLimit) validate() error {
+	if l.RequestsPerMinute < 0 || l.TokensPerMinute < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	return nil
+}
+
+// estimateTokens estimates the tokens a request uses before it is sent: about
+// four characters per prompt token, plus the completion tokens it allows
+func estimateTokens(chatReq *ChatCompletionRequest) int {
+	var chars int
+	for _, message := range chatReq.Messages {
+		chars += len(message.Content) + len(message.ContentParts) + len(message.ToolCalls)
+	}
+	chars += len(chatReq.Tools)
+	tokens := (chars + 3) / 4
+	switch {
+	case chatReq.MaxCompletionTokens != nil:
+		tokens += *chatReq.MaxCompletionTokens
+	case chatReq.MaxTokens != nil:
+		tokens += *chatReq.MaxTokens
+	}
+	return tokens
+}
+
+// clientIP returns the address of the client. Behind a trusted load balancer
+// it is the X-Forwarded-For entry the given number of hops from the right, as
+// load balancers append the address they saw while the entries to the left
+// come from the client.
+func (c *Config) clientIP(r *http.Request) string {
+	if forwarded := r.Header.Values("X-Forwarded-For"); c.RateLimitTrustForwardedFor && len(forwarded) > 0 {
+		entries := strings.Split(strings.Join(forwarded, ","), ",")
+		i := len(entries) - c.RateLimitForwardedForHops
+		if i < 0 {
+			i = 0
+		}
+		return strings.TrimSpace(entries[i])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited applies the request limits of the API key and client IP to
+// next before it does any work
+func (s *Server) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, limits, err := s.limiter.Allow(r, apiKeyFromContext(r.Context()), "", 0)
+		limits.set(w)
+		if err != nil {
+			writeError(w, err, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// maxReadyPollInterval caps the backoff between readiness probes
+const maxReadyPollInterval = 5 * time.Second
+
+// zeroAddress is reported as the provider of a session the node does not know yet
+const zeroAddress = "0x0000000000000000000000000000000000000000"
+
+// ErrSessionNotReady is matched by errors.Is for every SessionNotReadyError
+var ErrSessionNotReady = errors.New("session not ready")
+
+// SessionNotReadyError reports a session that did not become usable before
+// the readiness deadline.
+type SessionNotReadyError struct {
+	SessionToken string
+	Waited       time.Duration
+	Err          error // Last probe error, if the probe itself failed
+}
+
+func (e *SessionNotReadyError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("session %s not ready after %s: %v", e.SessionToken, e.Waited.Round(time.Millisecond), e.Err)
+	}
+	return fmt.Sprintf("session %s not ready after %s", e.SessionToken, e.Waited.Round(time.Millisecond))
+}
+
+func (e *SessionNotReadyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SessionNotReadyError) Is(target error) bool {
+	return target == ErrSessionNotReady
+}
+
+// SessionReadiness controls how newly opened sessions are probed before use
+type SessionReadiness struct {
+	Timeout      time.Duration // Give up after this long
+	PollInterval time.Duration // Initial delay between probes, doubled after each attempt
+}
+
+// Ready reports whether the consumer node considers the session usable: it is
+// known on chain, bound to a provider and not closed.
+func (s *SessionInfo) Ready() bool {
+	if s == nil || s.Provider == "" || s.Provider == zeroAddress {
+		return false
+	}
+	return s.ClosedAt.IsZero()
+}
+
+// waitForSessionReady polls the consumer node through sm with exponential
+// backoff until the session is usable, the readiness deadline passes or ctx
+// is done. The session state of the last successful probe is returned even
+// on failure.
+func waitForSessionReady(ctx context.Context, sm SessionManager, logger *slog.Logger, sessionToken string, readiness SessionReadiness) (*SessionInfo, error) {
+	start := time.Now()
+	deadline := start.Add(readiness.Timeout)
+	interval := readiness.PollInterval
+	if interval <= 0 {
+		interval = 250 * time.Millisecond
+	}
+
+	var lastErr error
+	var lastInfo *SessionInfo
+	for attempt := 1; ; attempt++ {
+		info, err := sm.GetSession(ctx, sessionToken)
+		switch {
+		case ctx.Err() != nil:
+			return lastInfo, ctx.Err()
+		case err != nil:
+			logger.DebugContext(ctx, "Session readiness probe failed", "session", sessionToken, "attempt", attempt, "error", err)
+			lastErr = err
+		case info.Ready():
+			logger.InfoContext(ctx, "Session ready", "session", sessionToken, "after", time.Since(start).Round(time.Millisecond).String(), "probes", attempt)
+			return info, nil
+		default:
+			lastErr = nil
+			lastInfo = info
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return lastInfo, &SessionNotReadyError{SessionToken: sessionToken, Waited: time.Since(start), Err: lastErr}
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return lastInfo, err
+		}
+
+		interval *= 2
+		if interval > maxReadyPollInterval {
+			interval = maxReadyPollInterval
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minMissRefreshInterval limits how often a lookup miss triggers a refresh,
+// so clients asking for unknown models cannot hammer the consumer node
+const minMissRefreshInterval = 10 * time.Second
+
+// ModelRegistry caches the on-chain model list and refreshes it in the
+// background. Lookups keep serving the last good list while the consumer node
+// is unavailable.
+type ModelRegistry struct {
+	mu          sync.RWMutex
+	models      []ModelInfo
+	lastRefresh time.Time
+	lastAttempt time.Time
+	lastErr     error
+
+	refreshMu  sync.Mutex   // Guards refreshing
+	refreshing *refreshCall // The fetch in flight, shared by every caller
+	fetch      func(ctx context.Context) ([]ModelInfo, error)
+	interval   *loopInterval
+	logger     *slog.Logger
+	ctx        context.Context // Cancelled by Close
+	cancel     context.CancelFunc
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// refreshCall is a fetch of the model list that callers wait on
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// RegistryStatus describes the state of the model registry for health output
+type RegistryStatus struct {
+	Models      int        `json:"models"`
+	LastRefresh *time.Time `json:"last_refresh"`
+	Stale       bool       `json:"stale"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// NewModelRegistry creates a registry and starts refreshing it every interval.
+// The first load happens on first use.
+func NewModelRegistry(fetch func() ([]ModelInfo, error), interval time.Duration) *ModelRegistry {
+	return newModelRegistry(func(context.Context) ([]ModelInfo, error) { return fetch() }, interval, slog.Default())
+}
+
+// newModelRegistry creates a registry whose fetches get the context of the
+// request that triggered them, or a background one for periodic refreshes
+func newModelRegistry(fetch func(ctx context.Context) ([]ModelInfo, error), interval time.Duration, logger *slog.Logger) *ModelRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ModelRegistry{
+		fetch:    fetch,
+		interval: newLoopInterval(interval),
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.refreshLoop()
+	return r
+}
+
+// Refresh reloads the model list. On failure the previous list is kept.
+func (r *ModelRegistry) Refresh() error {
+	return r.refresh(context.Background())
+}
+
+// refresh joins the fetch in flight or starts one, and waits for it until ctx
+// is done. The fetch runs on its own, carrying the request ID and trace of
+// the caller that started it, so a caller going away does not fail it for the
+// others; only Close cancels it.
+func (r *ModelRegistry) refresh(ctx context.Context) error {
+	r.refreshMu.Lock()
+	call := r.refreshing
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		r.refreshing = call
+		go r.runRefresh(context.WithoutCancel(ctx), call)
+	}
+	r.refreshMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.done:
+		return call.err
+	}
+}
+
+func (r *ModelRegistry) runRefresh(ctx context.Context, call *refreshCall) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(r.ctx, cancel)()
+
+	call.err = r.store(r.fetch(ctx))
+
+	r.refreshMu.Lock()
+	r.refreshing = nil
+	r.refreshMu.Unlock()
+	close(call.done)
+}
+
+// store records the result of a fetch
+func (r *ModelRegistry) store(models []ModelInfo, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastAttempt = time.Now()
+	r.lastErr = err
+	if err != nil {
+		if !r.lastRefresh.IsZero() {
+			r.logger.Warn("Error refreshing models, serving the last good list", "last_refresh", r.lastRefresh.Format(time.RFC3339), "error", err)
+		}
+		return err
+	}
+	r.models = models
+	r.lastRefresh = r.lastAttempt
+	return nil
+}
+
+// Models returns the cached model list, loading it if it was never loaded
+func (r *ModelRegistry) Models() ([]ModelInfo, error) {
+	return r.list(context.Background())
+}
+
+func (r *ModelRegistry) list(ctx context.Context) ([]ModelInfo, error) {
+	if err := r.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]ModelInfo(nil), r.models...), nil
+}
+
+// Lookup finds a model by handle, falling back to its blockchain ID. A miss
+// triggers a refresh in case the model was registered since the last one.
+func (r *ModelRegistry) Lookup(handleOrID string) (*ModelInfo, error) {
+	return r.lookup(context.Background(), handleOrID)
+}
+
+func (r *ModelRegistry) lookup(ctx context.Context, handleOrID string) (*ModelInfo, error) {
+	if err := r.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+
+	if model := r.find(handleOrID); model != nil {
+		return model, nil
+	}
+
+	r.mu.RLock()
+	recent := time.Since(r.lastAttempt) < minMissRefreshInterval
+	r.mu.RUnlock()
+	if !recent {
+		err := r.refresh(ctx)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err == nil {
+			if model := r.find(handleOrID); model != nil {
+				return model, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrModelNotFound, handleOrID)
+}
+
+// ByTag returns the models carrying the tag
+func (r *ModelRegistry) ByTag(tag string) ([]ModelInfo, error) {
+	models, err := r.Models()
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []ModelInfo
+	for _, model := range models {
+		if hasTag(model, tag) {
+			tagged = append(tagged, model)
+		}
+	}
+	return tagged, nil
+}
+
+// Status reports the registry state for health output
+func (r *ModelRegistry) Status() RegistryStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	status := RegistryStatus{Models: len(r.models)}
+	if !r.lastRefresh.IsZero() {
+		lastRefresh := r.lastRefresh
+		status.LastRefresh = &lastRefresh
+		status.Stale = r.lastErr != nil || time.Since(r.lastRefresh) > 2*r.interval.Get()
+	}
+	if r.lastErr != nil {
+		status.LastError = r.lastErr.Error()
+	}
+	return status
+}
+
+// Close stops the background refresh
+func (r *ModelRegistry) Close() {
+	select {
+	case <-r.stop:
+		return
+	default:
+		close(r.stop)
+	}
+	r.cancel()
+	<-r.done
+}
+
+// label returns the handle of a registered model ID for use as a metrics label
+func (r *ModelRegistry) label(modelID string) string {
+	if r != nil {
+		if model := r.find(modelID); model != nil {
+			return model.Name
+		}
+	}
+	return unknownModel
+}
+
+func (r *ModelRegistry) find(handleOrID string) *ModelInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, model := range r.models {
+		if strings.EqualFold(model.Name, handleOrID) {
+			return &model
+		}
+	}
+	for _, model := range r.models {
+		if strings.EqualFold(model.ID, handleOrID) {
+			return &model
+		}
+	}
+	return nil
+}
+
+func (r *ModelRegistry) ensureLoaded(ctx context.Context) error {
+	r.mu.RLock()
+	loaded := !r.lastRefresh.IsZero()
+	r.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	return r.refresh(ctx)
+}
+
+func (r *ModelRegistry) refreshLoop() {
+	defer close(r.done)
+	r.interval.run(r.stop, func() { r.refresh(r.ctx) })
+}
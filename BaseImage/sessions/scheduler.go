@@ -0,0 +1,265 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// QueueError is returned when a request could not be scheduled. It matches
+// ErrQueueFull or ErrQueueTimeout, and tells the client when to retry.
+type QueueError struct {
+	Err   error
+	Model string
+	Retry time.Duration
+}
+
+func (e *QueueError) Error() string {
+	return fmt.Sprintf("%v for model %s, retry after %s", e.Err, e.Model, e.Retry)
+}
+
+func (e *QueueError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfter returns how long the client should wait before retrying
+func (e *QueueError) RetryAfter() time.Duration {
+	return e.Retry
+}
+
+// QueueStatus reports the scheduler's load, for the health check
+type QueueStatus struct {
+	Running int                         `json:"running"`
+	Waiting int                         `json:"waiting"`
+	Models  map[string]ModelQueueStatus `json:"models,omitempty"`
+}
+
+// ModelQueueStatus reports the requests of one model
+type ModelQueueStatus struct {
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+}
+
+// queuedRequest is a request waiting for the scheduler to let it upstream
+type queuedRequest struct {
+	model    string
+	key      string
+	keyLimit int
+	admitted chan struct{} // Closed once the request may proceed
+}
+
+// scheduler bounds how many requests are upstream at once, per model and per
+// API key. Requests over a limit wait in a queue that admits the API keys in
+// turn, so one key's burst does not hold up the others.
+type scheduler struct {
+	config  func() *Config
+	metrics *serverMetrics
+
+	mu           sync.Mutex
+	modelRunning map[string]int
+	keyRunning   map[string]int
+	queues       map[string][]*queuedRequest // Waiting requests by API key, oldest first
+	order        []string                    // API keys with waiting requests, in turn order
+	next         int                         // Index into order of the key whose turn it is
+	waiting      int
+	modelWaiting map[string]int
+}
+
+func newScheduler(config func() *Config, metrics *serverMetrics) *scheduler {
+	return &scheduler{
+		config:       config,
+		metrics:      metrics,
+		modelRunning: make(map[string]int),
+		keyRunning:   make(map[string]int),
+		queues:       make(map[string][]*queuedRequest),
+		modelWaiting: make(map[string]int),
+	}
+}
+
+// Acquire waits until a request for model on behalf of key may go upstream,
+// for at most queue.max_wait. keyLimit is the key's concurrency limit; 0 leaves
+// it unlimited. The returned function must be called when the request is done.
+func (q *scheduler) Acquire(ctx context.Context, model, key string, keyLimit int) (func(), error) {
+	cfg := q.config()
+	req := &queuedRequest{model: model, key: key, keyLimit: keyLimit, admitted: make(chan struct{})}
+
+	q.mu.Lock()
+	// Waiting requests do not fit once dispatched, so one that fits does not
+	// overtake them
+	q.dispatch()
+	if q.fits(req) {
+		q.start(req)
+		q.mu.Unlock()
+		return q.releaser(req), nil
+	}
+	if q.waiting >= cfg.QueueSize {
+		q.mu.Unlock()
+		q.metrics.queueRejections.WithLabelValues(model, "full").Inc()
+		return nil, &QueueError{Err: ErrQueueFull, Model: model, Retry: q.retryAfter()}
+	}
+	q.enqueue(req)
+	q.mu.Unlock()
+
+	queued := time.Now()
+	timer := time.NewTimer(cfg.QueueMaxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-req.admitted:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = &QueueError{Err: ErrQueueTimeout, Model: model, Retry: q.retryAfter()}
+	}
+	q.metrics.queueWait.WithLabelValues(model).Observe(time.Since(queued).Seconds())
+
+	if err != nil {
+		q.mu.Lock()
+		admitted := q.dequeue(req)
+		q.mu.Unlock()
+		if !admitted {
+			if errors.Is(err, ErrQueueTimeout) {
+				q.metrics.queueRejections.WithLabelValues(model, "timeout").Inc()
+			}
+			return nil, err
+		}
+		// Admitted as the wait ended; a timed out request may as well proceed
+		if ctx.Err() != nil {
+			q.releaser(req)()
+			return nil, ctx.Err()
+		}
+	}
+	return q.releaser(req), nil
+}
+
+// fits reports whether req is within the model and key limits
+func (q *scheduler) fits(req *queuedRequest) bool {
+	limit := q.config().MaxConcurrentPerModel
+	if limit > 0 && q.modelRunning[req.model] >= limit {
+		return false
+	}
+	return req.keyLimit == 0 || q.keyRunning[req.key] < req.keyLimit
+}
+
+func (q *scheduler) start(req *queuedRequest) {
+	q.modelRunning[req.model]++
+	q.keyRunning[req.key]++
+}
+
+func (q *scheduler) enqueue(req *queuedRequest) {
+	if len(q.queues[req.key]) == 0 {
+		q.order = append(q.order, req.key)
+	}
+	q.queues[req.key] = append(q.queues[req.key], req)
+	q.waiting++
+	q.modelWaiting[req.model]++
+	q.metrics.queueDepth.WithLabelValues(req.model).Set(float64(q.modelWaiting[req.model]))
+}
+
+// dequeue removes req from the queue, reporting false when it was still
+// waiting and true when it had been admitted
+func (q *scheduler) dequeue(req *queuedRequest) bool {
+	queue := q.queues[req.key]
+	for i, waiting := range queue {
+		if waiting == req {
+			q.remove(req.key, i)
+			return false
+		}
+	}
+	return true
+}
+
+// remove takes the request at index i out of key's queue
+func (q *scheduler) remove(key string, i int) {
+	queue := q.queues[key]
+	req := queue[i]
+	q.queues[key] = append(queue[:i:i], queue[i+1:]...)
+	q.waiting--
+	q.modelWaiting[req.model]--
+	q.metrics.queueDepth.WithLabelValues(req.model).Set(float64(q.modelWaiting[req.model]))
+	if q.modelWaiting[req.model] == 0 {
+		delete(q.modelWaiting, req.model)
+	}
+
+	if len(q.queues[key]) > 0 {
+		return
+	}
+	delete(q.queues, key)
+	for j, k := range q.order {
+		if k == key {
+			q.order = append(q.order[:j:j], q.order[j+1:]...)
+			if j < q.next {
+				q.next--
+			}
+			break
+		}
+	}
+}
+
+// dispatch admits waiting requests that fit, taking the API keys in turn and
+// each key's requests oldest first
+func (q *scheduler) dispatch() {
+	for q.admitNext() {
+	}
+}
+
+// admitNext admits the first waiting request that fits, starting with the
+// key whose turn it is, and passes the turn to the key after it
+func (q *scheduler) admitNext() bool {
+	for n := 0; n < len(q.order); n++ {
+		i := (q.next + n) % len(q.order)
+		key := q.order[i]
+		for j, req := range q.queues[key] {
+			if q.fits(req) {
+				q.next = i + 1
+				q.remove(key, j)
+				q.start(req)
+				close(req.admitted)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *scheduler) releaser(req *queuedRequest) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if q.modelRunning[req.model]--; q.modelRunning[req.model] == 0 {
+				delete(q.modelRunning, req.model)
+			}
+			if q.keyRunning[req.key]--; q.keyRunning[req.key] == 0 {
+				delete(q.keyRunning, req.key)
+			}
+			q.dispatch()
+		})
+	}
+}
+
+// retryAfter is how long a turned away client should wait: the queue turns
+// over within queue.max_wait
+func (q *scheduler) retryAfter() time.Duration {
+	return time.Duration(math.Max(1, math.Ceil(q.config().QueueMaxWait.Seconds()))) * time.Second
+}
+
+// Status returns the requests running and waiting, in total and by model
+func (q *scheduler) Status() QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := QueueStatus{Waiting: q.waiting, Models: make(map[string]ModelQueueStatus)}
+	for model, running := range q.modelRunning {
+		status.Running += running
+		status.Models[model] = ModelQueueStatus{Running: running, Waiting: q.modelWaiting[model]}
+	}
+	for model, waiting := range q.modelWaiting {
+		status.Models[model] = ModelQueueStatus{Running: q.modelRunning[model], Waiting: waiting}
+	}
+	return status
+}
@@ -0,0 +1,322 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// selectionPolicyHeader picks the bid selection policy for a request
+	selectionPolicyHeader = "X-Morpheus-Selection-Policy"
+
+	// providerHeader pins a request to a provider address
+	providerHeader = "X-Morpheus-Provider"
+
+	// pinnedPolicyName is the policy implied by a pinned provider
+	pinnedPolicyName = "pinned"
+
+	// latencyDecay is the weight of the newest sample in a provider's latency average
+	latencyDecay = 0.3
+)
+
+// SelectionPolicy orders a model's bids, most preferred first. Sessions are
+// opened on the first bid that accepts, so later bids act as fallbacks.
+type SelectionPolicy interface {
+	Name() string
+	Order(bids []BidInfo, in SelectionInput) []BidInfo
+}
+
+// SelectionInput is what policies choose bids by
+type SelectionInput struct {
+	Provider string                   // Pinned provider address, for the pinned policy
+	Stats    map[string]ProviderStats // Observed stats, keyed by lower-case provider address
+}
+
+// stats returns the stats observed for a provider
+func (in SelectionInput) stats(provider string) ProviderStats {
+	return in.Stats[strings.ToLower(provider)]
+}
+
+// selectionPolicies are the policies available by name to API keys, the
+// selection policy header and SELECTION_POLICY
+type selectionPolicies map[string]SelectionPolicy
+
+// builtinPolicies are the policies every server has; WithSelectionPolicy adds
+// to them
+var builtinPolicies = newSelectionPolicies(
+	cheapestPolicy{},
+	lowestLatencyPolicy{},
+	successRatePolicy{},
+	pinnedPolicy{},
+	weightedRandomPolicy{},
+)
+
+func newSelectionPolicies(policies ...SelectionPolicy) selectionPolicies {
+	set := make(selectionPolicies, len(policies))
+	for _, policy := range policies {
+		set.add(policy)
+	}
+	return set
+}
+
+// add makes policy available by its name, replacing any policy of that name
+func (set selectionPolicies) add(policy SelectionPolicy) {
+	set[strings.ToLower(policy.Name())] = policy
+}
+
+func (set selectionPolicies) lookup(name string) (SelectionPolicy, bool) {
+	policy, ok := set[strings.ToLower(name)]
+	return policy, ok
+}
+
+// LookupSelectionPolicy returns the built-in policy with the name
+func LookupSelectionPolicy(name string) (SelectionPolicy, bool) {
+	return builtinPolicies.lookup(name)
+}
+
+// cheapestPolicy prefers the lowest price per second
+type cheapestPolicy struct{}
+
+func (cheapestPolicy) Name() string { return "cheapest" }
+
+func (cheapestPolicy) Order(bids []BidInfo, in SelectionInput) []BidInfo {
+	ordered := append([]BidInfo(nil), bids...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return parseWei(string(ordered[i].PricePerSecond)).Cmp(parseWei(string(ordered[j].PricePerSecond))) < 0
+	})
+	return ordered
+}
+
+// lowestLatencyPolicy prefers the provider with the lowest observed latency.
+// Providers without samples come after measured ones, cheapest first.
+type lowestLatencyPolicy struct{}
+
+func (lowestLatencyPolicy) Name() string { return "lowest_latency" }
+
+func (lowestLatencyPolicy) Order(bids []BidInfo, in SelectionInput) []BidInfo {
+	ordered := cheapestPolicy{}.Order(bids, in)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := in.stats(ordered[i].Provider).Latency, in.stats(ordered[j].Provider).Latency
+		if a == 0 || b == 0 {
+			return a != 0 && b == 0
+		}
+		return a < b
+	})
+	return ordered
+}
+
+// successRatePolicy prefers the provider that most often served requests
+type successRatePolicy struct{}
+
+func (successRatePolicy) Name() string { return "success_rate" }
+
+func (successRatePolicy) Order(bids []BidInfo, in SelectionInput) []BidInfo {
+	ordered := cheapestPolicy{}.Order(bids, in)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return in.stats(ordered[i].Provider).SuccessRate() > in.stats(ordered[j].Provider).SuccessRate()
+	})
+	return ordered
+}
+
+// pinnedPolicy only uses bids from the pinned provider
+type pinnedPolicy struct{}
+
+func (pinnedPolicy) Name() string { return pinnedPolicyName }
+
+func (pinnedPolicy) Order(bids []BidInfo, in SelectionInput) []BidInfo {
+	var pinned []BidInfo
+	for _, bid := range bids {
+		if strings.EqualFold(bid.Provider, in.Provider) {
+			pinned = append(pinned, bid)
+		}
+	}
+	return cheapestPolicy{}.Order(pinned, in)
+}
+
+// weightedRandomPolicy spreads sessions across providers at random, weighting
+// each bid by its provider's success rate divided by its price
+type weightedRandomPolicy struct{}
+
+func (weightedRandomPolicy) Name() string { return "weighted_random" }
+
+func (weightedRandomPolicy) Order(bids []BidInfo, in SelectionInput) []BidInfo {
+	remaining := append([]BidInfo(nil), bids...)
+	weights := make([]float64, len(remaining))
+	for i, bid := range remaining {
+		price, _ := new(big.Float).SetInt(parseWei(string(bid.PricePerSecond))).Float64()
+		if price < 1 {
+			price = 1
+		}
+		weights[i] = in.stats(bid.Provider).SuccessRate() / price
+	}
+
+	ordered := make([]BidInfo, 0, len(remaining))
+	for len(remaining) > 0 {
+		total := 0.0
+		for _, weight := range weights {
+			total += weight
+		}
+		pick := len(remaining) - 1
+		target := rand.Float64() * total
+		for i, weight := range weights {
+			if target < weight {
+				pick = i
+				break
+			}
+			target -= weight
+		}
+		ordered = append(ordered, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+		weights = append(weights[:pick], weights[pick+1:]...)
+	}
+	return ordered
+}
+
+// bidSelection is the policy a request asked for
+type bidSelection struct {
+	Policy   SelectionPolicy // nil lets the consumer node pick the bid
+	Provider string          // Pinned provider address
+}
+
+// key identifies the selection in the session pool, so requests with
+// different policies never share a session
+func (s bidSelection) key() string {
+	if s.Policy == nil {
+		return ""
+	}
+	if s.Provider != "" {
+		return s.Policy.Name() + ":" + strings.ToLower(s.Provider)
+	}
+	return s.Policy.Name()
+}
+
+// selectionFromRequest resolves the bid selection: the API key's settings
+// when it has any, else the request headers and then SELECTION_POLICY. A key
+// that sets its selection rejects headers asking for another one.
+func (s *Server) selectionFromRequest(r *http.Request, cfg *Config) (bidSelection, error) {
+	name := r.Header.Get(selectionPolicyHeader)
+	provider := r.Header.Get(providerHeader)
+	if key := apiKeyFromContext(r.Context()); key != nil && (key.SelectionPolicy != "" || key.Provider != "") {
+		keyName := key.SelectionPolicy
+		if keyName == "" {
+			keyName = pinnedPolicyName
+		}
+		if name != "" && !strings.EqualFold(name, keyName) {
+			return bidSelection{}, fmt.Errorf("this API key uses the %s selection policy, which the %s header cannot change", keyName, selectionPolicyHeader)
+		}
+		if provider != "" && !strings.EqualFold(provider, key.Provider) {
+			return bidSelection{}, fmt.Errorf("this API key's provider cannot be changed with the %s header", providerHeader)
+		}
+		name, provider = keyName, key.Provider
+	}
+	if name == "" && provider != "" {
+		name = pinnedPolicyName
+	}
+	if name == "" {
+		name = cfg.SelectionPolicy
+	}
+	if name == "" {
+		return bidSelection{}, nil
+	}
+
+	policy, ok := s.policies.lookup(name)
+	if !ok {
+		return bidSelection{}, fmt.Errorf("unknown selection policy %q", name)
+	}
+	if policy.Name() == pinnedPolicyName && provider == "" {
+		return bidSelection{}, fmt.Errorf("the pinned selection policy needs a provider address in the %s header", providerHeader)
+	}
+	return bidSelection{Policy: policy, Provider: provider}, nil
+}
+
+// ProviderStats is what the proxy observed of a provider
+type ProviderStats struct {
+	Successes int64         `json:"successes"`
+	Failures  int64         `json:"failures"`
+	Latency   time.Duration `json:"latency_ns"` // Moving average of the time to the first token, or to the full response
+	LastSeen  time.Time     `json:"last_seen"`
+}
+
+// SuccessRate estimates the share of requests the provider serves, starting
+// unseen providers at one half
+func (s ProviderStats) SuccessRate() float64 {
+	return float64(s.Successes+1) / float64(s.Successes+s.Failures+2)
+}
+
+// ProviderTracker collects ProviderStats from session opens and chat requests
+type ProviderTracker struct {
+	mu    sync.Mutex
+	stats map[string]ProviderStats
+}
+
+// NewProviderTracker creates an empty tracker
+func NewProviderTracker() *ProviderTracker {
+	return &ProviderTracker{stats: make(map[string]ProviderStats)}
+}
+
+// RecordSuccess counts a request the provider served and its latency
+func (t *ProviderTracker) RecordSuccess(provider string, latency time.Duration) {
+	if provider == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats[strings.ToLower(provider)]
+	stats.Successes++
+	if stats.Latency == 0 {
+		stats.Latency = latency
+	} else {
+		stats.Latency = time.Duration(latencyDecay*float64(latency) + (1-latencyDecay)*float64(stats.Latency))
+	}
+	stats.LastSeen = time.Now()
+	t.stats[strings.ToLower(provider)] = stats
+}
+
+// RecordFailure counts a session open or request the provider failed
+func (t *ProviderTracker) RecordFailure(provider string) {
+	if provider == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats[strings.ToLower(provider)]
+	stats.Failures++
+	stats.LastSeen = time.Now()
+	t.stats[strings.ToLower(provider)] = stats
+}
+
+// recordOutcome updates the stats of the session's provider after a chat
+// request sent at sent. first is when the first stream chunk arrived, or zero
+// for non-streaming requests. Requests the client abandoned are ignored.
+func (t *ProviderTracker) recordOutcome(ctx context.Context, session *SessionResponse, sent, first time.Time, err error) {
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		t.RecordFailure(session.Provider)
+	case first.IsZero():
+		t.RecordSuccess(session.Provider, time.Since(sent))
+	default:
+		t.RecordSuccess(session.Provider, first.Sub(sent))
+	}
+}
+
+// Snapshot returns a copy of the stats of every provider seen
+func (t *ProviderTracker) Snapshot() map[string]ProviderStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[string]ProviderStats, len(t.stats))
+	for provider, stats := range t.stats {
+		snapshot[provider] = stats
+	}
+	return snapshot
+}
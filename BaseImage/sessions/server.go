@@ -0,0 +1,270 @@
+package sessions
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server is the proxy for one consumer node. Every Server has its own
+// configuration, session manager, consumer node client, API keys, session
+// pool, spend ledger and metrics, so several can run in one process or be
+// embedded in another service.
+type Server struct {
+	cfg       atomic.Pointer[Config] // Replaced as a whole on reload
+	logger    *slog.Logger
+	tracer    trace.Tracer
+	upstream  *consumerClient
+	manager   SessionManager
+	keys      *KeyStore
+	ledger    *Ledger
+	registry  *ModelRegistry
+	pool      *SessionPool
+	providers *ProviderTracker
+	monitor   *monitor
+	scheduler *scheduler
+	limiter   *rateLimiter
+	cache     *responseCache // nil when the response cache is disabled
+	metrics   *serverMetrics
+	policies  selectionPolicies
+	mux       *http.ServeMux
+
+	approveMu sync.Mutex // Held while checking and raising the diamond contract allowance
+
+	mu         sync.Mutex
+	httpServer *http.Server
+
+	tracerProvider *sdktrace.TracerProvider // Created from the tracing settings; nil when one was given
+
+	// draining is set once shutdown starts so /health fails readiness checks
+	draining atomic.Bool
+}
+
+// Option customizes a Server created by NewServer
+type Option func(*Server)
+
+// WithSessionManager makes the server open sessions and send chat requests
+// through sm instead of its consumer node client, e.g. to use a mock in tests
+func WithSessionManager(sm SessionManager) Option {
+	return func(s *Server) {
+		s.manager = sm
+	}
+}
+
+// WithLogger makes the server log to logger instead of one built from the
+// logging settings. Wrap its handler with NewRedactingHandler to keep secrets
+// and user content out of it.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithHTTPClient makes the server send every consumer node request with
+// client. Its timeout and transport replace the per-request defaults.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Server) {
+		s.upstream.client = client
+	}
+}
+
+// WithCredentials sets fixed consumer node credentials instead of the
+// configured credentials source
+func WithCredentials(credentials Credentials) Option {
+	return WithCredentialsProvider(StaticCredentials(credentials))
+}
+
+// WithCredentialsProvider makes the server get the consumer node credentials
+// from provider instead of the configured credentials source
+func WithCredentialsProvider(provider CredentialsProvider) Option {
+	return func(s *Server) {
+		s.upstream.credentials = provider
+	}
+}
+
+// WithSelectionPolicy makes policy available by name to API keys, the
+// selection policy header and SELECTION_POLICY, in addition to the built-in
+// policies. A policy with the name of a built-in one replaces it.
+func WithSelectionPolicy(policy SelectionPolicy) Option {
+	return func(s *Server) {
+		s.policies.add(policy)
+	}
+}
+
+// NewServer creates a proxy from a configuration, such as one returned by
+// ReadConfig. The server is an http.Handler serving the proxy routes; Close
+// or Shutdown releases its sessions.
+func NewServer(cfg *Config, opts ...Option) (*Server, error) {
+	if cfg == nil {
+		return nil, errors.New("configuration is required")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{providers: NewProviderTracker(), policies: make(selectionPolicies)}
+	for _, policy := range builtinPolicies {
+		s.policies.add(policy)
+	}
+	s.cfg.Store(cfg)
+	s.metrics = newServerMetrics(s)
+	s.upstream = newConsumerClient(s.config, s.metrics)
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := cfg.checkPolicies(s.policies); err != nil {
+		return nil, err
+	}
+	if s.logger == nil {
+		s.logger = NewLogger(os.Stderr, cfg)
+	}
+	s.upstream.logger = s.logger
+	if s.upstream.credentials == nil {
+		s.upstream.credentials = cfg.credentialsProvider(s.logger)
+	}
+
+	keys, err := newKeyStore(cfg.APIKeysFile, cfg.staticKeys(), cfg.APIKeysReloadInterval, s.policies, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkKeys(keys); err != nil {
+		keys.Close()
+		return nil, err
+	}
+	if !keys.Enabled() {
+		s.logger.Warn("Authentication disabled, /v1 routes are open to anyone who can reach the proxy")
+	}
+	ledger, err := newLedger(cfg.LedgerFile, s.logger)
+	if err != nil {
+		keys.Close()
+		return nil, err
+	}
+	cache, err := newResponseCache(cfg, s.config, s.logger)
+	if err != nil {
+		keys.Close()
+		ledger.Close()
+		return nil, err
+	}
+	s.keys = keys
+	s.ledger = ledger
+	s.cache = cache
+
+	if s.tracer == nil && cfg.TracingEndpoint != "" {
+		if s.tracerProvider, err = newTracerProvider(cfg); err != nil {
+			keys.Close()
+			ledger.Close()
+			cache.Close()
+			return nil, err
+		}
+		s.tracer = s.tracerProvider.Tracer(tracerName)
+	} else if s.tracer == nil {
+		s.tracer = otel.GetTracerProvider().Tracer(tracerName)
+	}
+	s.upstream.tracer = s.tracer
+
+	s.registry = newModelRegistry(s.upstream.fetchModels, cfg.ModelRefreshInterval, s.logger)
+	s.upstream.registry = s.registry
+	if s.manager == nil {
+		s.manager = s.upstream
+	}
+	s.pool = newSessionPool(s)
+	s.scheduler = newScheduler(s.config, s.metrics)
+	s.limiter = newRateLimiter(s.config, s.metrics)
+	s.monitor = newMonitor(s, cfg.WalletMonitorInterval)
+	s.mux = s.routes()
+	return s, nil
+}
+
+// config returns the server's active configuration
+func (s *Server) config() *Config {
+	return s.cfg.Load()
+}
+
+// routes registers the proxy routes on a new mux
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealthCheck)
+	mux.HandleFunc("/v1/chat/completions", s.RequireAPIKey(s.rateLimited(s.handleChatCompletions)))
+	mux.HandleFunc("/v1/models", s.RequireAPIKey(s.rateLimited(s.handleModels)))
+	mux.HandleFunc("/v1/models/", s.RequireAPIKey(s.rateLimited(s.handleModel)))
+	mux.HandleFunc("/admin/spend", s.RequireAdminToken(s.handleSpendReport))
+	mux.HandleFunc("/admin/providers", s.RequireAdminToken(s.handleProviderStats))
+	mux.Handle("/metrics", s.metrics.handler())
+	return mux
+}
+
+// Logger returns the logger the server logs to
+func (s *Server) Logger() *slog.Logger {
+	return s.logger
+}
+
+// SessionManager returns the session manager the server opens sessions
+// through: its consumer node client, unless WithSessionManager replaced it
+func (s *Server) SessionManager() SessionManager {
+	return s.manager
+}
+
+// RefreshModels reloads the model list from the consumer node
+func (s *Server) RefreshModels() error {
+	return s.registry.Refresh()
+}
+
+// ServeHTTP serves the proxy routes, tagging every request with a request ID
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, withRequestID(w, r))
+}
+
+// ListenAndServe serves the proxy on the configured port until Shutdown
+func (s *Server) ListenAndServe() error {
+	cfg := s.config()
+	server := &http.Server{
+		Addr:              ":" + cfg.InternalAPIPort,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.mu.Lock()
+	s.httpServer = server
+	s.mu.Unlock()
+	s.draining.Store(false)
+
+	s.logger.Info("Starting server", "port", cfg.InternalAPIPort)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Reload applies a new configuration to new requests without dropping
+// connections or pooled sessions, and restarts the background loops on their
+// new intervals. Changed settings that are only read at startup are logged.
+// The current configuration is kept when the new one is invalid.
+func (s *Server) Reload(cfg *Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if err := cfg.checkPolicies(s.policies); err != nil {
+		return err
+	}
+	if err := s.keys.Configure(cfg.APIKeysFile, cfg.staticKeys()); err != nil {
+		return err
+	}
+	pending := cfg.restartRequired(s.config())
+	for _, name := range pending {
+		s.logger.Warn("Setting changed, restart the proxy to apply it", "setting", name)
+	}
+	s.cfg.Store(cfg)
+	s.keys.interval.Set(cfg.APIKeysReloadInterval)
+	s.registry.interval.Set(cfg.ModelRefreshInterval)
+	s.pool.interval.Set(renewInterval(cfg.SessionRenewBefore))
+	s.monitor.interval.Set(cfg.WalletMonitorInterval)
+	s.logger.Info("Reloaded configuration", "restart_required", pending)
+	return nil
+}
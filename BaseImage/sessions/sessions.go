@@ -3,198 +3,288 @@ package sessions
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"time"
-)
 
-const (
-	maxRetries = 3
-	sessionTimeout = 60 * time.Second
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type Config struct {
-	ConsumerNodeURL   string
-	MarketplaceURL   string
-	SessionDuration  string
-	InternalAPIPort  string
-	AuthToken       string
-}
-
 type SessionResponse struct {
 	SessionToken string    `json:"session_id"`
 	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+	Provider     string    `json:"provider,omitempty"` // Provider address, once known
+	BidID        string    `json:"bid_id,omitempty"`
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+// SessionInfo is the on-chain session state reported by the consumer node
+type SessionInfo struct {
+	ID             string        `json:"Id"`
+	User           string        `json:"User"`
+	Provider       string        `json:"Provider"`
+	ModelAgentID   string        `json:"ModelAgentId"`
+	BidID          string        `json:"BidID"`
+	Stake          NumericString `json:"Stake"`
+	PricePerSecond NumericString `json:"PricePerSecond"`
+	OpenedAt       NumericString `json:"OpenedAt"`
+	EndsAt         NumericString `json:"EndsAt"`
+	ClosedAt       NumericString `json:"ClosedAt"`
 }
 
-type ChatCompletionRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Stream      bool         `json:"stream"`
-	StakeAmount string       `json:"stake_amount,omitempty"` // Amount to stake in wei
+// NumericString holds a big integer the consumer node may encode either as a
+// JSON number or as a string
+type NumericString string
+
+func (n *NumericString) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*n = ""
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*n = NumericString(s)
+		return nil
+	}
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return fmt.Errorf("invalid numeric value %s", string(data))
+	}
+	*n = NumericString(num.String())
+	return nil
 }
 
-type ChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// IsZero reports whether the value is empty or zero
+func (n NumericString) IsZero() bool {
+	return n == "" || n == "0"
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
 }
 
 type ModelInfo struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Endpoint    string `json:"endpoint"`
-	Description string `json:"description"`
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Endpoint    string        `json:"endpoint"`
+	Description string        `json:"description"`
+	IpfsCID     string        `json:"ipfsCID"`
+	Fee         NumericString `json:"fee"`
+	Stake       NumericString `json:"stake"`
+	Owner       string        `json:"owner"`
+	Tags        []string      `json:"tags"`
+	CreatedAt   NumericString `json:"createdAt"`
+	IsDeleted   bool          `json:"isDeleted"`
 }
 
 type ModelsResponse struct {
 	Models []ModelInfo `json:"models"`
 }
 
-type ChatResponse struct {
-	Response string `json:"response"`
-}
-
 type AuthResponse struct {
 	Token string `json:"token"`
 }
 
-// Cookie file credentials
-type Credentials struct {
-	Username string
-	Password string
+// consumerClient makes a Server's calls to the consumer node. It implements
+// SessionManager, looking models up in the server's model registry.
+type consumerClient struct {
+	config   func() *Config
+	client   *http.Client   // Replaces the per-call clients when set, see WithHTTPClient
+	models   *http.Client   // Shared by model list refreshes so connections are reused
+	registry *ModelRegistry // Set once the server created its registry
+	metrics  *serverMetrics
+	logger   *slog.Logger
+	tracer   trace.Tracer
+
+	credentials CredentialsProvider
 }
 
-var config Config
-var credentials *Credentials
-
-type SessionManager interface {
-	GetModelByHandle(modelHandle string) (*ModelInfo, error)
-	CreateSession(modelId string, stakeAmount string) (*SessionResponse, error)
-	SendChatMessage(sessionToken string, modelId string, message string, stream bool, w StreamWriter) (*ChatResponse, error)
+func newConsumerClient(config func() *Config, metrics *serverMetrics) *consumerClient {
+	return &consumerClient{
+		config:  config,
+		metrics: metrics,
+		logger: slog.Default(),
+		tracer: otel.GetTracerProvider().Tracer(tracerName),
+		models: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				ResponseHeaderTimeout: 25 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+	}
 }
 
-type DefaultSessionManager struct{}
-
-var sessionManager SessionManager = &DefaultSessionManager{}
+// httpClient returns the client given with WithHTTPClient, or def
+func (c *consumerClient) httpClient(def *http.Client) *http.Client {
+	if c.client != nil {
+		return c.client
+	}
+	return def
+}
 
-// SetSessionManager allows injecting a mock for testing
-func SetSessionManager(sm SessionManager) {
-	sessionManager = sm
+// SessionManager talks to the consumer node. Every call stops its upstream
+// work when ctx is cancelled, e.g. because the client hung up. Opening a
+// session fails with an error matching ErrNoProvider, ErrInsufficientFunds or
+// ErrInsufficientAllowance with errors.Is when that is the cause; the proxy
+// picks its response and fails over by those errors alone.
+type SessionManager interface {
+	GetModelByHandle(ctx context.Context, modelHandle string) (*ModelInfo, error)
+	ListModels(ctx context.Context) ([]ModelInfo, error)
+	CreateSession(ctx context.Context, modelId string, params SessionParams) (*SessionResponse, error)
+	GetSession(ctx context.Context, sessionToken string) (*SessionInfo, error)
+	CloseSession(ctx context.Context, sessionToken string) error
+	SendChatMessage(ctx context.Context, sessionToken string, modelId string, chatReq *ChatCompletionRequest, w StreamWriter) (*ChatResponse, error)
+	ListBids(ctx context.Context, modelId string) ([]BidInfo, error)
+	CreateSessionForBid(ctx context.Context, bidId string, params SessionParams) (*SessionResponse, error)
+	GetBalance(ctx context.Context) (*WalletBalance, error)
+	GetAllowance(ctx context.Context, spender string) (*big.Int, error)
+	Approve(ctx context.Context, spender string, amount *big.Int) error
 }
 
-func LoadConfig() error {
-	config = Config{
-		ConsumerNodeURL:  os.Getenv("CONSUMER_NODE_URL"),
-		MarketplaceURL:  os.Getenv("MARKETPLACE_URL"),
-		SessionDuration: os.Getenv("SESSION_DURATION"),
-		InternalAPIPort: os.Getenv("INTERNAL_API_PORT"),
-		AuthToken:       os.Getenv("AUTH_TOKEN"),
+func (s *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "healthy",
+		"model_registry": s.registry.Status(),
+		"queue":          s.scheduler.Status(),
+	})
+}
 
-	if config.ConsumerNodeURL == "" {
-		return errors.New("CONSUMER_NODE_URL environment variable is required")
-	}
-	if config.SessionDuration == "" {
-		config.SessionDuration = "1h" // Default session duration
-	}
-	if config.InternalAPIPort == "" {
-		config.InternalAPIPort = "8081" // Default port
+// setBasicAuth sets the consumer node credentials on req
+func (c *consumerClient) setBasicAuth(req *http.Request) error {
+	credentials, err := c.credentials.Credentials()
+	if err != nil {
+		return err
 	}
-
+	req.SetBasicAuth(credentials.Username, credentials.Password)
 	return nil
 }
 
-func HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+// noProviderError is how the consumer node reports that no provider took the session
+const noProviderError = "no provider accepting session"
+
+// consumerNodeError turns an error message of the consumer node into an
+// error, marked with its kind when it is one the proxy knows. The consumer
+// node reports these in free text only, so this is the one place that reads
+// them.
+func consumerNodeError(message string) error {
+	err := errors.New(message)
+	switch lower := strings.ToLower(message); {
+	case strings.Contains(lower, noProviderError):
+		return withKind(ErrNoProvider, err)
+	case strings.Contains(lower, "allowance"):
+		return withKind(ErrInsufficientAllowance, err)
+	case strings.Contains(lower, "exceeds balance"), strings.Contains(lower, "insufficient funds"), strings.Contains(lower, "insufficient balance"):
+		return withKind(ErrInsufficientFunds, err)
+	}
+	return err
 }
 
-func StartServer() error {
-	if err := LoadConfig(); err != nil {
-		return fmt.Errorf("failed to load configuration: %v", err)
+// do sends a request to the consumer node in a client span, passing on the
+// request ID and trace context of the request's context. The span ends once
+// the response headers arrive.
+func (c *consumerClient) do(client *http.Client, req *http.Request, endpoint string) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), c.tracer, "consumer_node "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(req.Method), semconv.URLFull(req.URL.String())))
+	req = req.WithContext(ctx)
+	injectRequestContext(ctx, req.Header)
+
+	resp, err := c.doAuthenticated(client, req, endpoint)
+	if err == nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
 	}
-
-	http.HandleFunc("/health", HandleHealthCheck)
-	http.HandleFunc("/v1/chat/completions", HandleChatCompletions)
-	
-	log.Printf("Starting server on port %s", config.InternalAPIPort)
-	return http.ListenAndServe(":"+config.InternalAPIPort, nil)
+	endSpan(span, err)
+	return resp, err
 }
 
-func authenticate() error {
-	// Only authenticate once
-	if credentials != nil {
-		return nil
+// doAuthenticated sends a request to the consumer node. When the node rejects
+// the credentials, they are refreshed and the request is retried once with
+// the new ones, so rotated credentials take effect without failing requests.
+func (c *consumerClient) doAuthenticated(client *http.Client, req *http.Request, endpoint string) (*http.Response, error) {
+	resp, err := c.metrics.doUpstream(client, req, endpoint)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
 	}
 
-	// Try to read credentials from cookie file first
-	cookiePath := os.Getenv("COOKIE_FILE_PATH")
-	if cookiePath == "" {
-		cookiePath = ".cookie" // Default to current directory
+	credentials, err := c.credentials.Refresh()
+	if err != nil {
+		c.logger.ErrorContext(req.Context(), "Consumer node rejected the credentials and refreshing them failed", "error", err)
+		return resp, nil
 	}
-
-	// Try to read existing cookie file
-	if data, err := os.ReadFile(cookiePath); err == nil {
-		parts := strings.Split(strings.TrimSpace(string(data)), ":")
-		if len(parts) == 2 {
-			credentials = &Credentials{
-				Username: parts[0],
-				Password: parts[1],
-			}
-			return nil
+	if username, password, _ := req.BasicAuth(); username == credentials.Username && password == credentials.Password {
+		return resp, nil
+	}
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
 		}
+		req.Body = body
 	}
+	resp.Body.Close()
 
-	// If no cookie file, try environment variables
-	username := os.Getenv("CONSUMER_USERNAME")
-	if username == "" {
-		return fmt.Errorf("CONSUMER_USERNAME environment variable is required")
-	}
-	password := os.Getenv("CONSUMER_PASSWORD")
-	if password == "" {
-		return fmt.Errorf("no credentials found in cookie file or environment")
-	}
+	c.logger.WarnContext(req.Context(), "Consumer node rejected the credentials, retrying with refreshed ones", "endpoint", endpoint)
+	req.SetBasicAuth(credentials.Username, credentials.Password)
+	return c.metrics.doUpstream(client, req, endpoint)
+}
 
-	credentials = &Credentials{
-		Username: username,
-		Password: password,
-	}
+// GetModelByHandle looks up a model in the server's registry. It stops
+// waiting on a refresh it joins when ctx is done; the refresh carries on for
+// the other requests waiting on it.
+func (c *consumerClient) GetModelByHandle(ctx context.Context, modelHandle string) (*ModelInfo, error) {
+	return c.registry.lookup(ctx, modelHandle)
+}
 
-	return nil
+func (c *consumerClient) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	return c.registry.list(ctx)
 }
 
-// Helper function to set Basic Auth header
-func setBasicAuth(req *http.Request) error {
-	if err := authenticate(); err != nil {
-		return err
+// sleepContext waits for d, returning early with the context error if ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	
-	// Use credentials in Basic Auth header
-	auth := fmt.Sprintf("%s:%s", credentials.Username, credentials.Password)
-	encodedAuth := base64.StdEncoding.EncodeToString([]byte(auth))
-	log.Printf("Debug - Auth string before encoding: %s", auth)
-	log.Printf("Debug - Auth string after encoding: %s", encodedAuth)
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedAuth))
-	return nil
 }
 
-func getModelByHandle(modelHandle string) (*ModelInfo, error) {
-	url := fmt.Sprintf("%s/blockchain/models", config.ConsumerNodeURL)
+// fetchModels lists the models registered on chain, skipping deleted ones
+func (c *consumerClient) fetchModels(ctx context.Context) ([]ModelInfo, error) {
+	cfg := c.config()
+	url := fmt.Sprintf("%s/blockchain/models", cfg.ConsumerNodeURL)
 	
 	// Create request once, reuse for retries
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -202,33 +292,29 @@ func getModelByHandle(modelHandle string) (*ModelInfo, error) {
 	// Set required headers according to spec
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	if err := setBasicAuth(req); err != nil {
+	if err := c.setBasicAuth(req); err != nil {
 		return nil, fmt.Errorf("failed to set auth: %v", err)
 	}
 	
-	client := &http.Client{
-		Timeout: 30 * time.Second,  // Increased timeout
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: 25 * time.Second,
-			IdleConnTimeout:      20 * time.Second,
-			DisableKeepAlives:    true,
-		},
-	}
-
 	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Printf("Getting models attempt %d of %d", attempt, maxRetries)
+	for attempt := 1; attempt <= cfg.RetryAttempts; attempt++ {
+		c.logger.Debug("Getting models", "attempt", attempt, "attempts", cfg.RetryAttempts)
 		
-		resp, err := client.Do(req)
+		resp, err := c.do(c.httpClient(c.models), req, upstreamModels)
 		if err != nil {
-			log.Printf("Error getting models (attempt %d): %v", attempt, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			c.logger.Warn("Error getting models", "attempt", attempt, "error", err)
 			lastErr = err
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			if err, ok := err.(net.Error); ok && err.Timeout() {
-				return nil, fmt.Errorf("models request timed out after %d attempts: %v", attempt, err)
+				return nil, fmt.Errorf("models request timed out after %d attempts: %w", attempt, withKind(ErrUpstreamTimeout, err))
 			}
 			return nil, fmt.Errorf("failed to connect to consumer node after %d attempts: %v", attempt, err)
 		}
@@ -237,16 +323,18 @@ func getModelByHandle(modelHandle string) (*ModelInfo, error) {
 		// Read the response body
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("Error reading models response body (attempt %d): %v", attempt, err)
+			c.logger.Warn("Error reading models response body", "attempt", attempt, "error", err)
 			lastErr = err
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			return nil, fmt.Errorf("failed to read response body: %v", err)
 		}
 
-		log.Printf("Got models response: %s", string(body))
+		c.logger.Debug("Got models response", "status", resp.StatusCode, "bytes", len(body))
 		
 		// Handle different status codes according to spec
 		switch resp.StatusCode {
@@ -255,14 +343,14 @@ func getModelByHandle(modelHandle string) (*ModelInfo, error) {
 			if err := json.Unmarshal(body, &modelsResp); err != nil {
 				return nil, fmt.Errorf("failed to decode models response: %v", err)
 			}
-			
-			// Look for the requested model
+
+			models := make([]ModelInfo, 0, len(modelsResp.Models))
 			for _, model := range modelsResp.Models {
-				if strings.EqualFold(model.Name, modelHandle) {
-					return &model, nil
+				if !model.IsDeleted {
+					models = append(models, model)
 				}
 			}
-			return nil, fmt.Errorf("model not found: %s", modelHandle)
+			return models, nil
 			
 		case http.StatusUnauthorized:
 			var errorResp ErrorResponse
@@ -279,89 +367,88 @@ func getModelByHandle(modelHandle string) (*ModelInfo, error) {
 			return nil, fmt.Errorf("bad request: %s", errorResp.Error)
 			
 		case http.StatusServiceUnavailable:
-			log.Printf("Service unavailable (attempt %d), retrying...", attempt)
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			c.logger.Warn("Consumer node unavailable, retrying", "endpoint", upstreamModels, "attempt", attempt)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
-			return nil, fmt.Errorf("service unavailable after %d attempts", maxRetries)
+			return nil, fmt.Errorf("service unavailable after %d attempts", cfg.RetryAttempts)
 			
 		default:
-			if attempt < maxRetries {
-				log.Printf("Unexpected status code %d (attempt %d), retrying...", resp.StatusCode, attempt)
-				time.Sleep(time.Duration(attempt) * time.Second)
+			if attempt < cfg.RetryAttempts {
+				c.logger.Warn("Unexpected status code, retrying", "endpoint", upstreamModels, "status", resp.StatusCode, "attempt", attempt)
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
 		}
 	}
 
-	return nil, fmt.Errorf("failed to get models after %d attempts, last error: %v", maxRetries, lastErr)
+	return nil, fmt.Errorf("failed to get models after %d attempts, last error: %v", cfg.RetryAttempts, lastErr)
 }
 
-func CreateSession(modelId string, stakeAmount string) (*SessionResponse, error) {
-	url := fmt.Sprintf("%s/blockchain/models/%s/session", config.ConsumerNodeURL, modelId)
+func (c *consumerClient) CreateSession(ctx context.Context, modelId string, params SessionParams) (*SessionResponse, error) {
+	cfg := c.config()
+	url := fmt.Sprintf("%s/blockchain/models/%s/session", cfg.ConsumerNodeURL, modelId)
 
 	// Create session request payload according to OpenSessionWithFailover spec
-	duration, err := time.ParseDuration(config.SessionDuration)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse session duration: %v", err)
-	}
-	durationSecs := int64(duration.Seconds())
-
-	payload := map[string]interface{}{
-		"sessionDuration": fmt.Sprintf("%d", durationSecs),
-		"directPayment": false,
-		"failover": false,
-		"fee": "300000000000",  // Adding standard fee amount
-		"stake": stakeAmount,   // Including stake amount from request
-	}
+	payload := params.payload()
+	payload["failover"] = cfg.SessionFailover
 
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Creating session with URL: %s and payload: %s", url, string(body))
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	if err := setBasicAuth(req); err != nil {
+	if err := c.setBasicAuth(req); err != nil {
 		return nil, fmt.Errorf("failed to set auth: %v", err)
 	}
 
-	// Log request details
-	log.Printf("Making session request to URL: %s", url)
-	log.Printf("Session request payload: %s", string(body))
-	log.Printf("Session request headers: %+v", req.Header)
+	c.logger.DebugContext(ctx, "Creating session", "model", modelId)
 
-	client := &http.Client{
-		Timeout: sessionTimeout,
+	client := c.httpClient(&http.Client{
+		Timeout: cfg.SessionOpenTimeout,
 		Transport: &http.Transport{
 			ResponseHeaderTimeout: 55 * time.Second,
 			IdleConnTimeout:      30 * time.Second,
 			DisableKeepAlives:    true,
 		},
-	}
+	})
 	
 	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Printf("Session creation attempt %d of %d", attempt, maxRetries)
-		
-		resp, err := client.Do(req)
+	for attempt := 1; attempt <= cfg.RetryAttempts; attempt++ {
+		c.logger.DebugContext(ctx, "Session creation attempt", "model", modelId, "attempt", attempt, "attempts", cfg.RetryAttempts)
+		c.metrics.sessionCreateAttempts.WithLabelValues(c.registry.label(modelId)).Inc()
+		if attempt > 1 {
+			c.metrics.sessionCreateRetries.WithLabelValues(c.registry.label(modelId)).Inc()
+		}
+
+		resp, err := c.do(client, req, upstreamSessionOpen)
 		if err != nil {
-			log.Printf("Error making session request (attempt %d): %v", attempt, err)
+			// Never retry for a client that is gone, so no session is paid for
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			c.logger.WarnContext(ctx, "Error making session request", "model", modelId, "attempt", attempt, "error", err)
 			lastErr = err
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			if err, ok := err.(net.Error); ok && err.Timeout() {
-				return nil, fmt.Errorf("session creation timed out after %d attempts: %v", attempt, err)
+				return nil, fmt.Errorf("session creation timed out after %d attempts: %w", attempt, withKind(ErrUpstreamTimeout, err))
 			}
 			return nil, fmt.Errorf("failed to connect to consumer node after %d attempts: %v", attempt, err)
 		}
@@ -369,22 +456,25 @@ func CreateSession(modelId string, stakeAmount string) (*SessionResponse, error)
 
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("Error reading session response body (attempt %d): %v", attempt, err)
+			c.logger.WarnContext(ctx, "Error reading session response body", "model", modelId, "attempt", attempt, "error", err)
 			lastErr = err
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			return nil, fmt.Errorf("failed to read response body: %v", err)
 		}
 
-		log.Printf("Session creation response - Status: %d, Headers: %+v", resp.StatusCode, resp.Header)
-		log.Printf("Session creation response body: %s", string(respBody))
+		c.logger.DebugContext(ctx, "Session creation response", "model", modelId, "status", resp.StatusCode)
 
 		if resp.StatusCode == http.StatusServiceUnavailable {
-			log.Printf("Service unavailable (attempt %d), retrying...", attempt)
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			c.logger.WarnContext(ctx, "Consumer node unavailable, retrying", "endpoint", upstreamSessionOpen, "attempt", attempt)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 		}
@@ -392,18 +482,26 @@ func CreateSession(modelId string, stakeAmount string) (*SessionResponse, error)
 		if resp.StatusCode != http.StatusOK {
 			var eResp ErrorResponse
 			if err := json.Unmarshal(respBody, &eResp); err != nil {
-				log.Printf("Failed to parse error response: %v", err)
+				c.logger.WarnContext(ctx, "Failed to parse session error response", "status", resp.StatusCode, "error", err)
 				lastErr = fmt.Errorf("failed to create session, status: %d, body: %s", resp.StatusCode, string(respBody))
-				if attempt < maxRetries {
-					time.Sleep(time.Duration(attempt) * time.Second)
+				if attempt < cfg.RetryAttempts {
+					if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+						return nil, err
+					}
 					continue
 				}
 				return nil, lastErr
 			}
-			log.Printf("Session creation error: %s", eResp.Error)
-			lastErr = fmt.Errorf("failed to create session: %s", eResp.Error)
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			c.logger.WarnContext(ctx, "Session creation failed", "model", modelId, "attempt", attempt, "error", eResp.Error)
+			lastErr = fmt.Errorf("failed to create session: %w", consumerNodeError(eResp.Error))
+			// Retrying cannot help a wallet that cannot pay
+			if errors.Is(lastErr, ErrInsufficientFunds) || errors.Is(lastErr, ErrInsufficientAllowance) {
+				return nil, lastErr
+			}
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			return nil, lastErr
@@ -414,25 +512,94 @@ func CreateSession(modelId string, stakeAmount string) (*SessionResponse, error)
 			SessionID string `json:"sessionID"`
 		}
 		if err := json.Unmarshal(respBody, &sessionResp); err != nil {
-			log.Printf("Failed to parse session response: %v", err)
+			c.logger.WarnContext(ctx, "Failed to parse session response", "error", err)
 			lastErr = fmt.Errorf("failed to decode session response: %v", err)
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+			if attempt < cfg.RetryAttempts {
+				if err := sleepContext(ctx, time.Duration(attempt)*cfg.RetryBackoff); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			return nil, lastErr
 		}
 
-		log.Printf("Successfully created session with token: %s", sessionResp.SessionID)
+		c.logger.InfoContext(ctx, "Created session", "session", sessionResp.SessionID, "model", modelId)
 
 		// Return the session response with the session ID
 		return &SessionResponse{
 			SessionToken: sessionResp.SessionID,
-			ExpiresAt:   time.Now().Add(duration),
+			ExpiresAt:   time.Now().Add(params.Duration),
 		}, nil
 	}
 
-	return nil, fmt.Errorf("failed to create session after %d attempts, last error: %v", maxRetries, lastErr)
+	return nil, fmt.Errorf("failed to create session after %d attempts, last error: %w", cfg.RetryAttempts, lastErr)
+}
+
+// GetSession looks up a session on the consumer node
+func (c *consumerClient) GetSession(ctx context.Context, sessionToken string) (*SessionInfo, error) {
+	url := fmt.Sprintf("%s/blockchain/sessions/%s", c.config().ConsumerNodeURL, sessionToken)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.setBasicAuth(req); err != nil {
+		return nil, fmt.Errorf("failed to set auth: %v", err)
+	}
+
+	client := c.httpClient(&http.Client{Timeout: 10 * time.Second})
+	resp, err := c.do(client, req, upstreamSessionGet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to consumer node: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("session lookup failed, status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var sessionResp struct {
+		Session SessionInfo `json:"session"`
+	}
+	if err := json.Unmarshal(respBody, &sessionResp); err != nil {
+		return nil, fmt.Errorf("failed to decode session response: %v", err)
+	}
+	return &sessionResp.Session, nil
+}
+
+// CloseSession closes a blockchain session so the stake is returned to the wallet
+func (c *consumerClient) CloseSession(ctx context.Context, sessionToken string) error {
+	cfg := c.config()
+	url := fmt.Sprintf("%s/blockchain/sessions/%s/close", cfg.ConsumerNodeURL, sessionToken)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.setBasicAuth(req); err != nil {
+		return fmt.Errorf("failed to set auth: %v", err)
+	}
+
+	client := c.httpClient(&http.Client{Timeout: cfg.SessionOpenTimeout})
+	resp, err := c.do(client, req, upstreamSessionClose)
+	if err != nil {
+		return fmt.Errorf("failed to connect to consumer node: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to close session, status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	c.logger.InfoContext(ctx, "Closed session", "session", sessionToken)
+	return nil
 }
 
 type StreamWriter interface {
@@ -440,27 +607,18 @@ type StreamWriter interface {
 	Flush()
 }
 
-func SendChatMessage(sessionToken string, modelId string, message string, stream bool, w StreamWriter) (*ChatResponse, error) {
-	url := fmt.Sprintf("%s/v1/chat/completions", config.ConsumerNodeURL)
+func (c *consumerClient) SendChatMessage(ctx context.Context, sessionToken string, modelId string, chatReq *ChatCompletionRequest, w StreamWriter) (*ChatResponse, error) {
+	cfg := c.config()
+	url := fmt.Sprintf("%s/v1/chat/completions", cfg.ConsumerNodeURL)
+	stream := chatReq.Stream
 
-	payload := map[string]interface{}{
-		"model": modelId,
-		"messages": []map[string]string{
-			{
-				"role": "user",
-				"content": message,
-			},
-		},
-		"stream": stream,
-	}
-	body, err := json.Marshal(payload)
+	// Forward the conversation and parameters as sent by the client
+	body, err := chatReq.UpstreamBody(modelId)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Sending chat request to %s with payload: %s", url, string(body))
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -472,56 +630,38 @@ func SendChatMessage(sessionToken string, modelId string, message string, stream
 	} else {
 		req.Header.Set("Accept", "application/json")
 	}
-	if err := setBasicAuth(req); err != nil {
+	if err := c.setBasicAuth(req); err != nil {
 		return nil, fmt.Errorf("failed to set auth: %v", err)
 	}
 	req.Header.Set("session_id", sessionToken)
 
-	log.Printf("Chat request headers: %v", req.Header)
+	attrs := []interface{}{"session", sessionToken, "model", modelId, "stream", stream}
+	if cfg.LogContent {
+		attrs = append(attrs, "request_body", string(body))
+	}
+	c.logger.DebugContext(ctx, "Sending chat request", attrs...)
 
-	client := &http.Client{Timeout: 60 * time.Second} // Increased timeout for streaming
-	resp, err := client.Do(req)
+	client := c.httpClient(&http.Client{Timeout: 60 * time.Second}) // Increased timeout for streaming
+	resp, err := c.do(client, req, upstreamChat)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to consumer node: %v", err)
+		return nil, fmt.Errorf("failed to connect to consumer node: %w", timeoutError(err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		log.Printf("Chat error response: %s", string(respBody))
-		return nil, fmt.Errorf("chat request failed with status %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	// For streaming responses
-	if stream && w != nil {
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					return &ChatResponse{}, nil
-				}
-				return nil, err
-			}
-
-			// Skip empty lines
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
-
-			// Handle SSE data
-			if strings.HasPrefix(line, "data: ") {
-				data := strings.TrimPrefix(line, "data: ")
-				if data == "[DONE]" {
-					return &ChatResponse{}, nil
-				}
-
-				// Write the data directly to the response writer
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				w.Flush()
-			}
+		c.logger.WarnContext(ctx, "Chat request failed", "session", sessionToken, "status", resp.StatusCode, "response_body", string(respBody))
+		err := fmt.Errorf("chat request failed with status %d: %s", resp.StatusCode, string(respBody))
+		if resp.StatusCode == http.StatusGatewayTimeout {
+			err = withKind(ErrUpstreamTimeout, err)
 		}
+		return nil, err
+	}
+
+	// Streamed responses are relayed to w as they arrive and assembled into a
+	// completion, which also covers nodes that stream non-streaming requests
+	if stream || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readChatStream(ctx, c.logger, resp.Body, w)
 	}
 
 	// For non-streaming responses
@@ -535,87 +675,269 @@ func SendChatMessage(sessionToken string, modelId string, message string, stream
 		return nil, fmt.Errorf("failed to decode chat response: %v", err)
 	}
 
-	log.Printf("Successfully received chat response: %s", chatResp.Response)
+	attrs = []interface{}{"session", sessionToken, "model", modelId, "status", resp.StatusCode}
+	if cfg.LogContent {
+		attrs = append(attrs, "response_body", string(respBody))
+	}
+	c.logger.DebugContext(ctx, "Received chat response", attrs...)
 	return &chatResp, nil
 }
 
-// HandleChatCompletions processes chat completion requests
-func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// readChatStream reads an SSE chat stream, relaying each event to w when it
+// is set, and returns the completion assembled from the chunks. A stream that
+// breaks off before [DONE] or a finish reason returns the partial completion
+// with ErrStreamInterrupted.
+func readChatStream(ctx context.Context, logger *slog.Logger, body io.Reader, w StreamWriter) (*ChatResponse, error) {
+	builder := newCompletionBuilder()
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && builder.Finished() {
+				return builder.Response(), nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return builder.Response(), fmt.Errorf("%w: %v", ErrStreamInterrupted, err)
+		}
+
+		// Skip empty lines
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// Handle SSE data
+		if strings.HasPrefix(line, "data: ") {
+			data := strings.TrimPrefix(line, "data: ")
+
+			// Write the data directly to the response writer
+			if w != nil {
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				w.Flush()
+			}
+			if data == "[DONE]" {
+				return builder.Response(), nil
+			}
+
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				logger.DebugContext(ctx, "Skipping undecodable stream chunk", "error", err)
+				continue
+			}
+			builder.Add(&chunk)
+		}
+	}
+}
+
+// newCompletionID generates an OpenAI style completion ID
+func newCompletionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+// handleChatCompletions processes chat completion requests
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	r, span := startServerSpan(r, s.tracer, "chat.completions")
+	metrics := newRequestMetrics(r.Context(), s.logger, s.metrics)
+	mw := &metricsResponseWriter{ResponseWriter: w, metrics: metrics}
+	w = mw
+	var usage *Usage
+	defer func() {
+		metrics.observe(usage)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(metrics.status), attribute.String("model", metrics.model))
+		if metrics.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(metrics.status))
+		}
+		span.End()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Method not allowed",
-		})
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
 		return
 	}
 
 	// Read and parse the request body
 	var chatReq ChatCompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Invalid request body: %v", err),
-		})
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request_body", fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
 	// Validate request
 	if len(chatReq.Messages) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Messages array cannot be empty",
-		})
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_messages", "Messages array cannot be empty")
+		return
+	}
+
+	// Model aliases from the configuration stand for a registered handle
+	cfg := s.config()
+	handle := cfg.resolveModel(chatReq.Model)
+	if key := apiKeyFromContext(r.Context()); key != nil && !key.AllowsModel(handle) {
+		writeOpenAIError(w, http.StatusForbidden, "invalid_request_error", "model_not_allowed",
+			fmt.Sprintf("This API key is not allowed to use the model '%s'", chatReq.Model))
 		return
 	}
 
 	// Get model info based on the requested model handle
-	model, err := sessionManager.GetModelByHandle(chatReq.Model)
+	ctx := r.Context()
+	lookupCtx, lookupSpan := startSpan(ctx, s.tracer, "model.lookup", trace.WithAttributes(attribute.String("model", handle)))
+	model, err := s.manager.GetModelByHandle(lookupCtx, handle)
+	endSpan(lookupSpan, err)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Error getting model info: %v", err),
-		})
+		if ctx.Err() != nil {
+			metrics.cancelled("model_lookup")
+			return
+		}
+		writeError(w, err, fmt.Sprintf("Error getting model info: %v", err))
 		return
 	}
+	metrics.model = model.Name
 
-	// Create session with the consumer node using the model ID
-	session, err := sessionManager.CreateSession(model.ID, chatReq.StakeAmount)
+	params, err := sessionParamsFromRequest(r, &chatReq, cfg)
 	if err != nil {
-		// Check for specific error cases
-		if strings.Contains(err.Error(), "no provider accepting session") {
-			w.WriteHeader(http.StatusBadRequest)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Error creating session: %v", err),
-		})
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_session_params", err.Error())
 		return
 	}
 
-	// Wait for 20 seconds after session creation
-	log.Printf("Waiting 20 seconds for session initialization...")
-	time.Sleep(20 * time.Second)
-	log.Printf("Resuming after wait, sending chat message...")
+	selection, err := s.selectionFromRequest(r, cfg)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_selection_policy", err.Error())
+		return
+	}
 
-	// Send the chat message
-	lastMessage := chatReq.Messages[len(chatReq.Messages)-1]
+	// Requests over a limit of the model or a token limit are turned away; the
+	// tokens reserved for the request are settled against its usage once it
+	// is done
+	reservation, limits, err := s.limiter.Allow(r, apiKeyFromContext(ctx), model.Name, estimateTokens(&chatReq))
+	limits.set(w)
+	if err != nil {
+		writeError(w, err, err.Error())
+		return
+	}
+	defer func() { reservation.Settle(usage) }()
+
+	// Deterministic requests are answered from the response cache without a
+	// session; Cache-Control: no-cache skips the lookup but refreshes the entry
+	var responseKey string
+	if s.cache != nil && cacheable(r, &chatReq) {
+		var tenant string
+		if apiKey := apiKeyFromContext(ctx); apiKey != nil && !cfg.CacheShared {
+			tenant = apiKey.Tenant
+		}
+		if responseKey, err = cacheKey(tenant, model.ID, &chatReq); err != nil {
+			s.logger.WarnContext(ctx, "Error computing the response cache key", "error", err)
+		}
+	}
+	if responseKey != "" {
+		if cached, ok := s.cache.Get(responseKey); ok && !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			s.metrics.cacheRequests.WithLabelValues(model.Name, strings.ToLower(cacheHit)).Inc()
+			span.SetAttributes(attribute.String("cache", cacheHit))
+			w.Header().Set("X-Cache", cacheHit)
+			reservation.Refund()
+			writeCachedResponse(w, cached, &chatReq)
+			return
+		}
+		s.metrics.cacheRequests.WithLabelValues(model.Name, strings.ToLower(cacheMiss)).Inc()
+		span.SetAttributes(attribute.String("cache", cacheMiss))
+		w.Header().Set("X-Cache", cacheMiss)
+	}
+
+	// Requests over the concurrency limits wait for their turn
+	keyLimit := 0
+	var keyName string
+	if apiKey := apiKeyFromContext(ctx); apiKey != nil {
+		keyName, keyLimit = apiKey.Key, cfg.MaxConcurrentPerKey
+		if apiKey.MaxConcurrent > 0 {
+			keyLimit = apiKey.MaxConcurrent
+		}
+	}
+	queueCtx, queueSpan := startSpan(ctx, s.tracer, "queue.wait")
+	release, err := s.scheduler.Acquire(queueCtx, model.Name, keyName, keyLimit)
+	endSpan(queueSpan, err)
+	if err != nil {
+		if ctx.Err() != nil {
+			metrics.cancelled("queue")
+			return
+		}
+		writeError(w, err, fmt.Sprintf("Error waiting for a turn: %v", err))
+		return
+	}
+	defer release()
+
+	// Reuse a pooled session for the model, opening one if needed
+	key := sessionKey{ModelID: model.ID, Caller: callerFromRequest(r, cfg), Selection: selection.key(), Terms: params.key()}
+	sessReq := sessionRequest{
+		Model:     model,
+		Params:    params,
+		APIKey:    apiKeyFromContext(ctx),
+		Selection: selection,
+	}
+	acquireCtx, acquireSpan := startSpan(ctx, s.tracer, "session.acquire")
+	session, err := s.pool.Acquire(acquireCtx, key, sessReq)
+	if err == nil {
+		acquireSpan.SetAttributes(attribute.String("session", session.SessionToken))
+	}
+	endSpan(acquireSpan, err)
+	if err != nil {
+		if ctx.Err() != nil {
+			metrics.cancelled("session")
+			return
+		}
+		writeError(w, err, fmt.Sprintf("Error creating session: %v", err))
+		return
+	}
+
+	if !chatReq.Stream {
+		sent := time.Now()
+		sendCtx, sendSpan := startSpan(ctx, s.tracer, "chat.send")
+		chatResp, err := s.manager.SendChatMessage(sendCtx, session.SessionToken, model.ID, &chatReq, nil)
+		endSpan(sendSpan, err)
+		s.providers.recordOutcome(ctx, session, sent, time.Time{}, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				metrics.cancelled("upstream")
+				return
+			}
+			writeError(w, err, fmt.Sprintf("Error sending chat message: %v", err))
+			return
+		}
+
+		// Fill in what the node left out so clients get a complete object
+		chatResp.Object = "chat.completion"
+		if chatResp.ID == "" {
+			chatResp.ID = newCompletionID()
+		}
+		if chatResp.Created == 0 {
+			chatResp.Created = time.Now().Unix()
+		}
+		if chatResp.Model == "" {
+			chatResp.Model = chatReq.Model
+		}
+		usage = chatResp.Usage
+		if responseKey != "" {
+			s.cache.Put(responseKey, chatResp)
+		}
+		json.NewEncoder(w).Encode(chatResp)
+		return
+	}
 
 	// Get the flusher for streaming
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Streaming not supported",
-		})
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "streaming_unsupported", "Streaming not supported")
 		return
 	}
 
+	// Set headers for streaming response
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
 	// Create a wrapper that implements StreamWriter
 	streamWriter := struct {
 		http.ResponseWriter
@@ -623,24 +945,30 @@ func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	}{w, flusher}
 
 	// Start streaming
-	_, err = sessionManager.SendChatMessage(session.SessionToken, model.ID, lastMessage.Content, true, streamWriter)
+	sendCtx, sendSpan := startSpan(ctx, s.tracer, "chat.send", trace.WithAttributes(attribute.Bool("stream", true)))
+	chatResp, err := s.streamChat(sendCtx, key, sessReq, session, &chatReq, streamWriter)
+	endSpan(sendSpan, err)
+	if chatResp != nil {
+		usage = chatResp.Usage
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Error sending chat message: %v", err),
-		})
+		if ctx.Err() != nil {
+			metrics.cancelled("stream")
+			return
+		}
+		// Once the stream started the status is sent, so the error
+		// follows the chunks as an event of its own
+		message := fmt.Sprintf("Error sending chat message: %v", err)
+		if mw.wroteHeader {
+			writeStreamError(streamWriter, err, message)
+			return
+		}
+		w.Header().Del("Cache-Control")
+		w.Header().Del("Connection")
+		writeError(w, err, message)
 		return
 	}
+	if responseKey != "" && len(chatResp.Choices) > 0 {
+		s.cache.Put(responseKey, chatResp)
+	}
 }
-
-func (sm *DefaultSessionManager) GetModelByHandle(modelHandle string) (*ModelInfo, error) {
-	return getModelByHandle(modelHandle)
-}
-
-func (sm *DefaultSessionManager) CreateSession(modelId string, stakeAmount string) (*SessionResponse, error) {
-	return CreateSession(modelId, stakeAmount)
-}
-
-func (sm *DefaultSessionManager) SendChatMessage(sessionToken string, modelId string, message string, stream bool, w StreamWriter) (*ChatResponse, error) {
-	return SendChatMessage(sessionToken, modelId, message, stream, w)
-} 
\ No newline at end of file
@@ -0,0 +1,57 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Shutdown stops accepting requests, lets in-flight requests and streams
+// finish for up to SHUTDOWN_TIMEOUT, then closes the server. Streams still
+// running at the deadline are cut off.
+func (s *Server) Shutdown() error {
+	s.draining.Store(true)
+
+	s.mu.Lock()
+	server := s.httpServer
+	s.mu.Unlock()
+
+	var shutdownErr error
+	if server != nil {
+		timeout := s.config().ShutdownTimeout
+		s.logger.Info("Shutting down, waiting for in-flight requests", "timeout", timeout.String())
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				s.logger.Warn("Shutdown deadline reached, closing remaining connections")
+			}
+			shutdownErr = err
+			server.Close()
+		}
+	}
+
+	s.Close()
+	return shutdownErr
+}
+
+// Close closes the pooled sessions so their stake is returned, stops the
+// server's background work and flushes its spans. Requests still in flight
+// may fail.
+func (s *Server) Close() {
+	s.logger.Info("Closing pooled sessions")
+	s.pool.Close()
+	s.registry.Close()
+	s.monitor.Close()
+	if s.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.tracerProvider.Shutdown(ctx); err != nil {
+			s.logger.Warn("Error flushing traces", "error", err)
+		}
+		cancel()
+	}
+	s.keys.Close()
+	s.ledger.Close()
+	s.cache.Close()
+}
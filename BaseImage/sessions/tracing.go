@@ -0,0 +1,100 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+
+// requestIDHeader carries the request ID from clients to the proxy and from
+// the proxy to the consumer node
+const requestIDHeader = "X-Request-ID"
+
+// propagator carries the trace context in and out of the proxy as W3C
+// traceparent headers
+var propagator = propagation.TraceContext{}
+
+// WithTracerProvider makes the server create its spans with provider instead
+// of exporting them to the configured collector
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// newTracerProvider creates a provider exporting spans over OTLP/HTTP to the
+// collector at tracing.endpoint. A URL without a path gets the standard
+// /v1/traces one.
+func newTracerProvider(cfg *Config) (*sdktrace.TracerProvider, error) {
+	endpoint, err := url.Parse(cfg.TracingEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing endpoint: %v", err)
+	}
+	path := endpoint.Path
+	if path == "" || path == "/" {
+		path = "/v1/traces"
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host), otlptracehttp.WithURLPath(path)}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.TracingServiceName))),
+	), nil
+}
+
+// startSpan starts a span for a phase of a request, tagged with its request ID
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if id := RequestIDFromContext(ctx); id != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("request_id", id)))
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// startServerSpan starts the span of an inbound request, continuing the
+// caller's trace when the request carries one
+func startServerSpan(r *http.Request, tracer trace.Tracer, name string) (*http.Request, trace.Span) {
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := startSpan(ctx, tracer, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+	return r.WithContext(ctx), span
+}
+
+// endSpan ends a span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectRequestContext adds the request ID and trace context of ctx to an
+// upstream request, so the consumer node's logs can be matched to the
+// proxy's
+func injectRequestContext(ctx context.Context, header http.Header) {
+	if id := RequestIDFromContext(ctx); id != "" {
+		header.Set(requestIDHeader, id)
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
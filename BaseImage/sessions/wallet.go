@@ -0,0 +1,195 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Funds a session is paid from, as reported by InsufficientFundsError
+const (
+	fundsBalance   = "balance"
+	fundsAllowance = "allowance"
+)
+
+var addressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// WalletBalance is the consumer node wallet's balance, in wei
+type WalletBalance struct {
+	ETH NumericString `json:"eth"`
+	MOR NumericString `json:"mor"`
+}
+
+// InsufficientFundsError is returned when the wallet's MOR balance, or the
+// allowance it granted the diamond contract, does not cover a session. It
+// matches ErrInsufficientFunds or ErrInsufficientAllowance.
+type InsufficientFundsError struct {
+	Funds     string // "balance" or "allowance"
+	Required  *big.Int
+	Available *big.Int
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient MOR %s: session needs %s wei, %s wei available", e.Funds, e.Required, e.Available)
+}
+
+func (e *InsufficientFundsError) Is(target error) bool {
+	if e.Funds == fundsAllowance {
+		return target == ErrInsufficientAllowance
+	}
+	return target == ErrInsufficientFunds
+}
+
+// GetBalance returns the ETH and MOR balance of the consumer node's wallet
+func (c *consumerClient) GetBalance(ctx context.Context) (*WalletBalance, error) {
+	var balance WalletBalance
+	if err := c.getJSON(ctx, "/blockchain/balance", upstreamBalance, &balance); err != nil {
+		return nil, err
+	}
+	return &balance, nil
+}
+
+// GetAllowance returns the MOR the consumer node's wallet allows spender to
+// spend
+func (c *consumerClient) GetAllowance(ctx context.Context, spender string) (*big.Int, error) {
+	var allowanceResp struct {
+		Allowance NumericString `json:"allowance"`
+	}
+	path := "/blockchain/allowance?spender=" + url.QueryEscape(spender)
+	if err := c.getJSON(ctx, path, upstreamAllowance, &allowanceResp); err != nil {
+		return nil, err
+	}
+	allowance, ok := new(big.Int).SetString(string(allowanceResp.Allowance), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid allowance %q", allowanceResp.Allowance)
+	}
+	return allowance, nil
+}
+
+// Approve allows spender to spend amount of the consumer node wallet's MOR,
+// returning once the transaction is mined
+func (c *consumerClient) Approve(ctx context.Context, spender string, amount *big.Int) error {
+	cfg := c.config()
+	query := url.Values{"spender": {spender}, "amount": {amount.String()}}
+	approveURL := fmt.Sprintf("%s/blockchain/approve?%s", cfg.ConsumerNodeURL, query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, "POST", approveURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.setBasicAuth(req); err != nil {
+		return fmt.Errorf("failed to set auth: %v", err)
+	}
+
+	client := c.httpClient(&http.Client{Timeout: cfg.SessionOpenTimeout})
+	resp, err := c.do(client, req, upstreamApprove)
+	if err != nil {
+		return fmt.Errorf("failed to connect to consumer node: %w", timeoutError(err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("approve failed, status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var approveResp struct {
+		Tx string `json:"tx"`
+	}
+	json.Unmarshal(respBody, &approveResp)
+	c.logger.InfoContext(ctx, "Approved MOR spending", "spender", spender, "amount", amount.String(), "tx", approveResp.Tx)
+	return nil
+}
+
+// getJSON decodes the response to a GET request for a consumer node path
+func (c *consumerClient) getJSON(ctx context.Context, path string, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.config().ConsumerNodeURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.setBasicAuth(req); err != nil {
+		return fmt.Errorf("failed to set auth: %v", err)
+	}
+
+	client := c.httpClient(&http.Client{Timeout: 10 * time.Second})
+	resp, err := c.do(client, req, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect to consumer node: %w", timeoutError(err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s lookup failed, status: %d, body: %s", endpoint, resp.StatusCode, string(respBody))
+	}
+	if err := json.Unmarshal(respBody, v); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", endpoint, err)
+	}
+	return nil
+}
+
+// checkFunds makes sure the wallet can pay for a session committing required
+// wei of MOR before any of it is staked. An allowance that falls short is
+// raised to wallet.auto_approve_ceiling when that covers the session. The
+// check is skipped without a diamond contract to check the allowance for,
+// and when the funds cannot be looked up, in which case the consumer node
+// has the last word.
+func (s *Server) checkFunds(ctx context.Context, required *big.Int) error {
+	cfg := s.config()
+	if cfg.DiamondContract == "" || required.Sign() == 0 {
+		return nil
+	}
+
+	balance, err := s.manager.GetBalance(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.logger.WarnContext(ctx, "Error checking the wallet balance, opening the session anyway", "error", err)
+		return nil
+	}
+	if mor := parseWei(string(balance.MOR)); mor.Cmp(required) < 0 {
+		return &InsufficientFundsError{Funds: fundsBalance, Required: required, Available: mor}
+	}
+
+	// One approval at a time, so sessions opening together do not each send one
+	s.approveMu.Lock()
+	defer s.approveMu.Unlock()
+
+	allowance, err := s.manager.GetAllowance(ctx, cfg.DiamondContract)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.logger.WarnContext(ctx, "Error checking the diamond contract allowance, opening the session anyway", "error", err)
+		return nil
+	}
+	if allowance.Cmp(required) >= 0 {
+		return nil
+	}
+	ceiling := parseWei(cfg.AutoApproveCeiling)
+	if cfg.AutoApproveCeiling == "" || ceiling.Cmp(required) < 0 {
+		return &InsufficientFundsError{Funds: fundsAllowance, Required: required, Available: allowance}
+	}
+
+	s.logger.InfoContext(ctx, "Raising the diamond contract allowance",
+		"allowance", allowance.String(), "required", required.String(), "ceiling", ceiling.String())
+	if err := s.manager.Approve(ctx, cfg.DiamondContract, ceiling); err != nil {
+		return fmt.Errorf("failed to raise the diamond contract allowance: %w", err)
+	}
+	return nil
+}
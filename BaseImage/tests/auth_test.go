@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// writeAPIKeys writes an API keys file and returns its path
+func writeAPIKeys(t *testing.T, path string, keys string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "api-keys.json")
+	}
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatalf("Failed to write API keys: %v", err)
+	}
+	return path
+}
+
+func expectOpenAIError(t *testing.T, resp *http.Response, status int, code string) {
+	t.Helper()
+
+	body, _ := io.ReadAll(resp.Body)
+	var errResp sessions.OpenAIError
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		t.Fatalf("Expected an OpenAI error body, got %s", string(body))
+	}
+	if resp.StatusCode != status || errResp.Error.Code != code || errResp.Error.Message == "" {
+		t.Errorf("Expected status %d with code %s, got %d: %s", status, code, resp.StatusCode, string(body))
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-team-a","tenant":"team-a"},
+		{"key":"sk-team-b","tenant":"team-b","models":["LMR-OpenAI-GPT-4o"],"spend_cap":"1000000000000000000"}
+	]}`)
+	_, proxy := setupMockProxy(t, map[string]string{"API_KEYS_FILE": keysFile})
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	expectOpenAIError(t, resp, http.StatusUnauthorized, "invalid_api_key")
+
+	resp = postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-wrong"})
+	expectOpenAIError(t, resp, http.StatusUnauthorized, "invalid_api_key")
+
+	resp = postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-team-a"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for a valid key, got %d", resp.StatusCode)
+	}
+
+	resp = postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-team-b"})
+	expectOpenAIError(t, resp, http.StatusForbidden, "model_not_allowed")
+}
+
+func TestAPIKeysAuthToken(t *testing.T) {
+	_, proxy := setupMockProxy(t, map[string]string{"AUTH_TOKEN": "legacy-token"})
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer legacy-token"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected AUTH_TOKEN to be accepted as a bearer key, got %d", resp.StatusCode)
+	}
+
+	// Basic auth with the key as password, as used by the integration tests
+	req, _ := http.NewRequest("POST", proxy.chatURL(), nil)
+	req.SetBasicAuth("admin", "wrong-token")
+	basicResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer basicResp.Body.Close()
+	expectOpenAIError(t, basicResp, http.StatusUnauthorized, "invalid_api_key")
+}
+
+func TestAPIKeysHotReload(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-old","tenant":"team-a"}]}`)
+	_, proxy := setupMockProxy(t, map[string]string{
+		"API_KEYS_FILE":            keysFile,
+		"API_KEYS_RELOAD_INTERVAL": "20ms",
+	})
+
+	writeAPIKeys(t, keysFile, `{"keys":[{"key":"sk-new-rotated","tenant":"team-a"}]}`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-new-rotated"})
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rotated key to be accepted after reload, got %d", resp.StatusCode)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-old"})
+	expectOpenAIError(t, resp, http.StatusUnauthorized, "invalid_api_key")
+}
+
+func TestModelsFilteredByAPIKey(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-limited","tenant":"team-b","models":["LMR-OpenAI-GPT-4o"]}]}`)
+	proxy := startFakeConsumerNode(t, fakeConsumerNodeMux(nil), map[string]string{"API_KEYS_FILE": keysFile})
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer sk-limited")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to list models: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var list sessions.OpenAIModelList
+	json.NewDecoder(resp.Body).Decode(&list)
+	if len(list.Data) != 0 {
+		t.Errorf("Expected models outside the key's allow list to be hidden, got %+v", list.Data)
+	}
+}
+
+func TestAuthFailsClosedWithoutKeys(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer.invalid")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if _, err := sessions.NewServer(cfg); err == nil || !strings.Contains(err.Error(), "auth.disabled") {
+		t.Errorf("Expected the proxy to refuse to start without API keys, got %v", err)
+	}
+
+	// Emptying the keys file later rejects every request
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-a","tenant":"team-a"}]}`)
+	_, proxy := setupMockProxy(t, map[string]string{
+		"API_KEYS_FILE":            keysFile,
+		"API_KEYS_RELOAD_INTERVAL": "20ms",
+		"AUTH_DISABLED":            "false",
+	})
+	writeAPIKeys(t, keysFile, `{"keys":[]}`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-a"})
+		if resp.StatusCode == http.StatusUnauthorized {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected requests to be rejected once no keys are left, got %d", resp.StatusCode)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	expectOpenAIError(t, postChat(t, proxy.chatURL(), helloRequest(), nil), http.StatusUnauthorized, "invalid_api_key")
+}
@@ -0,0 +1,317 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// countedAnswers makes every chat request get a new answer, "Answer 1",
+// "Answer 2" and so on, and returns the number of requests sent
+func countedAnswers(mock *mocks.MockSessionManager) *int32 {
+	var sent int32
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		answer := fmt.Sprintf("Answer %d", atomic.AddInt32(&sent, 1))
+		if w != nil {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":\"stop\"}]}\n\n", answer)
+			w.Flush()
+		}
+		finishReason := "stop"
+		return &sessions.ChatResponse{
+			ID:      "chatcmpl-cached",
+			Object:  "chat.completion",
+			Created: 1700000000,
+			Model:   defaultModelHandle,
+			Choices: []sessions.ChatChoice{{
+				Message:      sessions.ChatMessage{Role: "assistant", Content: answer},
+				FinishReason: &finishReason,
+			}},
+			Usage: &sessions.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+		}, nil
+	}
+	return &sent
+}
+
+func deterministicRequest(content string) sessions.ChatCompletionRequest {
+	temperature := 0.0
+	req := helloRequest()
+	req.Stream = false
+	req.Temperature = &temperature
+	req.Messages = []sessions.ChatMessage{{Role: "user", Content: content}}
+	return req
+}
+
+// cachedAnswer sends a request and returns its X-Cache header and answer
+func cachedAnswer(t *testing.T, url string, req sessions.ChatCompletionRequest, headers map[string]string) (string, string) {
+	t.Helper()
+	resp := postChat(t, url, req, headers)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+	}
+	var chatResp sessions.ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil || len(chatResp.Choices) == 0 {
+		t.Fatalf("Failed to decode the completion: %v", err)
+	}
+	return resp.Header.Get("X-Cache"), chatResp.Choices[0].Message.Content
+}
+
+func TestCacheAnswersRepeatedRequests(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"CACHE_ENABLED": "true"})
+	sent := countedAnswers(mock)
+
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "MISS" || answer != "Answer 1" {
+		t.Errorf("Expected a miss answered upstream, got %s %q", cache, answer)
+	}
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "HIT" || answer != "Answer 1" {
+		t.Errorf("Expected the cached answer, got %s %q", cache, answer)
+	}
+	// Session terms do not change the completion
+	staked := deterministicRequest("Hello")
+	staked.StakeAmount = "1000"
+	if cache, _ := cachedAnswer(t, proxy.chatURL(), staked, nil); cache != "HIT" {
+		t.Errorf("Expected the session terms to be left out of the cache key, got %s", cache)
+	}
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Goodbye"), nil); cache != "MISS" || answer != "Answer 2" {
+		t.Errorf("Expected another conversation to miss, got %s %q", cache, answer)
+	}
+	if *sent != 2 {
+		t.Errorf("Expected 2 requests upstream, got %d", *sent)
+	}
+
+	// no-cache refreshes the entry, no-store bypasses the cache
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), map[string]string{"Cache-Control": "no-cache"}); cache != "MISS" || answer != "Answer 3" {
+		t.Errorf("Expected no-cache to skip the lookup, got %s %q", cache, answer)
+	}
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "HIT" || answer != "Answer 3" {
+		t.Errorf("Expected the refreshed answer, got %s %q", cache, answer)
+	}
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), map[string]string{"Cache-Control": "no-store"}); cache != "" || answer != "Answer 4" {
+		t.Errorf("Expected no-store to bypass the cache, got %q %q", cache, answer)
+	}
+
+	samples := scrapeMetrics(t, proxy.URL)
+	if hits := samples[`nfa_proxy_cache_requests_total{model="`+defaultModelHandle+`",result="hit"}`]; hits < 3 {
+		t.Errorf("Expected at least 3 cache hits counted, got %v", hits)
+	}
+}
+
+func TestCacheSkipsNondeterministicRequests(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"CACHE_ENABLED": "true"})
+	sent := countedAnswers(mock)
+
+	temperature := 0.7
+	req := deterministicRequest("Hello")
+	req.Temperature = &temperature
+	for i := 0; i < 2; i++ {
+		if cache, _ := cachedAnswer(t, proxy.chatURL(), req, nil); cache != "" {
+			t.Errorf("Expected no X-Cache header for a sampled request, got %s", cache)
+		}
+	}
+	if *sent != 2 {
+		t.Errorf("Expected every sampled request to be sent upstream, got %d", *sent)
+	}
+}
+
+func TestCacheKeyIgnoresMemberOrder(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"CACHE_ENABLED": "true"})
+	countedAnswers(mock)
+
+	bodies := []string{
+		`{"model":"` + defaultModelHandle + `","temperature":0,"messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_object","schema":{"a":1}}}`,
+		`{"response_format": {"schema": {"a": 1}, "type": "json_object"}, "messages": [{"content": "Hi", "role": "user"}], "temperature": 0, "model": "` + defaultModelHandle + `"}`,
+	}
+	for i, body := range bodies {
+		resp, err := http.Post(proxy.chatURL(), "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if want := []string{"MISS", "HIT"}[i]; resp.Header.Get("X-Cache") != want {
+			t.Errorf("Expected request %d to be a %s, got %q", i+1, want, resp.Header.Get("X-Cache"))
+		}
+	}
+}
+
+func TestCacheReplaysStreams(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"CACHE_ENABLED": "true"})
+	sent := countedAnswers(mock)
+
+	// Cached from a streamed request, replayed as JSON
+	streamed := deterministicRequest("Hello")
+	streamed.Stream = true
+	resp := postChat(t, proxy.chatURL(), streamed, nil)
+	io.Copy(io.Discard, resp.Body)
+	if cache, answer := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "HIT" || answer != "Answer 1" {
+		t.Errorf("Expected the streamed answer to be cached, got %s %q", cache, answer)
+	}
+
+	// and as a synthetic stream
+	streamed.StreamOptions = json.RawMessage(`{"include_usage":true}`)
+	resp = postChat(t, proxy.chatURL(), streamed, nil)
+	if resp.Header.Get("X-Cache") != "HIT" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Expected a cached event stream, got %q %q", resp.Header.Get("X-Cache"), resp.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	var content strings.Builder
+	var finished, usage bool
+	for _, line := range strings.Split(string(body), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk sessions.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to decode chunk %q: %v", data, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || chunk.ID != "chatcmpl-cached" {
+			t.Errorf("Expected chunks of the cached completion, got %+v", chunk)
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+			finished = finished || choice.FinishReason != nil
+		}
+		usage = usage || (chunk.Usage != nil && chunk.Usage.TotalTokens == 5)
+	}
+	if content.String() != "Answer 1" || !finished || !usage {
+		t.Errorf("Expected the replayed content, finish reason and usage, got %q %v %v", content.String(), finished, usage)
+	}
+	if !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Errorf("Expected the replayed stream to end with [DONE], got %q", body)
+	}
+	if *sent != 1 {
+		t.Errorf("Expected one request upstream, got %d", *sent)
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{
+		"CACHE_ENABLED":     "true",
+		"CACHE_MAX_ENTRIES": "1",
+		"CACHE_TTL":         "200ms",
+	})
+	countedAnswers(mock)
+
+	cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil)
+	cachedAnswer(t, proxy.chatURL(), deterministicRequest("Goodbye"), nil)
+	if cache, _ := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "MISS" {
+		t.Errorf("Expected the least recently used response to be evicted, got %s", cache)
+	}
+	if cache, _ := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "HIT" {
+		t.Errorf("Expected a hit, got %s", cache)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if cache, _ := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil); cache != "MISS" {
+		t.Errorf("Expected the response to expire, got %s", cache)
+	}
+}
+
+func TestCachePersistsResponses(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer.invalid")
+	t.Setenv("SESSION_READY_POLL_INTERVAL", "10ms")
+	t.Setenv("CACHE_ENABLED", "true")
+	t.Setenv("CACHE_FILE", filepath.Join(t.TempDir(), "cache.db"))
+	t.Setenv("AUTH_DISABLED", "true")
+
+	answer := func() (string, string) {
+		cfg, err := sessions.ReadConfig("")
+		if err != nil {
+			t.Fatalf("Failed to read config: %v", err)
+		}
+		mock := mocks.NewMockSessionManager()
+		countedAnswers(mock)
+		proxy, err := sessions.NewServer(cfg, sessions.WithSessionManager(mock))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		defer proxy.Close()
+		server := httptest.NewServer(proxy)
+		defer server.Close()
+		return cachedAnswer(t, server.URL+"/v1/chat/completions", deterministicRequest("Hello"), nil)
+	}
+
+	answer()
+	if cache, answer := answer(); cache != "HIT" || answer != "Answer 1" {
+		t.Errorf("Expected the response cached by the previous server, got %s %q", cache, answer)
+	}
+}
+
+func TestCacheConfigValidation(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	t.Setenv("CACHE_TTL", "0s")
+	t.Setenv("CACHE_MAX_BYTES", "0")
+
+	_, err := sessions.ReadConfig("")
+	if err == nil {
+		t.Fatal("Expected an invalid cache configuration to be rejected")
+	}
+	for _, problem := range []string{"cache.ttl", "cache.max_bytes"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to be reported, got %v", problem, err)
+		}
+	}
+}
+
+func TestCachePerTenant(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-team-a","tenant":"team-a"},
+		{"key":"sk-team-a-2","tenant":"team-a"},
+		{"key":"sk-team-b","tenant":"team-b"}
+	]}`)
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared=%t", shared), func(t *testing.T) {
+			mock, proxy := setupMockProxy(t, map[string]string{
+				"API_KEYS_FILE": keysFile,
+				"CACHE_ENABLED": "true",
+				"CACHE_SHARED":  fmt.Sprint(shared),
+			})
+			countedAnswers(mock)
+			cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), map[string]string{"Authorization": "Bearer sk-team-a"})
+
+			if cache, _ := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), map[string]string{"Authorization": "Bearer sk-team-a-2"}); cache != "HIT" {
+				t.Errorf("Expected another key of the tenant to hit the cache, got %s", cache)
+			}
+			want := "MISS"
+			if shared {
+				want = "HIT"
+			}
+			if cache, _ := cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), map[string]string{"Authorization": "Bearer sk-team-b"}); cache != want {
+				t.Errorf("Expected %s for another tenant, got %s", want, cache)
+			}
+		})
+	}
+}
+
+func TestCacheHitsRefundTokens(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{
+		"CACHE_ENABLED":        "true",
+		"RATE_LIMIT_MODEL_TPM": "100",
+	})
+	countedAnswers(mock)
+
+	// "Hello" is estimated at 2 tokens, then settled at the 5 used
+	cachedAnswer(t, proxy.chatURL(), deterministicRequest("Hello"), nil)
+	for i := 0; i < 3; i++ {
+		resp := postChat(t, proxy.chatURL(), deterministicRequest("Hello"), nil)
+		if got := resp.Header.Get("X-Cache"); got != "HIT" {
+			t.Fatalf("Expected a cache hit, got %q", got)
+		}
+		// Each hit reserves 2 of the 95 tokens left and gets them back
+		if got := resp.Header.Get("x-ratelimit-remaining-tokens"); got != "93" {
+			t.Errorf("Expected cache hits to leave the tokens reserved before them, got %s remaining", got)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+func TestClientDisconnectCancelsStream(t *testing.T) {
+	upstreamCancelled := make(chan struct{})
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"Hi"}}]}` + "\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(upstreamCancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	series := `nfa_proxy_requests_cancelled_total{model="` + defaultModelHandle + `",stage="stream"}`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, _ := json.Marshal(helloRequest())
+	req, _ := http.NewRequestWithContext(ctx, "POST", proxy.chatURL(), bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Hang up once the first chunk arrives
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatalf("Failed to read the first chunk: %v", err)
+	}
+	cancel()
+
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the upstream stream to be cancelled when the client hung up")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for scrapeMetrics(t, proxy.URL)[series] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be 1", series)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientDisconnectCancelsSessionOpen(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	opening := make(chan struct{})
+	openCancelled := make(chan struct{})
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		close(opening)
+		select {
+		case <-ctx.Done():
+			close(openCancelled)
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return &sessions.SessionResponse{SessionToken: "late-session", ExpiresAt: time.Now().Add(time.Hour)}, nil
+		}
+	}
+	var sent int32
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		atomic.AddInt32(&sent, 1)
+		return &sessions.ChatResponse{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, _ := json.Marshal(helloRequest())
+	req, _ := http.NewRequestWithContext(ctx, "POST", proxy.chatURL(), bytes.NewReader(body))
+	go http.DefaultClient.Do(req)
+
+	<-opening
+	cancel()
+
+	select {
+	case <-openCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the session open to be cancelled when the client hung up")
+	}
+	if atomic.LoadInt32(&sent) != 0 {
+		t.Errorf("Expected no chat message for a cancelled request")
+	}
+}
+
+func TestClientDisconnectStopsWaitingForModels(t *testing.T) {
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	var fetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blockchain/models", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"models":[{"Id":"0xmodel","Name":"` + defaultModelHandle + `","Fee":"100","Stake":"200","Owner":"0xowner","CreatedAt":1700000000,"IsDeleted":false}]}`))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan struct{})
+	go func() {
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/models", nil).WithContext(ctx))
+		close(served)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&fetches) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the models request to load the model list")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the models request to stop waiting when the client hung up")
+	}
+
+	// The load carries on for the requests still waiting on it
+	releaseOnce.Do(func() { close(release) })
+	resp, err := http.Get(proxy.URL + "/v1/models")
+	if err != nil {
+		t.Fatalf("Failed to list models: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("Expected the model list to be loaded once, got %d loads", got)
+	}
+}
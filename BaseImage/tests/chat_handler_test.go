@@ -1 +1,270 @@
- 
\ No newline at end of file
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// testProxy is a Server under test, served over HTTP
+type testProxy struct {
+	*sessions.Server
+	URL string
+}
+
+// chatURL returns the URL of the proxy's chat completions route
+func (p *testProxy) chatURL() string {
+	return p.URL + "/v1/chat/completions"
+}
+
+// newProxy creates a Server from the configuration in env, plus the file
+// named by CONFIG_FILE, and closes it when the test ends. Tests that configure
+// no API keys run with authentication disabled.
+func newProxy(t *testing.T, env map[string]string, opts ...sessions.Option) *sessions.Server {
+	t.Helper()
+
+	defaults := map[string]string{
+		"SESSION_READY_POLL_INTERVAL": "10ms",
+		"AUTH_DISABLED":               "true",
+	}
+	for name, value := range defaults {
+		if _, ok := env[name]; !ok {
+			env[name] = value
+		}
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cfg, err := sessions.ReadConfig(env["CONFIG_FILE"])
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	proxy, err := sessions.NewServer(cfg, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// startProxy creates a Server like newProxy and serves it until the test ends
+func startProxy(t *testing.T, env map[string]string, opts ...sessions.Option) *testProxy {
+	t.Helper()
+
+	proxy := newProxy(t, env, opts...)
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return &testProxy{Server: proxy, URL: server.URL}
+}
+
+// setupMockProxy starts a proxy on a mock session manager
+func setupMockProxy(t *testing.T, env map[string]string) (*mocks.MockSessionManager, *testProxy) {
+	t.Helper()
+
+	env["CONSUMER_NODE_URL"] = "http://consumer.invalid"
+	mock := mocks.NewMockSessionManager()
+	return mock, startProxy(t, env, sessions.WithSessionManager(mock))
+}
+
+// postChat sends a chat completion request to the handler under test
+func postChat(t *testing.T, url string, reqBody sessions.ChatCompletionRequest, headers map[string]string) *http.Response {
+	t.Helper()
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func helloRequest() sessions.ChatCompletionRequest {
+	return sessions.ChatCompletionRequest{
+		Model:    defaultModelHandle,
+		Messages: []sessions.ChatMessage{{Role: "user", Content: "Hello"}},
+		Stream:   true,
+	}
+}
+
+func TestSessionPoolReusesSessions(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		atomic.AddInt32(&created, 1)
+		return &sessions.SessionResponse{
+			SessionToken: "pooled-session",
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}, nil
+	}
+	var usedTokens []string
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		usedTokens = append(usedTokens, sessionToken)
+		w.Write([]byte("data: {}\n\n"))
+		return &sessions.ChatResponse{}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Request %d failed with status %d: %s", i, resp.StatusCode, string(body))
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("Expected 1 session to be created, got %d", created)
+	}
+	for _, token := range usedTokens {
+		if token != "pooled-session" {
+			t.Errorf("Expected pooled session token, got %s", token)
+		}
+	}
+}
+
+func TestSessionPoolReplacesExpiringSessions(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		atomic.AddInt32(&created, 1)
+		// Sessions expiring this soon are never handed out twice
+		return &sessions.SessionResponse{
+			SessionToken: "short-session",
+			ExpiresAt:    time.Now().Add(10 * time.Second),
+		}, nil
+	}
+	var closed int32
+	mock.CloseSessionFn = func(ctx context.Context, sessionToken string) error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+
+	postChat(t, proxy.chatURL(), helloRequest(), nil)
+	postChat(t, proxy.chatURL(), helloRequest(), nil)
+
+	if created != 2 {
+		t.Errorf("Expected 2 sessions to be created, got %d", created)
+	}
+
+	proxy.Close()
+	if atomic.LoadInt32(&closed) == 0 {
+		t.Errorf("Expected sessions to be closed on shutdown")
+	}
+}
+
+func TestSessionPoolByCaller(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-agent-a","tenant":"team-a"},
+		{"key":"sk-agent-b","tenant":"team-a"}
+	]}`)
+	mock, proxy := setupMockProxy(t, map[string]string{
+		"API_KEYS_FILE":          keysFile,
+		"SESSION_POOL_BY_CALLER": "true",
+	})
+
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		n := atomic.AddInt32(&created, 1)
+		return &sessions.SessionResponse{
+			SessionToken: fmt.Sprintf("caller-session-%d", n),
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}, nil
+	}
+
+	// Sessions follow the API key; the caller header is not trusted
+	agentA := map[string]string{"Authorization": "Bearer sk-agent-a", "X-Morpheus-Caller": "agent-a"}
+	agentB := map[string]string{"Authorization": "Bearer sk-agent-b", "X-Morpheus-Caller": "agent-b"}
+	postChat(t, proxy.chatURL(), helloRequest(), agentA)
+	postChat(t, proxy.chatURL(), helloRequest(), agentB)
+	agentA["X-Morpheus-Caller"] = "someone-else"
+	postChat(t, proxy.chatURL(), helloRequest(), agentA)
+
+	if created != 2 {
+		t.Errorf("Expected 2 sessions to be created, got %d", created)
+	}
+}
+
+func TestSessionReadinessProbe(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	var probes int32
+	mock.GetSessionFn = func(ctx context.Context, sessionToken string) (*sessions.SessionInfo, error) {
+		// The provider is only known from the third probe on
+		if atomic.AddInt32(&probes, 1) < 3 {
+			return &sessions.SessionInfo{ID: sessionToken}, nil
+		}
+		return &sessions.SessionInfo{ID: sessionToken, Provider: "0x1111111111111111111111111111111111111111"}, nil
+	}
+
+	start := time.Now()
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, string(body))
+	}
+	if probes != 3 {
+		t.Errorf("Expected 3 readiness probes, got %d", probes)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the request to complete once the session was ready, took %s", elapsed)
+	}
+}
+
+func TestSessionNotReady(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"SESSION_READY_TIMEOUT": "100ms"})
+
+	mock.GetSessionFn = func(ctx context.Context, sessionToken string) (*sessions.SessionInfo, error) {
+		return &sessions.SessionInfo{ID: sessionToken, ClosedAt: "1700000000"}, nil
+	}
+	closed := make(chan string, 1)
+	mock.CloseSessionFn = func(ctx context.Context, sessionToken string) error {
+		closed <- sessionToken
+		return nil
+	}
+	var sent int32
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		atomic.AddInt32(&sent, 1)
+		return &sessions.ChatResponse{}, nil
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", resp.StatusCode)
+	}
+	if sent != 0 {
+		t.Errorf("Expected no chat message on a session that is not ready")
+	}
+
+	select {
+	case token := <-closed:
+		if token != "test-session-token" {
+			t.Errorf("Expected test-session-token to be closed, got %s", token)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the unready session to be closed")
+	}
+}
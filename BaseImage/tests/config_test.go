@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, path string, config string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "config.yaml")
+	}
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeConfig(t, "", `
+upstream:
+  consumer_node_url: http://consumer:8082
+server:
+  port: "9090"
+auth:
+  keys:
+    - key: sk-research
+      tenant: research
+      daily_budget: "1000000000000000000"
+      stake: "1000"
+      session_duration: 2h
+models:
+  aliases:
+    fast: LMR-Hermes-2-Theta-Llama-3-8B
+sessions:
+  duration: 30m
+  selection_policy: cheapest
+timeouts:
+  session_ready: 10s
+retry:
+  attempts: 5
+  backoff: 250ms
+`)
+	t.Setenv("SESSION_DURATION", "45m")
+
+	cfg, err := sessions.ReadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if cfg.ConsumerNodeURL != "http://consumer:8082" || cfg.InternalAPIPort != "9090" {
+		t.Errorf("Unexpected upstream settings: %s, port %s", cfg.ConsumerNodeURL, cfg.InternalAPIPort)
+	}
+	if cfg.Session.Duration != 45*time.Minute {
+		t.Errorf("Expected SESSION_DURATION to override the file, got %s", cfg.Session.Duration)
+	}
+	if cfg.SessionReadyTimeout != 10*time.Second || cfg.RetryAttempts != 5 || cfg.RetryBackoff != 250*time.Millisecond {
+		t.Errorf("Unexpected timeouts or retry policy: %+v", cfg)
+	}
+	if cfg.ShutdownTimeout != 25*time.Second || cfg.BidFailoverAttempts != 3 {
+		t.Errorf("Expected unset settings to keep their defaults, got %+v", cfg)
+	}
+	if len(cfg.APIKeys) != 1 || cfg.APIKeys[0].DailyBudget != "1000000000000000000" || cfg.APIKeys[0].SessionOverrides.Duration != "2h" {
+		t.Errorf("Unexpected API keys: %+v", cfg.APIKeys)
+	}
+	if cfg.SelectionPolicy != "cheapest" || cfg.ModelAliases["fast"] != "LMR-Hermes-2-Theta-Llama-3-8B" {
+		t.Errorf("Unexpected session settings: %+v", cfg)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	path := writeConfig(t, "", "upstream:\n  consumer_node_url: http://consumer:8082\n  retries: 3\n")
+	if _, err := sessions.ReadConfig(path); err == nil || !strings.Contains(err.Error(), "retries") {
+		t.Errorf("Expected unknown settings to be rejected, got %v", err)
+	}
+
+	path = writeConfig(t, "", `
+upstream:
+  consumer_node_url: consumer:8082
+server:
+  port: http
+sessions:
+  fee: lots
+auth:
+  keys:
+    - key: sk-no-tenant
+`)
+	_, err := sessions.ReadConfig(path)
+	if err == nil {
+		t.Fatal("Expected an invalid configuration to be rejected")
+	}
+	for _, problem := range []string{"consumer_node_url", "server.port", "sessions.fee", "auth.keys[0]"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected the error to report %s, got %v", problem, err)
+		}
+	}
+
+	path = writeConfig(t, "", "upstream:\n  consumer_node_url: http://consumer:8082\nsessions:\n  selection_policy: fastest\n")
+	if err := sessions.CheckConfig(path); err == nil || !strings.Contains(err.Error(), "selection_policy") {
+		t.Errorf("Expected CheckConfig to reject an unknown selection policy, got %v", err)
+	}
+
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-a"}]}`)
+	t.Setenv("API_KEYS_FILE", keysFile)
+	if err := sessions.CheckConfig(writeConfig(t, "", "upstream:\n  consumer_node_url: http://consumer:8082\n")); err == nil {
+		t.Error("Expected CheckConfig to validate the API keys file")
+	}
+}
+
+func TestModelAliases(t *testing.T) {
+	path := writeConfig(t, "", "models:\n  aliases:\n    fast: LMR-Hermes-2-Theta-Llama-3-8B\n")
+	mock, proxy := setupMockProxy(t, map[string]string{"CONFIG_FILE": path})
+	var looked string
+	mock.GetModelByHandleFn = func(ctx context.Context, modelHandle string) (*sessions.ModelInfo, error) {
+		looked = modelHandle
+		return &sessions.ModelInfo{ID: "test-model-id", Name: modelHandle}, nil
+	}
+
+	req := helloRequest()
+	req.Model = "fast"
+	if resp := postChat(t, proxy.chatURL(), req, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if looked != "LMR-Hermes-2-Theta-Llama-3-8B" {
+		t.Errorf("Expected the alias to resolve to its model handle, got %q", looked)
+	}
+}
+
+// reloadProxy re-reads the configuration from path and the environment and
+// applies it to proxy
+func reloadProxy(proxy *testProxy, path string) error {
+	cfg, err := sessions.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	return proxy.Reload(cfg)
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := writeConfig(t, "", "auth:\n  keys:\n    - key: sk-old\n      tenant: team-a\n")
+	_, proxy := setupMockProxy(t, map[string]string{"CONFIG_FILE": path})
+
+	old := map[string]string{"Authorization": "Bearer sk-old"}
+	if resp := postChat(t, proxy.chatURL(), helloRequest(), old); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the configured key to be accepted, got %d", resp.StatusCode)
+	}
+
+	writeConfig(t, path, "auth:\n  keys:\n    - key: sk-new\n      tenant: team-a\n")
+	if err := reloadProxy(proxy, path); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if resp := postChat(t, proxy.chatURL(), helloRequest(), old); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the removed key to be rejected after reload, got %d", resp.StatusCode)
+	}
+	fresh := map[string]string{"Authorization": "Bearer sk-new"}
+	if resp := postChat(t, proxy.chatURL(), helloRequest(), fresh); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the added key to be accepted after reload, got %d", resp.StatusCode)
+	}
+
+	// A broken file leaves the running configuration in place
+	writeConfig(t, path, "auth:\n  keys: [\n")
+	if err := reloadProxy(proxy, path); err == nil {
+		t.Error("Expected reloading a broken config file to fail")
+	}
+	if resp := postChat(t, proxy.chatURL(), helloRequest(), fresh); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the previous configuration to be kept, got %d", resp.StatusCode)
+	}
+}
+
+func TestReloadAppliesIntervals(t *testing.T) {
+	path := writeConfig(t, "", "wallet:\n  monitor_interval: 0s\n")
+	mock, proxy := setupMockProxy(t, map[string]string{"CONFIG_FILE": path})
+	checks := make(chan struct{}, 10)
+	mock.GetBalanceFn = func(ctx context.Context) (*sessions.WalletBalance, error) {
+		select {
+		case checks <- struct{}{}:
+		default:
+		}
+		return &sessions.WalletBalance{ETH: "1", MOR: "1"}, nil
+	}
+
+	writeConfig(t, path, "wallet:\n  monitor_interval: 10ms\n")
+	if err := reloadProxy(proxy, path); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-checks:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the wallet to be polled once the reload set an interval")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+func TestCookieFileCredentialsRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".cookie")
+	writeConfig(t, path, "admin:first\n")
+	provider := sessions.NewCookieFileCredentials(path)
+
+	creds, err := provider.Credentials()
+	if err != nil || creds.Username != "admin" || creds.Password != "first" {
+		t.Fatalf("Expected the cookie credentials, got %v, %v", creds, err)
+	}
+
+	writeConfig(t, path, "admin:rotated\n")
+	if creds, _ := provider.Credentials(); creds.Password != "rotated" {
+		t.Errorf("Expected the rotated cookie to be picked up, got %v", creds)
+	}
+	if s := fmt.Sprint(creds); strings.Contains(s, "first") {
+		t.Errorf("Expected the password to be redacted when printed, got %s", s)
+	}
+
+	writeConfig(t, path, "no password")
+	if _, err := provider.Refresh(); err == nil {
+		t.Error("Expected a malformed cookie file to be rejected")
+	}
+}
+
+func TestSecretsFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	writeConfig(t, path, `{"username":"proxy","password":"s3cret"}`)
+
+	creds, err := sessions.NewSecretsFileCredentials(path).Credentials()
+	if err != nil || creds.Username != "proxy" || creds.Password != "s3cret" {
+		t.Errorf("Expected the secrets file credentials, got %v, %v", creds, err)
+	}
+
+	writeConfig(t, path, `{"username":"proxy"}`)
+	if _, err := sessions.NewSecretsFileCredentials(path).Credentials(); err == nil {
+		t.Error("Expected a secrets file without a password to be rejected")
+	}
+}
+
+func TestRejectedCredentialsAreRefreshed(t *testing.T) {
+	cookie := filepath.Join(t.TempDir(), ".cookie")
+	writeConfig(t, cookie, "admin:old-secret")
+
+	var mu sync.Mutex
+	password := "old-secret"
+	var rejected int32
+	node := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		want := password
+		mu.Unlock()
+		if username, got, ok := r.BasicAuth(); !ok || username != "admin" || got != want {
+			atomic.AddInt32(&rejected, 1)
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		node.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("CONSUMER_NODE_URL", upstream.URL)
+	t.Setenv("COOKIE_FILE_PATH", cookie)
+	t.Setenv("CONSUMER_CREDENTIALS_SOURCE", "cookie_file")
+	t.Setenv("SESSION_READY_POLL_INTERVAL", "10ms")
+	t.Setenv("AUTH_DISABLED", "true")
+	t.Setenv("LOG_LEVEL", "debug")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	var logs logBuffer
+	proxy, err := sessions.NewServer(cfg, sessions.WithLogger(sessions.NewLogger(&logs, cfg)))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer proxy.Close()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/models")
+	if err != nil {
+		t.Fatalf("Failed to list models: %v", err)
+	}
+	resp.Body.Close()
+
+	// Rotate the cookie without changing its size or modification time, so
+	// only the consumer node rejecting the cached credentials reveals it
+	info, _ := os.Stat(cookie)
+	writeConfig(t, cookie, "admin:new-secret")
+	os.Chtimes(cookie, time.Now(), info.ModTime())
+	mu.Lock()
+	password = "new-secret"
+	mu.Unlock()
+
+	if resp := postChat(t, server.URL+"/v1/chat/completions", helloRequest(), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the request to succeed with refreshed credentials, got %d", resp.StatusCode)
+	}
+	if rejected != 1 {
+		t.Errorf("Expected a single rejected request before the retry, got %d", rejected)
+	}
+
+	for _, secret := range []string{"old-secret", "new-secret", base64.StdEncoding.EncodeToString([]byte("admin:new-secret"))} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("Expected credentials to stay out of the logs, found %q", secret)
+		}
+	}
+}
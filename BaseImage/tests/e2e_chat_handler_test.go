@@ -13,7 +13,6 @@ import (
 
 	"bufio"
 	"encoding/base64"
-	"net/http/httptest"
 
 	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
 )
@@ -153,36 +152,20 @@ func clearExistingSessions(t *testing.T) (string, error) {
 
 func TestHandleChatCompletions(t *testing.T) {
 	// Set required environment variables for testing
-	os.Setenv("CONSUMER_NODE_URL", "https://consumer-node-2cmojdnxfq-uw.a.run.app")
-	os.Setenv("MARKETPLACE_URL", "https://consumer-node-2cmojdnxfq-uw.a.run.app")
-	os.Setenv("CONSUMER_USERNAME", "proxy")
-	os.Setenv("CONSUMER_PASSWORD", "yosz9BZCuu7Rli7mYe4G1JbIO0Yprvwl")
-	os.Setenv("SESSION_DURATION", "1h")
-	os.Setenv("INTERNAL_API_PORT", "8082")
+	t.Setenv("CONSUMER_NODE_URL", "https://consumer-node-2cmojdnxfq-uw.a.run.app")
+	t.Setenv("MARKETPLACE_URL", "https://consumer-node-2cmojdnxfq-uw.a.run.app")
+	t.Setenv("CONSUMER_USERNAME", "proxy")
+	t.Setenv("CONSUMER_PASSWORD", "yosz9BZCuu7Rli7mYe4G1JbIO0Yprvwl")
+	t.Setenv("SESSION_DURATION", "1h")
+	t.Setenv("INTERNAL_API_PORT", "8082")
 	
-	// Clean up environment variables after test
-	defer func() {
-		os.Unsetenv("CONSUMER_NODE_URL")
-		os.Unsetenv("MARKETPLACE_URL")
-		os.Unsetenv("CONSUMER_USERNAME")
-		os.Unsetenv("CONSUMER_PASSWORD")
-		os.Unsetenv("SESSION_DURATION")
-		os.Unsetenv("INTERNAL_API_PORT")
-	}()
-
 	// Clear any existing sessions
 	if _, err := clearExistingSessions(t); err != nil {
 		t.Fatalf("Failed to clear sessions: %v", err)
 	}
 
-	// Load config
-	if err := sessions.LoadConfig(); err != nil {
-		t.Fatalf("Failed to load config: %v", err)
-	}
-
 	// Start a test server
-	server := httptest.NewServer(http.HandlerFunc(sessions.HandleChatCompletions))
-	defer server.Close()
+	proxy := startProxy(t, map[string]string{})
 
 	// Create request using the proper struct
 	reqBody := sessions.ChatCompletionRequest{
@@ -205,7 +188,7 @@ func TestHandleChatCompletions(t *testing.T) {
 	t.Logf("Making request with body: %s", string(jsonData))
 
 	// Create request with proper headers for SSE
-	req, err := http.NewRequest("POST", server.URL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", proxy.chatURL(), bytes.NewBuffer(jsonData))
 	if err != nil {
 		t.Fatalf("Failed to create request: %v", err)
 	}
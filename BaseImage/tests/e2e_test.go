@@ -88,8 +88,7 @@ func TestProxyServerOpenAICompatibility(t *testing.T) {
 	}
 
 	// Set up environment variables for the test if needed
-	os.Setenv("MARKETPLACE_URL", marketplaceURL)
-	defer os.Unsetenv("MARKETPLACE_URL")
+	t.Setenv("MARKETPLACE_URL", marketplaceURL)
 
 	// Define test cases
 	testCases := []struct {
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+func TestTypedErrorResponses(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	mock.GetModelByHandleFn = func(ctx context.Context, modelHandle string) (*sessions.ModelInfo, error) {
+		return nil, fmt.Errorf("%w: %s", sessions.ErrModelNotFound, modelHandle)
+	}
+	expectOpenAIError(t, postChat(t, proxy.chatURL(), helloRequest(), nil), http.StatusNotFound, "model_not_found")
+
+	mock.GetModelByHandleFn = mocks.NewMockSessionManager().GetModelByHandleFn
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return nil, fmt.Errorf("failed to create session: %w", sessions.ErrInsufficientAllowance)
+	}
+	expectOpenAIError(t, postChat(t, proxy.chatURL(), helloRequest(), nil), http.StatusPaymentRequired, "insufficient_allowance")
+
+	mock.CreateSessionFn = mocks.NewMockSessionManager().CreateSessionFn
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		return nil, fmt.Errorf("failed to connect to consumer node: %w", sessions.ErrUpstreamTimeout)
+	}
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected a stream failing before its first chunk to answer with JSON, got %s", contentType)
+	}
+	expectOpenAIError(t, resp, http.StatusGatewayTimeout, "upstream_timeout")
+}
+
+func TestMidStreamErrorEvent(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n"))
+		w.Flush()
+		return nil, fmt.Errorf("failed to read stream: %w", sessions.ErrUpstreamTimeout)
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected the stream to have started, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+	if len(events) != 2 {
+		t.Fatalf("Expected the chunk followed by an error event, got %q", body)
+	}
+	var errEvent sessions.OpenAIError
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(events[1], "data: ")), &errEvent); err != nil {
+		t.Fatalf("Expected an OpenAI error event, got %q", events[1])
+	}
+	if errEvent.Error.Code != "upstream_timeout" || errEvent.Error.Type != "api_error" || errEvent.Error.Message == "" {
+		t.Errorf("Expected an upstream_timeout error event, got %+v", errEvent.Error)
+	}
+}
+
+func TestConsumerNodeErrorsAreClassified(t *testing.T) {
+	mux := fakeConsumerNodeMux(nil)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/session") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"failed to open session: ERC20: insufficient allowance"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer node.Close()
+
+	t.Setenv("CONSUMER_NODE_URL", node.URL)
+	t.Setenv("CONSUMER_USERNAME", "admin")
+	t.Setenv("CONSUMER_PASSWORD", "mock-test-password")
+	t.Setenv("COOKIE_FILE_PATH", "/nonexistent/.cookie")
+	t.Setenv("RETRY_ATTEMPTS", "1")
+	proxy, server := newTracedProxy(t)
+	defer proxy.Close()
+
+	resp := postChat(t, server.URL+"/v1/chat/completions", helloRequest(), nil)
+	expectOpenAIError(t, resp, http.StatusPaymentRequired, "insufficient_allowance")
+
+	chatReq := helloRequest()
+	chatReq.Model = "no-such-model"
+	resp = postChat(t, server.URL+"/v1/chat/completions", chatReq, nil)
+	expectOpenAIError(t, resp, http.StatusNotFound, "model_not_found")
+}
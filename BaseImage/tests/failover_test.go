@@ -0,0 +1,222 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+func TestBidFailover(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return nil, fmt.Errorf("failed to create session: %w", sessions.ErrNoProvider)
+	}
+	mock.ListBidsFn = func(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+		return []sessions.BidInfo{{ID: "bid-1"}, {ID: "bid-2"}, {ID: "bid-3"}}, nil
+	}
+	var tried []string
+	mock.CreateSessionForBidFn = func(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		tried = append(tried, bidId)
+		if bidId == "bid-1" {
+			return nil, errors.New("failed to create session: provider unreachable")
+		}
+		return &sessions.SessionResponse{SessionToken: "session-" + bidId, ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+	var usedToken string
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		usedToken = sessionToken
+		return &sessions.ChatResponse{}, nil
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected failover to an alternative bid, got %d: %s", resp.StatusCode, string(body))
+	}
+	if strings.Join(tried, ",") != "bid-1,bid-2" {
+		t.Errorf("Expected bids to be tried in order until one opened, got %v", tried)
+	}
+	if usedToken != "session-bid-2" {
+		t.Errorf("Expected the chat to use the failover session, got %s", usedToken)
+	}
+}
+
+func TestBidFailoverExhausted(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"BID_FAILOVER_ATTEMPTS": "2"})
+
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return nil, fmt.Errorf("failed to create session: %w", sessions.ErrNoProvider)
+	}
+	mock.ListBidsFn = func(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+		return []sessions.BidInfo{{ID: "bid-1"}, {ID: "bid-2"}, {ID: "bid-3"}}, nil
+	}
+	var tried int32
+	mock.CreateSessionForBidFn = func(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		atomic.AddInt32(&tried, 1)
+		return nil, fmt.Errorf("failed to create session: %w", sessions.ErrNoProvider)
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	expectOpenAIError(t, resp, http.StatusServiceUnavailable, "no_provider")
+	if tried != 2 {
+		t.Errorf("Expected BID_FAILOVER_ATTEMPTS bids to be tried, got %d", tried)
+	}
+}
+
+func TestFailoverNeedsTypedNoProviderError(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return nil, errors.New("failed to create session: no provider accepting session")
+	}
+	mock.ListBidsFn = func(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+		t.Error("Expected no failover for an error that is not ErrNoProvider")
+		return nil, nil
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	expectOpenAIError(t, resp, http.StatusBadGateway, "upstream_error")
+}
+
+func TestStreamResumedOnNewSession(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"STREAM_RESUME_ATTEMPTS": "1"})
+
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return &sessions.SessionResponse{
+			SessionToken: fmt.Sprintf("session-%d", atomic.AddInt32(&created, 1)),
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}, nil
+	}
+	closed := make(chan string, 1)
+	mock.CloseSessionFn = func(ctx context.Context, sessionToken string) error {
+		closed <- sessionToken
+		return nil
+	}
+	var resumed *sessions.ChatCompletionRequest
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		if sessionToken == "session-1" {
+			w.Write([]byte(`data: {"id":"chatcmpl-first","created":1700000000,"choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}` + "\n\n"))
+			w.Flush()
+			partial := &sessions.ChatResponse{Choices: []sessions.ChatChoice{{
+				Message: sessions.ChatMessage{Role: "assistant", Content: "Hel"},
+			}}}
+			return partial, fmt.Errorf("%w: unexpected EOF", sessions.ErrStreamInterrupted)
+		}
+		resumed = chatReq
+		w.Write([]byte(`data: {"id":"chatcmpl-second","created":1800000000,"choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}` + "\n\n"))
+		w.Write([]byte(`data: {"id":"chatcmpl-second","created":1800000000,"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}` + "\n\ndata: [DONE]\n\n"))
+		w.Flush()
+		return &sessions.ChatResponse{}, nil
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Fatalf("Expected the stream to complete, got %d: %s", resp.StatusCode, string(body))
+	}
+	if !strings.Contains(string(body), `"Hel"`) || !strings.Contains(string(body), `"lo"`) {
+		t.Errorf("Expected both parts of the completion in the stream, got %s", string(body))
+	}
+	// The resumed chunks continue the first completion
+	if strings.Contains(string(body), "chatcmpl-second") || strings.Contains(string(body), "1800000000") {
+		t.Errorf("Expected the resumed chunks to keep the original id and created time, got %s", string(body))
+	}
+	if n := strings.Count(string(body), `"role"`); n != 1 {
+		t.Errorf("Expected the assistant role once, got it %d times: %s", n, string(body))
+	}
+	if n := strings.Count(string(body), "chatcmpl-first"); n != 2 {
+		t.Errorf("Expected 2 chunks of the original completion, got %d: %s", n, string(body))
+	}
+
+	if resumed == nil {
+		t.Fatalf("Expected the completion to be resumed on a new session")
+	}
+	last := resumed.Messages[len(resumed.Messages)-1]
+	if len(resumed.Messages) != 2 || last.Role != "assistant" || last.Content != "Hel" {
+		t.Errorf("Expected the conversation plus the partial output, got %+v", resumed.Messages)
+	}
+
+	select {
+	case token := <-closed:
+		if token != "session-1" {
+			t.Errorf("Expected the broken session to be closed, got %s", token)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the broken session to be closed")
+	}
+}
+
+func TestStreamNotResumedByDefault(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+
+	var sent int32
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		atomic.AddInt32(&sent, 1)
+		return &sessions.ChatResponse{}, fmt.Errorf("%w: unexpected EOF", sessions.ErrStreamInterrupted)
+	}
+
+	postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if sent != 1 {
+		t.Errorf("Expected no resume without STREAM_RESUME_ATTEMPTS, got %d sends", sent)
+	}
+}
+
+func TestOpenSessionOnBid(t *testing.T) {
+	var payload map[string]interface{}
+	var modelPayload map[string]interface{}
+	mux := fakeConsumerNodeMux(nil)
+	mux.HandleFunc("/blockchain/models/0xmodel/session", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&modelPayload)
+		w.Write([]byte(`{"sessionID":"0xsession"}`))
+	})
+	mux.HandleFunc("/blockchain/models/0xmodel/bids", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"bids":[` +
+			`{"Id":"0xbid1","Provider":"0xprovider1","ModelAgentId":"0xmodel","PricePerSecond":"100","Nonce":"0","CreatedAt":"1700000000","DeletedAt":"1700000100"},` +
+			`{"Id":"0xbid2","Provider":"0xprovider2","ModelAgentId":"0xmodel","PricePerSecond":200,"Nonce":1,"CreatedAt":1700000000,"DeletedAt":"0"}]}`))
+	})
+	mux.HandleFunc("/blockchain/bids/0xbid2/session", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.Write([]byte(`{"sessionID":"0xbidsession"}`))
+	})
+	t.Setenv("SESSION_FAILOVER", "true")
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	ctx := context.Background()
+	params := sessions.SessionParams{Duration: time.Hour, MaxFee: "300000000000", Stake: "1000"}
+	if _, err := proxy.SessionManager().CreateSession(ctx, "0xmodel", params); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if modelPayload["failover"] != true {
+		t.Errorf("Expected SESSION_FAILOVER to be sent to the consumer node, got %v", modelPayload["failover"])
+	}
+
+	bids, err := proxy.SessionManager().ListBids(ctx, "0xmodel")
+	if err != nil {
+		t.Fatalf("Failed to list bids: %v", err)
+	}
+	if len(bids) != 1 || bids[0].ID != "0xbid2" || bids[0].PricePerSecond != "200" {
+		t.Fatalf("Expected deleted bids to be skipped, got %+v", bids)
+	}
+
+	session, err := proxy.SessionManager().CreateSessionForBid(ctx, bids[0].ID, params)
+	if err != nil {
+		t.Fatalf("Failed to open session on bid: %v", err)
+	}
+	if session.SessionToken != "0xbidsession" {
+		t.Errorf("Expected session 0xbidsession, got %s", session.SessionToken)
+	}
+	if payload["stake"] != "1000" || payload["sessionDuration"] == nil {
+		t.Errorf("Unexpected bid session payload: %v", payload)
+	}
+}
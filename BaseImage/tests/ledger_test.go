@@ -0,0 +1,223 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// shortSessions starts a proxy on which every request opens a new session
+func shortSessions(t *testing.T, env map[string]string) *testProxy {
+	t.Helper()
+
+	mock, proxy := setupMockProxy(t, env)
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return &sessions.SessionResponse{
+			SessionToken: fmt.Sprintf("session-%d", atomic.AddInt32(&created, 1)),
+			ExpiresAt:    time.Now().Add(10 * time.Second),
+		}, nil
+	}
+	return proxy
+}
+
+func stakedRequest(stake string) sessions.ChatCompletionRequest {
+	req := helloRequest()
+	req.StakeAmount = stake
+	return req
+}
+
+func TestDailyBudgetEnforced(t *testing.T) {
+	// Each session commits its stake plus the 300000000000 wei fee
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-team-a","tenant":"team-a","daily_budget":"500000000000"},
+		{"key":"sk-team-b","tenant":"team-b"}
+	]}`)
+	proxy := shortSessions(t, map[string]string{"API_KEYS_FILE": keysFile})
+
+	teamA := map[string]string{"Authorization": "Bearer sk-team-a"}
+	resp := postChat(t, proxy.chatURL(), stakedRequest("1000"), teamA)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first session to fit the budget, got %d", resp.StatusCode)
+	}
+
+	resp = postChat(t, proxy.chatURL(), stakedRequest("1000"), teamA)
+	expectOpenAIError(t, resp, http.StatusTooManyRequests, "budget_exceeded")
+
+	// Budgets are per key
+	resp = postChat(t, proxy.chatURL(), stakedRequest("1000"), map[string]string{"Authorization": "Bearer sk-team-b"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a key without budget to be unaffected, got %d", resp.StatusCode)
+	}
+}
+
+func TestLedgerPersistsSessions(t *testing.T) {
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-team-a","tenant":"team-a"}]}`)
+	_, proxy := setupMockProxy(t, map[string]string{
+		"API_KEYS_FILE":    keysFile,
+		"LEDGER_FILE":      ledgerFile,
+		"SESSION_DURATION": "30m",
+	})
+
+	resp := postChat(t, proxy.chatURL(), stakedRequest("1000"), map[string]string{"Authorization": "Bearer sk-team-a"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	proxy.Close()
+
+	ledger, err := sessions.NewLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to replay ledger: %v", err)
+	}
+	defer ledger.Close()
+
+	records := ledger.Records(time.Time{}, time.Time{})
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 ledger record, got %d", len(records))
+	}
+	record := records[0]
+	if record.SessionID != "test-session-token" || record.Tenant != "team-a" || record.Model != defaultModelHandle {
+		t.Errorf("Unexpected ledger record: %+v", record)
+	}
+	if record.Stake != "1000" || record.Fee != "300000000000" || record.DurationSeconds != 1800 {
+		t.Errorf("Unexpected amounts in ledger record: %+v", record)
+	}
+	if record.ClosedAt == nil {
+		t.Errorf("Expected the session close to be recorded")
+	}
+}
+
+func TestSpendReport(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-team-a","tenant":"team-a"},
+		{"key":"sk-team-b","tenant":"team-b"}
+	]}`)
+	proxy := shortSessions(t, map[string]string{"API_KEYS_FILE": keysFile, "ADMIN_TOKEN": "admin-secret"})
+
+	postChat(t, proxy.chatURL(), stakedRequest("1000"), map[string]string{"Authorization": "Bearer sk-team-a"})
+	postChat(t, proxy.chatURL(), stakedRequest("2000"), map[string]string{"Authorization": "Bearer sk-team-a"})
+	postChat(t, proxy.chatURL(), stakedRequest("5000"), map[string]string{"Authorization": "Bearer sk-team-b"})
+
+	resp, err := http.Get(proxy.URL + "/admin/spend")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	expectOpenAIError(t, resp, http.StatusUnauthorized, "invalid_api_key")
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/admin/spend?tenant=team-a&period=day", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var report sessions.SpendReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode spend report: %v", err)
+	}
+	if report.Totals.Sessions != 2 || report.Totals.Stake != "3000" || report.Totals.LockedStake != "3000" || report.Totals.Total != "600000003000" {
+		t.Errorf("Unexpected totals: %+v", report.Totals)
+	}
+	if len(report.Keys) != 1 || report.Keys[0].Tenant != "team-a" {
+		t.Fatalf("Expected spend for team-a only, got %+v", report.Keys)
+	}
+	if model, ok := report.Keys[0].Models[defaultModelHandle]; !ok || model.Sessions != 2 {
+		t.Errorf("Expected spend per model, got %+v", report.Keys[0].Models)
+	}
+	if report.From == nil {
+		t.Errorf("Expected the report period to be set")
+	}
+}
+
+func TestClosedSessionsReturnStake(t *testing.T) {
+	ledger, err := sessions.NewLedger("")
+	if err != nil {
+		t.Fatalf("Failed to create ledger: %v", err)
+	}
+	defer ledger.Close()
+
+	key := &sessions.APIKey{Key: "sk-team-a", Tenant: "team-a", DailyBudget: "2000"}
+	now := time.Now()
+	ledger.RecordOpen(sessions.SpendRecord{SessionID: "session-1", Tenant: "team-a", KeyID: key.ID(), Stake: "1000", Fee: "300", OpenedAt: now})
+	if err := ledger.CheckBudget(key, big.NewInt(701), now); err == nil {
+		t.Error("Expected an open session to hold its stake and fee")
+	}
+
+	ledger.RecordClose("session-1", now)
+	if err := ledger.CheckBudget(key, big.NewInt(1700), now); err != nil {
+		t.Errorf("Expected only the fee to count once the stake is returned, got %v", err)
+	}
+	report := sessions.BuildSpendReport(ledger.Records(time.Time{}, time.Time{}), "", now)
+	if report.Totals.Stake != "1000" || report.Totals.LockedStake != "0" || report.Totals.Total != "300" {
+		t.Errorf("Unexpected totals after close: %+v", report.Totals)
+	}
+}
+
+func TestConcurrentOpensHoldBudget(t *testing.T) {
+	// Each session commits its stake plus the 300000000000 wei fee, so one fits
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-team-a","tenant":"team-a","daily_budget":"500000000000"}]}`)
+	mock, proxy := setupMockProxy(t, map[string]string{"API_KEYS_FILE": keysFile})
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		time.Sleep(50 * time.Millisecond)
+		return &sessions.SessionResponse{
+			SessionToken: fmt.Sprintf("session-%d", atomic.AddInt32(&created, 1)),
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}, nil
+	}
+
+	// Different stakes are different terms, so each request opens its own session
+	const requests = 5
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func(stake string) {
+			resp := postChat(t, proxy.chatURL(), stakedRequest(stake), map[string]string{"Authorization": "Bearer sk-team-a"})
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(fmt.Sprint(1000 + i))
+	}
+	served := 0
+	for i := 0; i < requests; i++ {
+		if <-statuses == http.StatusOK {
+			served++
+		}
+	}
+	if served != 1 || atomic.LoadInt32(&created) != 1 {
+		t.Errorf("Expected the budget to allow a single session, served %d and opened %d", served, created)
+	}
+}
+
+func TestBudgetRequiresStake(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-team-a","tenant":"team-a","spend_cap":"500000000000"}]}`)
+	_, proxy := setupMockProxy(t, map[string]string{"API_KEYS_FILE": keysFile})
+	teamA := map[string]string{"Authorization": "Bearer sk-team-a"}
+
+	// The stake the consumer node would pick could take the key past its cap
+	resp := postChat(t, proxy.chatURL(), helloRequest(), teamA)
+	expectOpenAIError(t, resp, http.StatusBadRequest, "invalid_session_params")
+
+	if resp := postChat(t, proxy.chatURL(), stakedRequest("1000"), teamA); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a request with a stake to be served, got %d", resp.StatusCode)
+	}
+
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	configFile := writeConfig(t, "", "auth:\n  keys:\n    - key: sk-b\n      tenant: team-b\n      daily_budget: \"1000\"\n")
+	if _, err := sessions.ReadConfig(configFile); err == nil || !strings.Contains(err.Error(), "needs a stake") {
+		t.Errorf("Expected a budget without a stake to be rejected, got %v", err)
+	}
+}
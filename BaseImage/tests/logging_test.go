@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// logBuffer collects log output written from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// records decodes the JSON log lines written so far
+func (b *logBuffer) records(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected JSON log lines, got %q", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	const privateKey = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+	var logs logBuffer
+	logger := sessions.NewLogger(&logs, &sessions.Config{LogLevel: "debug"})
+
+	logger.Debug("Sending chat request",
+		"headers", http.Header{"Authorization": {"Basic YWRtaW46czNjcmV0"}, "Accept": {"application/json"}},
+		"request_body", `{"messages":[{"role":"user","content":"my diagnosis"}]}`,
+		"password", "s3cret",
+		"error", errors.New("wallet key "+privateKey+" rejected"),
+	)
+	logger.Info("Retrying with Bearer sk-live-123", "session", "0x"+privateKey)
+
+	output := logs.String()
+	for _, secret := range []string{"YWRtaW46czNjcmV0", "my diagnosis", "s3cret", "sk-live-123", " " + privateKey} {
+		if strings.Contains(output, secret) {
+			t.Errorf("Expected %q to be redacted, got %s", secret, output)
+		}
+	}
+	records := logs.records(t)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 log records, got %d", len(records))
+	}
+	if records[0]["level"] != "DEBUG" || records[0]["msg"] != "Sending chat request" {
+		t.Errorf("Expected a structured debug record, got %v", records[0])
+	}
+	if records[1]["session"] != "0x"+privateKey {
+		t.Errorf("Expected 0x prefixed session IDs to be kept, got %v", records[1]["session"])
+	}
+
+	// Content is logged once it is asked for, secrets still are not
+	logs = logBuffer{}
+	logger = sessions.NewLogger(&logs, &sessions.Config{LogLevel: "info", LogContent: true})
+	logger.Debug("Dropped below the level")
+	logger.Info("Received chat response", "response_body", "the answer", "api_key", "sk-live-123")
+	output = logs.String()
+	if !strings.Contains(output, "the answer") || strings.Contains(output, "sk-live-123") {
+		t.Errorf("Expected content but no API key in the logs, got %s", output)
+	}
+	if strings.Contains(output, "Dropped below the level") {
+		t.Errorf("Expected debug records to be dropped at info level, got %s", output)
+	}
+}
+
+func TestRequestLogsCarryRequestID(t *testing.T) {
+	node := httptest.NewServer(fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"a private answer"},"finish_reason":"stop"}]}`))
+	}))
+	defer node.Close()
+
+	t.Setenv("CONSUMER_NODE_URL", node.URL)
+	t.Setenv("CONSUMER_USERNAME", "admin")
+	t.Setenv("CONSUMER_PASSWORD", "mock-test-password")
+	t.Setenv("COOKIE_FILE_PATH", "/nonexistent/.cookie")
+	t.Setenv("SESSION_READY_POLL_INTERVAL", "10ms")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("AUTH_DISABLED", "true")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	var logs logBuffer
+	proxy, err := sessions.NewServer(cfg, sessions.WithLogger(sessions.NewLogger(&logs, cfg)))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer proxy.Close()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	chatReq := helloRequest()
+	chatReq.Stream = false
+	chatReq.Messages[0].Content = "my private question"
+	resp := postChat(t, server.URL+"/v1/chat/completions", chatReq, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	requestID := resp.Header.Get("X-Request-ID")
+	if requestID == "" {
+		t.Fatal("Expected the response to carry an X-Request-ID")
+	}
+
+	messages := map[string]bool{}
+	for _, record := range logs.records(t) {
+		if record["request_id"] == requestID {
+			messages[record["msg"].(string)] = true
+		}
+		for _, attr := range []string{"headers", "payload", "request_body", "response_body"} {
+			if _, ok := record[attr]; ok {
+				t.Errorf("Expected no %s in %q without logging.content", attr, record["msg"])
+			}
+		}
+	}
+	for _, msg := range []string{"Sending chat request", "Received chat response", "Chat completion"} {
+		if !messages[msg] {
+			t.Errorf("Expected %q to be logged with request ID %s, got %v", msg, requestID, messages)
+		}
+	}
+	for _, secret := range []string{"my private question", "a private answer", "mock-test-password"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("Expected %q to stay out of the logs", secret)
+		}
+	}
+}
+
+func TestLoggingConfigValidation(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	t.Setenv("LOG_FORMAT", "xml")
+	if _, err := sessions.ReadConfig(""); err == nil || !strings.Contains(err.Error(), "logging.format") {
+		t.Errorf("Expected an unknown log format to be rejected, got %v", err)
+	}
+
+	t.Setenv("LOG_FORMAT", "text")
+	t.Setenv("LOG_LEVEL", "verbose")
+	if _, err := sessions.ReadConfig(""); err == nil || !strings.Contains(err.Error(), "logging.level") {
+		t.Errorf("Expected an unknown log level to be rejected, got %v", err)
+	}
+}
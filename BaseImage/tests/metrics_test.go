@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// scrapeMetrics returns the samples exported on /metrics by the proxy at url,
+// keyed by series as written in the exposition format
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected metrics status 200, got %d", resp.StatusCode)
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndex(line, " ")
+		if sep < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[sep+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples[line[:sep]] = value
+	}
+	return samples
+}
+
+func TestMetricsForStreamingRequest(t *testing.T) {
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"Hi"}}]}` + "\n\n"))
+		w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":" there"}}]}` + "\n\ndata: [DONE]\n\n"))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	samples := scrapeMetrics(t, proxy.URL)
+
+	model := `model="` + defaultModelHandle + `"`
+	counts := map[string]float64{
+		`nfa_proxy_requests_total{code="200",` + model + `}`:                     1,
+		`nfa_proxy_request_duration_seconds_count{` + model + `}`:                1,
+		`nfa_proxy_time_to_first_token_seconds_count{` + model + `}`:             1,
+		`nfa_proxy_streamed_tokens_total{` + model + `}`:                         2,
+		`nfa_proxy_session_create_attempts_total{` + model + `}`:                 1,
+		`nfa_proxy_upstream_responses_total{code="200",endpoint="session_open"}`: 1,
+		`nfa_proxy_upstream_responses_total{code="200",endpoint="chat"}`:         1,
+	}
+	for series, want := range counts {
+		if got := samples[series]; got != want {
+			t.Errorf("Expected %s to be %v, got %v", series, want, got)
+		}
+	}
+
+	if samples["nfa_proxy_active_sessions"] != 1 {
+		t.Errorf("Expected 1 active session, got %v", samples["nfa_proxy_active_sessions"])
+	}
+	if age, ok := samples["nfa_proxy_model_registry_refresh_age_seconds"]; !ok || age < 0 || age > 60 {
+		t.Errorf("Expected a recent model registry refresh, got %v", age)
+	}
+}
+
+func TestMetricsCountFailedRequests(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{})
+	mock.GetModelByHandleFn = func(ctx context.Context, modelHandle string) (*sessions.ModelInfo, error) {
+		return nil, fmt.Errorf("%w: %s", sessions.ErrModelNotFound, modelHandle)
+	}
+
+	series := `nfa_proxy_requests_total{code="404",model="unknown"}`
+	postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if got := scrapeMetrics(t, proxy.URL)[series]; got != 1 {
+		t.Errorf("Expected %s to be 1, got %v", series, got)
+	}
+}
+
+func TestMetricsPerServer(t *testing.T) {
+	_, first := setupMockProxy(t, map[string]string{})
+	_, second := setupMockProxy(t, map[string]string{})
+
+	postChat(t, first.chatURL(), helloRequest(), nil)
+	series := `nfa_proxy_requests_total{code="200",model="` + defaultModelHandle + `"}`
+	if got := scrapeMetrics(t, first.URL)[series]; got != 1 {
+		t.Errorf("Expected the first server to count its request, got %v", got)
+	}
+	samples := scrapeMetrics(t, second.URL)
+	if got, ok := samples[series]; ok {
+		t.Errorf("Expected the second server not to count the first one's request, got %v", got)
+	}
+	if got := samples["nfa_proxy_active_sessions"]; got != 0 {
+		t.Errorf("Expected the second server to hold no sessions, got %v", got)
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+func TestListModels(t *testing.T) {
+	proxy := startFakeConsumerNode(t, fakeConsumerNodeMux(nil), nil)
+
+	resp, err := http.Get(proxy.URL + "/v1/models")
+	if err != nil {
+		t.Fatalf("Failed to list models: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var list sessions.OpenAIModelList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode model list: %v", err)
+	}
+	if list.Object != "list" || len(list.Data) != 1 {
+		t.Fatalf("Unexpected model list: %+v", list)
+	}
+
+	model := list.Data[0]
+	if model.ID != defaultModelHandle || model.Object != "model" || model.OwnedBy != "0xowner" {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	if model.BlockchainID != "0xmodel" || model.Fee != "100" || model.Stake != "200" || model.Created != 1700000000 {
+		t.Errorf("Expected on-chain details as extension fields, got %+v", model)
+	}
+	if len(model.Tags) != 2 || model.Tags[0] != "llama" {
+		t.Errorf("Expected tags, got %v", model.Tags)
+	}
+}
+
+func TestGetModel(t *testing.T) {
+	proxy := startFakeConsumerNode(t, fakeConsumerNodeMux(nil), nil)
+
+	for _, id := range []string{defaultModelHandle, "0xmodel"} {
+		resp, err := http.Get(proxy.URL + "/v1/models/" + url.PathEscape(id))
+		if err != nil {
+			t.Fatalf("Failed to get model %s: %v", id, err)
+		}
+		var model sessions.OpenAIModel
+		json.NewDecoder(resp.Body).Decode(&model)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || model.ID != defaultModelHandle {
+			t.Errorf("Expected model %s to resolve to %s, got status %d and %+v", id, defaultModelHandle, resp.StatusCode, model)
+		}
+	}
+
+	resp, err := http.Get(proxy.URL + "/v1/models/unknown-model")
+	if err != nil {
+		t.Fatalf("Failed to get model: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var errResp sessions.OpenAIError
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	if resp.StatusCode != http.StatusNotFound || errResp.Error.Code != "model_not_found" {
+		t.Errorf("Expected 404 model_not_found, got status %d and %+v", resp.StatusCode, errResp)
+	}
+}
+
+func TestModelRegistryCachesModels(t *testing.T) {
+	var fetches int32
+	var down int32
+	node := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", node)
+	mux.HandleFunc("/blockchain/models", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, `{"error":"node restarting"}`, http.StatusBadRequest)
+			return
+		}
+		node.ServeHTTP(w, r)
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	postChat(t, proxy.chatURL(), helloRequest(), nil)
+	postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if fetches != 1 {
+		t.Errorf("Expected the model list to be fetched once, got %d", fetches)
+	}
+
+	// The registry keeps serving the last good list while the node is down
+	atomic.StoreInt32(&down, 1)
+	if err := proxy.RefreshModels(); err == nil {
+		t.Errorf("Expected refresh to fail while the node is down")
+	}
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected stale models to be served, got status %d", resp.StatusCode)
+	}
+
+	health, err := http.Get(proxy.URL + "/health")
+	if err != nil {
+		t.Fatalf("Failed to get health: %v", err)
+	}
+	defer health.Body.Close()
+	var status struct {
+		Status        string                  `json:"status"`
+		ModelRegistry sessions.RegistryStatus `json:"model_registry"`
+	}
+	if err := json.NewDecoder(health.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode health: %v", err)
+	}
+	if status.ModelRegistry.LastRefresh == nil || !status.ModelRegistry.Stale || status.ModelRegistry.Models != 1 {
+		t.Errorf("Expected a stale registry with a last refresh time, got %+v", status.ModelRegistry)
+	}
+}
+
+func TestListModelsByTag(t *testing.T) {
+	proxy := startFakeConsumerNode(t, fakeConsumerNodeMux(nil), nil)
+
+	for tag, expected := range map[string]int{"llama": 1, "vision": 0} {
+		resp, err := http.Get(proxy.URL + "/v1/models?tag=" + tag)
+		if err != nil {
+			t.Fatalf("Failed to list models: %v", err)
+		}
+		var list sessions.OpenAIModelList
+		json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+
+		if len(list.Data) != expected {
+			t.Errorf("Expected %d models tagged %s, got %d", expected, tag, len(list.Data))
+		}
+	}
+}
+
+func TestModelRefreshBackoffStopsOnClose(t *testing.T) {
+	requested := make(chan struct{}, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blockchain/models", func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	proxy := startFakeConsumerNode(t, mux, map[string]string{
+		"MODEL_REFRESH_INTERVAL": "20ms",
+		"RETRY_ATTEMPTS":         "3",
+		"RETRY_BACKOFF":          "1h",
+	})
+
+	select {
+	case <-requested:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the models to be refreshed")
+	}
+
+	// The refresh is now waiting an hour to retry
+	closed := make(chan struct{})
+	go func() {
+		proxy.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Close to cancel the retry backoff of a models refresh")
+	}
+}
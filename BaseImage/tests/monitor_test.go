@@ -0,0 +1,266 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// startAlertWebhook returns the URL of a webhook that passes the alerts it
+// receives to the returned channel
+func startAlertWebhook(t *testing.T) (string, <-chan sessions.Alert) {
+	t.Helper()
+
+	alerts := make(chan sessions.Alert, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert sessions.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("Failed to decode alert: %v", err)
+		}
+		alerts <- alert
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, alerts
+}
+
+func expectAlert(t *testing.T, alerts <-chan sessions.Alert, name, status string) sessions.Alert {
+	t.Helper()
+	select {
+	case alert := <-alerts:
+		if alert.Alert != name || alert.Status != status {
+			t.Fatalf("Expected a %s %s alert, got %+v", status, name, alert)
+		}
+		return alert
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for a %s %s alert", status, name)
+	}
+	return sessions.Alert{}
+}
+
+func expectNoAlert(t *testing.T, alerts <-chan sessions.Alert) {
+	t.Helper()
+	select {
+	case alert := <-alerts:
+		t.Errorf("Expected no further alert, got %+v", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// newMonitoredProxy creates a proxy configured from env that uses mock
+func newMonitoredProxy(t *testing.T, env map[string]string, mock *mocks.MockSessionManager) *httptest.Server {
+	t.Helper()
+
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer.invalid")
+	t.Setenv("SESSION_READY_POLL_INTERVAL", "10ms")
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	t.Setenv("AUTH_DISABLED", "true")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	proxy, err := sessions.NewServer(cfg, sessions.WithSessionManager(mock))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWalletBalanceAlert(t *testing.T) {
+	webhook, alerts := startAlertWebhook(t)
+	mock := mocks.NewMockSessionManager()
+	var mor atomic.Value
+	mor.Store("2000000000000000000")
+	mock.GetBalanceFn = func(ctx context.Context) (*sessions.WalletBalance, error) {
+		return &sessions.WalletBalance{ETH: "1000000000000000000", MOR: sessions.NumericString(mor.Load().(string))}, nil
+	}
+	server := newMonitoredProxy(t, map[string]string{
+		"WALLET_MONITOR_INTERVAL": "10ms",
+		"ALERT_WEBHOOK_URLS":      webhook,
+		"ALERT_MIN_MOR_BALANCE":   "1000000000000000000",
+	}, mock)
+
+	time.Sleep(50 * time.Millisecond)
+	if value := scrapeMetrics(t, server.URL)[`nfa_proxy_wallet_balance{asset="MOR"}`]; value != 2 {
+		t.Errorf("Expected a MOR balance of 2 tokens, got %v", value)
+	}
+	expectNoAlert(t, alerts)
+
+	mor.Store("500000000000000000")
+	alert := expectAlert(t, alerts, "wallet_balance_low", "firing")
+	if alert.Labels["asset"] != "MOR" || alert.Labels["balance"] != "500000000000000000" {
+		t.Errorf("Expected the MOR balance in the alert labels, got %v", alert.Labels)
+	}
+	// The alert fires once while the balance stays low
+	expectNoAlert(t, alerts)
+
+	mor.Store("3000000000000000000")
+	expectAlert(t, alerts, "wallet_balance_low", "resolved")
+}
+
+func TestSessionFailureRateAlert(t *testing.T) {
+	webhook, alerts := startAlertWebhook(t)
+	mock := mocks.NewMockSessionManager()
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return nil, errors.New("provider unreachable")
+	}
+	server := newMonitoredProxy(t, map[string]string{
+		"ALERT_WEBHOOK_URLS":         webhook,
+		"ALERT_SESSION_FAILURE_RATE": "0.5",
+	}, mock)
+
+	for i := 0; i < 5; i++ {
+		postChat(t, server.URL+"/v1/chat/completions", helloRequest(), nil)
+	}
+	alert := expectAlert(t, alerts, "session_failure_rate", "firing")
+	if !strings.Contains(alert.Message, "failed to open") {
+		t.Errorf("Expected the failure rate in the alert message, got %q", alert.Message)
+	}
+
+	postChat(t, server.URL+"/v1/chat/completions", helloRequest(), nil)
+	expectNoAlert(t, alerts)
+	if fired := scrapeMetrics(t, server.URL)[`nfa_proxy_alerts_total{alert="session_failure_rate"}`]; fired != 1 {
+		t.Errorf("Expected the alert to fire once, counted %v", fired)
+	}
+}
+
+func TestBudgetNearlyExhaustedAlert(t *testing.T) {
+	webhook, alerts := startAlertWebhook(t)
+	keysFile := writeAPIKeys(t, "", `{"keys":[{"key":"sk-team-a","tenant":"team-a","daily_budget":"10000000000000"}]}`)
+	mock := mocks.NewMockSessionManager()
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		return &sessions.SessionResponse{
+			SessionToken: fmt.Sprintf("session-%d", atomic.AddInt32(&created, 1)),
+			ExpiresAt:    time.Now().Add(10 * time.Second),
+		}, nil
+	}
+	server := newMonitoredProxy(t, map[string]string{
+		"API_KEYS_FILE":          keysFile,
+		"ALERT_WEBHOOK_URLS":     webhook,
+		"ALERT_BUDGET_THRESHOLD": "0.8",
+	}, mock)
+	teamA := map[string]string{"Authorization": "Bearer sk-team-a"}
+
+	// Each session commits its stake plus the 300000000000 wei fee
+	if resp := postChat(t, server.URL+"/v1/chat/completions", stakedRequest("5000000000000"), teamA); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	expectNoAlert(t, alerts)
+
+	if resp := postChat(t, server.URL+"/v1/chat/completions", stakedRequest("3000000000000"), teamA); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	alert := expectAlert(t, alerts, "budget_nearly_exhausted", "firing")
+	if alert.Labels["tenant"] != "team-a" || alert.Labels["period"] != "daily" {
+		t.Errorf("Expected the tenant and period in the alert labels, got %v", alert.Labels)
+	}
+
+	// Once per budget period
+	if resp := postChat(t, server.URL+"/v1/chat/completions", stakedRequest("1000"), teamA); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	expectNoAlert(t, alerts)
+}
+
+func TestAlertConfigValidation(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	t.Setenv("ALERT_WEBHOOK_URLS", "https://hooks.example.com/nfa, ftp://hooks.example.com")
+	t.Setenv("ALERT_MIN_ETH_BALANCE", "0.1")
+	t.Setenv("ALERT_BUDGET_THRESHOLD", "90")
+	t.Setenv("WALLET_MONITOR_INTERVAL", "-1m")
+
+	_, err := sessions.ReadConfig("")
+	if err == nil {
+		t.Fatal("Expected an invalid alert configuration to be rejected")
+	}
+	for _, problem := range []string{
+		"alerts.webhooks entry 2",
+		"alerts.min_eth_balance",
+		"alerts.budget_threshold",
+		"wallet.monitor_interval",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to be reported, got %v", problem, err)
+		}
+	}
+	if strings.Contains(err.Error(), "entry 1") {
+		t.Errorf("Expected the https webhook to be accepted, got %v", err)
+	}
+	if strings.Contains(err.Error(), "hooks.example.com") {
+		t.Errorf("Expected webhook URLs to stay out of errors, got %v", err)
+	}
+}
+
+func TestAlertWebhookEnablesBalanceChecks(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	t.Setenv("ALERT_WEBHOOK_URLS", "https://hooks.example.com/nfa")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if cfg.WalletMonitorInterval != 5*time.Minute {
+		t.Errorf("Expected webhooks to default the monitor interval to 5m, got %v", cfg.WalletMonitorInterval)
+	}
+
+	t.Setenv("WALLET_MONITOR_INTERVAL", "1m")
+	if cfg, err = sessions.ReadConfig(""); err != nil || cfg.WalletMonitorInterval != time.Minute {
+		t.Errorf("Expected an explicit monitor interval to be kept, got %v, %v", cfg, err)
+	}
+}
+
+func TestAlertDeliveryErrorsLogWebhookHost(t *testing.T) {
+	webhook := httptest.NewServer(http.NotFoundHandler())
+	webhook.Close()
+	mock := mocks.NewMockSessionManager()
+	mock.GetBalanceFn = func(ctx context.Context) (*sessions.WalletBalance, error) {
+		return &sessions.WalletBalance{ETH: "1000000000000000000", MOR: "0"}, nil
+	}
+
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer.invalid")
+	t.Setenv("AUTH_DISABLED", "true")
+	t.Setenv("WALLET_MONITOR_INTERVAL", "10ms")
+	t.Setenv("ALERT_WEBHOOK_URLS", webhook.URL+"/services/T0/s3cret-token")
+	t.Setenv("ALERT_MIN_MOR_BALANCE", "1")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	var logs logBuffer
+	proxy, err := sessions.NewServer(cfg, sessions.WithSessionManager(mock), sessions.WithLogger(sessions.NewLogger(&logs, cfg)))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	proxy.Close()
+
+	var delivery map[string]interface{}
+	for _, record := range logs.records(t) {
+		if record["msg"] == "Error delivering alert" {
+			delivery = record
+		}
+	}
+	if delivery == nil {
+		t.Fatalf("Expected the failed delivery to be logged, got %s", logs.String())
+	}
+	if host := strings.TrimPrefix(webhook.URL, "http://"); delivery["webhook"] != host {
+		t.Errorf("Expected the webhook to be logged as %s, got %v", host, delivery["webhook"])
+	}
+	if strings.Contains(logs.String(), "s3cret-token") {
+		t.Errorf("Expected the webhook path to stay out of the logs, got %s", logs.String())
+	}
+}
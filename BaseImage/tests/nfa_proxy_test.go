@@ -48,7 +48,7 @@ func TestChatEndpointIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get available port: %v", err)
 	}
-	os.Setenv("PORT", fmt.Sprintf("%d", port))
+	t.Setenv("PORT", fmt.Sprintf("%d", port))
 
 	// Verify required environment variables
 	requiredEnvVars := []string{
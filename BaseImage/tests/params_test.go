@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// recordSessionParams starts a proxy that records the parameters sessions
+// are opened with
+func recordSessionParams(t *testing.T, env map[string]string) (*[]sessions.SessionParams, *testProxy) {
+	mock, proxy := setupMockProxy(t, env)
+	var opened []sessions.SessionParams
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		opened = append(opened, params)
+		return &sessions.SessionResponse{
+			SessionToken: fmt.Sprintf("session-%d", len(opened)),
+			ExpiresAt:    time.Now().Add(params.Duration),
+		}, nil
+	}
+	return &opened, proxy
+}
+
+func TestSessionParamsDefaults(t *testing.T) {
+	opened, proxy := recordSessionParams(t, map[string]string{
+		"SESSION_DURATION": "30m",
+		"SESSION_FEE":      "1000",
+		"SESSION_STAKE":    "5000",
+	})
+
+	if resp := postChat(t, proxy.chatURL(), helloRequest(), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	want := sessions.SessionParams{Duration: 30 * time.Minute, MaxFee: "1000", Stake: "5000"}
+	if len(*opened) != 1 || (*opened)[0] != want {
+		t.Errorf("Expected the configured defaults %+v, got %+v", want, *opened)
+	}
+}
+
+func TestSessionParamsOverrides(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-long","tenant":"team-a","session_duration":"2h","stake":"100","max_fee":"5000"}
+	]}`)
+	opened, proxy := recordSessionParams(t, map[string]string{"API_KEYS_FILE": keysFile})
+
+	auth := map[string]string{"Authorization": "Bearer sk-long"}
+	postChat(t, proxy.chatURL(), helloRequest(), auth)
+
+	// Request fields override the key, and headers override request fields,
+	// within the key's terms
+	direct := true
+	req := helloRequest()
+	req.MaxFee = "2000"
+	req.StakeAmount = "80"
+	req.DirectPayment = &direct
+	postChat(t, proxy.chatURL(), req, map[string]string{
+		"Authorization":               "Bearer sk-long",
+		"X-Morpheus-Stake":            "50",
+		"X-Morpheus-Session-Duration": "600",
+	})
+
+	want := []sessions.SessionParams{
+		{Duration: 2 * time.Hour, MaxFee: "5000", Stake: "100"},
+		{Duration: 10 * time.Minute, DirectPayment: true, MaxFee: "2000", Stake: "50"},
+	}
+	if len(*opened) != len(want) {
+		t.Fatalf("Expected a session per set of terms, got %+v", *opened)
+	}
+	for i := range want {
+		if (*opened)[i] != want[i] {
+			t.Errorf("Session %d: expected %+v, got %+v", i, want[i], (*opened)[i])
+		}
+	}
+
+	// Requests with the same terms share the pooled session
+	postChat(t, proxy.chatURL(), helloRequest(), auth)
+	if len(*opened) != 2 {
+		t.Errorf("Expected the session to be reused, got %d sessions", len(*opened))
+	}
+
+	// Requests cannot ask for more than the key allows
+	over := helloRequest()
+	over.StakeAmount = "200"
+	expectOpenAIError(t, postChat(t, proxy.chatURL(), over, auth), http.StatusBadRequest, "invalid_session_params")
+	for _, headers := range []map[string]string{
+		{"X-Morpheus-Stake": "101"},
+		{"X-Morpheus-Max-Fee": "5001"},
+		{"X-Morpheus-Session-Duration": "3h"},
+	} {
+		headers["Authorization"] = "Bearer sk-long"
+		expectOpenAIError(t, postChat(t, proxy.chatURL(), helloRequest(), headers), http.StatusBadRequest, "invalid_session_params")
+	}
+	if len(*opened) != 2 {
+		t.Errorf("Expected no session for terms beyond the key's, got %+v", *opened)
+	}
+}
+
+func TestSessionParamsLimits(t *testing.T) {
+	opened, proxy := recordSessionParams(t, map[string]string{
+		"SESSION_MAX_STAKE":            "1000",
+		"SESSION_MAX_DURATION":         "2h",
+		"SESSION_ALLOW_DIRECT_PAYMENT": "false",
+	})
+
+	for _, headers := range []map[string]string{
+		{"X-Morpheus-Stake": "1001"},
+		{"X-Morpheus-Session-Duration": "3h"},
+		{"X-Morpheus-Direct-Payment": "true"},
+		{"X-Morpheus-Direct-Payment": "maybe"},
+		{"X-Morpheus-Max-Fee": "-5"},
+	} {
+		resp := postChat(t, proxy.chatURL(), helloRequest(), headers)
+		expectOpenAIError(t, resp, http.StatusBadRequest, "invalid_session_params")
+	}
+	if len(*opened) != 0 {
+		t.Errorf("Expected no session for terms out of limits, got %+v", *opened)
+	}
+}
+
+func TestSessionParamsConfigValidated(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://localhost:0")
+	t.Setenv("SESSION_DURATION", "48h")
+	if _, err := sessions.ReadConfig(""); err == nil {
+		t.Error("Expected a default session duration above SESSION_MAX_DURATION to be rejected")
+	}
+	t.Setenv("SESSION_DURATION", "1h")
+	t.Setenv("SESSION_FEE", "a lot")
+	if _, err := sessions.ReadConfig(""); err == nil {
+		t.Error("Expected an invalid SESSION_FEE to be rejected")
+	}
+}
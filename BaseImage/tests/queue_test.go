@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// gatedAnswers makes chat requests report their user on arrived and wait for
+// a value on release before answering
+func gatedAnswers(mock *mocks.MockSessionManager) (arrived chan string, release chan struct{}) {
+	arrived = make(chan string, 16)
+	release = make(chan struct{}, 16)
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		arrived <- chatReq.User
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		finishReason := "stop"
+		return &sessions.ChatResponse{Choices: []sessions.ChatChoice{{
+			Message:      sessions.ChatMessage{Role: "assistant", Content: "Hello"},
+			FinishReason: &finishReason,
+		}}}, nil
+	}
+	return arrived, release
+}
+
+// startQueuedProxy starts a proxy on a mock session manager whose queued
+// requests give up within 5s unless env says otherwise
+func startQueuedProxy(t *testing.T, env map[string]string) (*mocks.MockSessionManager, string) {
+	t.Helper()
+	// Requests left queued by a failed test hold up its cleanup
+	if _, ok := env["QUEUE_MAX_WAIT"]; !ok {
+		env["QUEUE_MAX_WAIT"] = "5s"
+	}
+	mock, proxy := setupMockProxy(t, env)
+	return mock, proxy.URL
+}
+
+// sendQueued posts a non-streaming request from user in the background and
+// returns a channel its response is sent to
+func sendQueued(t *testing.T, url, user string, headers map[string]string) <-chan *http.Response {
+	done := make(chan *http.Response, 1)
+	req := helloRequest()
+	req.Stream = false
+	req.User = user
+	go func() {
+		done <- postChat(t, url+"/v1/chat/completions", req, headers)
+	}()
+	return done
+}
+
+// waitForQueue waits until the health check reports waiting queued requests
+func waitForQueue(t *testing.T, url string, waiting int) sessions.QueueStatus {
+	t.Helper()
+	var health struct {
+		Queue sessions.QueueStatus `json:"queue"`
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		resp, err := http.Get(url + "/health")
+		if err != nil {
+			t.Fatalf("Failed to get health: %v", err)
+		}
+		json.NewDecoder(resp.Body).Decode(&health)
+		resp.Body.Close()
+		if health.Queue.Waiting == waiting {
+			return health.Queue
+		}
+	}
+	t.Fatalf("Expected %d queued requests, health reports %+v", waiting, health.Queue)
+	return health.Queue
+}
+
+func expectArrival(t *testing.T, arrived <-chan string, user string) {
+	t.Helper()
+	select {
+	case got := <-arrived:
+		if got != user {
+			t.Fatalf("Expected the request of %s to go upstream, got %s", user, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for the request of %s", user)
+	}
+}
+
+func TestConcurrencyLimitPerModel(t *testing.T) {
+	mock, url := startQueuedProxy(t, map[string]string{"MAX_CONCURRENT_PER_MODEL": "1"})
+	arrived, release := gatedAnswers(mock)
+
+	first := sendQueued(t, url, "first", nil)
+	expectArrival(t, arrived, "first")
+	second := sendQueued(t, url, "second", nil)
+	status := waitForQueue(t, url, 1)
+	if status.Running != 1 || status.Models[defaultModelHandle].Waiting != 1 {
+		t.Errorf("Expected one request running and one waiting for the model, got %+v", status)
+	}
+	if depth := scrapeMetrics(t, url)[`nfa_proxy_queue_depth{model="`+defaultModelHandle+`"}`]; depth != 1 {
+		t.Errorf("Expected a queue depth of 1, got %v", depth)
+	}
+
+	release <- struct{}{}
+	if resp := <-first; resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the first request to succeed, got %d", resp.StatusCode)
+	}
+	expectArrival(t, arrived, "second")
+	release <- struct{}{}
+	if resp := <-second; resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the queued request to succeed, got %d", resp.StatusCode)
+	}
+	waitForQueue(t, url, 0)
+}
+
+func TestQueueFullAndTimeout(t *testing.T) {
+	mock, url := startQueuedProxy(t, map[string]string{
+		"MAX_CONCURRENT_PER_MODEL": "1",
+		"QUEUE_SIZE":               "1",
+		"QUEUE_MAX_WAIT":           "300ms",
+	})
+	arrived, release := gatedAnswers(mock)
+	defer close(release)
+
+	sendQueued(t, url, "running", nil)
+	expectArrival(t, arrived, "running")
+	queued := sendQueued(t, url, "queued", nil)
+	waitForQueue(t, url, 1)
+
+	resp := <-sendQueued(t, url, "rejected", nil)
+	if resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After: 1, got %q", resp.Header.Get("Retry-After"))
+	}
+	expectOpenAIError(t, resp, http.StatusTooManyRequests, "queue_full")
+
+	resp = <-queued
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header when the wait times out")
+	}
+	expectOpenAIError(t, resp, http.StatusTooManyRequests, "queue_timeout")
+}
+
+func TestQueueTakesKeysInTurn(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-busy","tenant":"busy"},
+		{"key":"sk-quiet","tenant":"quiet"}
+	]}`)
+	mock, url := startQueuedProxy(t, map[string]string{
+		"API_KEYS_FILE":            keysFile,
+		"MAX_CONCURRENT_PER_MODEL": "1",
+	})
+	arrived, release := gatedAnswers(mock)
+	busy := map[string]string{"Authorization": "Bearer sk-busy"}
+	quiet := map[string]string{"Authorization": "Bearer sk-quiet"}
+
+	var responses []<-chan *http.Response
+	responses = append(responses, sendQueued(t, url, "busy-1", busy))
+	expectArrival(t, arrived, "busy-1")
+	for i, user := range []string{"busy-2", "busy-3"} {
+		responses = append(responses, sendQueued(t, url, user, busy))
+		waitForQueue(t, url, i+1)
+	}
+	responses = append(responses, sendQueued(t, url, "quiet-1", quiet))
+	waitForQueue(t, url, 3)
+
+	// The quiet key's request goes ahead of the busy key's backlog
+	for _, user := range []string{"busy-2", "quiet-1", "busy-3"} {
+		release <- struct{}{}
+		expectArrival(t, arrived, user)
+	}
+	release <- struct{}{}
+	for _, resp := range responses {
+		if resp := <-resp; resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected every request to succeed, got %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestConcurrencyLimitPerKey(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-a","tenant":"a"},
+		{"key":"sk-b","tenant":"b","max_concurrent":2}
+	]}`)
+	mock, url := startQueuedProxy(t, map[string]string{
+		"API_KEYS_FILE":          keysFile,
+		"MAX_CONCURRENT_PER_KEY": "1",
+	})
+	arrived, release := gatedAnswers(mock)
+	defer close(release)
+	keyA := map[string]string{"Authorization": "Bearer sk-a"}
+	keyB := map[string]string{"Authorization": "Bearer sk-b"}
+
+	sendQueued(t, url, "a-1", keyA)
+	expectArrival(t, arrived, "a-1")
+	sendQueued(t, url, "a-2", keyA)
+	waitForQueue(t, url, 1)
+
+	// Other keys are not held up, and keys may raise their own limit
+	sendQueued(t, url, "b-1", keyB)
+	expectArrival(t, arrived, "b-1")
+	sendQueued(t, url, "b-2", keyB)
+	expectArrival(t, arrived, "b-2")
+	if status := waitForQueue(t, url, 1); status.Running != 3 {
+		t.Errorf("Expected 3 requests running, got %+v", status)
+	}
+}
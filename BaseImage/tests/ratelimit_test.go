@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// usageAnswers makes chat requests report totalTokens tokens of usage
+func usageAnswers(mock *mocks.MockSessionManager, totalTokens int) {
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		finishReason := "stop"
+		return &sessions.ChatResponse{
+			Choices: []sessions.ChatChoice{{
+				Message:      sessions.ChatMessage{Role: "assistant", Content: "Hello"},
+				FinishReason: &finishReason,
+			}},
+			Usage: &sessions.Usage{PromptTokens: totalTokens / 2, CompletionTokens: totalTokens - totalTokens/2, TotalTokens: totalTokens},
+		}, nil
+	}
+}
+
+func sendLimited(t *testing.T, url string, headers map[string]string) *http.Response {
+	t.Helper()
+	req := helloRequest()
+	req.Stream = false
+	return postChat(t, url+"/v1/chat/completions", req, headers)
+}
+
+func expectRateHeaders(t *testing.T, resp *http.Response, limit string, max, remaining int) {
+	t.Helper()
+	if got := resp.Header.Get("x-ratelimit-limit-" + limit); got != strconv.Itoa(max) {
+		t.Errorf("Expected x-ratelimit-limit-%s: %d, got %q", limit, max, got)
+	}
+	if got := resp.Header.Get("x-ratelimit-remaining-" + limit); got != strconv.Itoa(remaining) {
+		t.Errorf("Expected x-ratelimit-remaining-%s: %d, got %q", limit, remaining, got)
+	}
+	if resp.Header.Get("x-ratelimit-reset-"+limit) == "" {
+		t.Errorf("Expected an x-ratelimit-reset-%s header", limit)
+	}
+}
+
+func TestRateLimitPerKey(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-small","tenant":"small","requests_per_minute":2},
+		{"key":"sk-default","tenant":"default"}
+	]}`)
+	_, url := startQueuedProxy(t, map[string]string{
+		"API_KEYS_FILE":      keysFile,
+		"RATE_LIMIT_KEY_RPM": "5",
+	})
+	small := map[string]string{"Authorization": "Bearer sk-small"}
+	series := `nfa_proxy_rate_limited_total{limit="requests",scope="key"}`
+
+	for remaining := 1; remaining >= 0; remaining-- {
+		resp := sendLimited(t, url, small)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected a request within the limit to succeed, got %d", resp.StatusCode)
+		}
+		expectRateHeaders(t, resp, "requests", 2, remaining)
+	}
+
+	resp := sendLimited(t, url, small)
+	expectRateHeaders(t, resp, "requests", 2, 0)
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry < 1 || retry > 30 {
+		t.Errorf("Expected Retry-After within the refill of one request, got %q", resp.Header.Get("Retry-After"))
+	}
+	if resp.Header.Get("retry-after-ms") == "" {
+		t.Error("Expected a retry-after-ms header")
+	}
+	expectOpenAIError(t, resp, http.StatusTooManyRequests, "rate_limit_exceeded")
+	if got := scrapeMetrics(t, url)[series]; got != 1 {
+		t.Errorf("Expected 1 request limited per key, got %v", got)
+	}
+
+	// Other keys have their own buckets, with the default limit
+	resp = sendLimited(t, url, map[string]string{"Authorization": "Bearer sk-default"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected another key's request to succeed, got %d", resp.StatusCode)
+	}
+	expectRateHeaders(t, resp, "requests", 5, 4)
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	_, url := startQueuedProxy(t, map[string]string{
+		"RATE_LIMIT_IP_RPM":              "1",
+		"RATE_LIMIT_TRUST_FORWARDED_FOR": "true",
+	})
+
+	// The load balancer appends the client address, anything left of it is up to the client
+	if resp := sendLimited(t, url, map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.1"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first request to succeed, got %d", resp.StatusCode)
+	}
+	spoofed := map[string]string{"X-Forwarded-For": "198.51.100.2, 203.0.113.1"}
+	expectOpenAIError(t, sendLimited(t, url, spoofed), http.StatusTooManyRequests, "rate_limit_exceeded")
+	if resp := sendLimited(t, url, map[string]string{"X-Forwarded-For": "203.0.113.2"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a request from another client to succeed, got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimitForwardedForHops(t *testing.T) {
+	_, url := startQueuedProxy(t, map[string]string{
+		"RATE_LIMIT_IP_RPM":              "1",
+		"RATE_LIMIT_TRUST_FORWARDED_FOR": "true",
+		"RATE_LIMIT_FORWARDED_FOR_HOPS":  "2",
+	})
+
+	// Two load balancers: the client address is the second entry from the right
+	if resp := sendLimited(t, url, map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.1, 10.0.0.1"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first request to succeed, got %d", resp.StatusCode)
+	}
+	spoofed := map[string]string{"X-Forwarded-For": "198.51.100.2, 203.0.113.1, 10.0.0.2"}
+	expectOpenAIError(t, sendLimited(t, url, spoofed), http.StatusTooManyRequests, "rate_limit_exceeded")
+}
+
+func TestRateLimitTokensSettledByUsage(t *testing.T) {
+	mock, url := startQueuedProxy(t, map[string]string{"RATE_LIMIT_MODEL_TPM": "100"})
+	usageAnswers(mock, 80)
+
+	// "Hello" is estimated at 2 tokens, then settled at the 80 used
+	resp := sendLimited(t, url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first request to succeed, got %d", resp.StatusCode)
+	}
+	expectRateHeaders(t, resp, "tokens", 100, 98)
+	if resp.Header.Get("x-ratelimit-limit-requests") != "" {
+		t.Error("Expected no request limit headers without a request limit")
+	}
+
+	resp = sendLimited(t, url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the second request to succeed, got %d", resp.StatusCode)
+	}
+	expectRateHeaders(t, resp, "tokens", 100, 18)
+
+	resp = sendLimited(t, url, nil)
+	expectOpenAIError(t, resp, http.StatusTooManyRequests, "rate_limit_exceeded")
+}
+
+func TestRateLimitConfigValidation(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	configFile := writeConfig(t, "", `
+rate_limits:
+  models:
+    LMR-Hermes-3-Llama-3.1-8B:
+      tokens_per_minute: -1
+auth:
+  keys:
+    - key: sk-negative
+      tenant: negative
+      requests_per_minute: -5
+`)
+
+	_, err := sessions.ReadConfig(configFile)
+	if err == nil {
+		t.Fatal("Expected negative rate limits to be rejected")
+	}
+	for _, problem := range []string{"rate_limits.models", "auth.keys[0]"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to be reported, got %v", problem, err)
+		}
+	}
+}
+
+func TestRateLimitBeforeDecoding(t *testing.T) {
+	mock, url := startQueuedProxy(t, map[string]string{"RATE_LIMIT_IP_RPM": "1"})
+	var lookups int32
+	mock.GetModelByHandleFn = func(ctx context.Context, handle string) (*sessions.ModelInfo, error) {
+		atomic.AddInt32(&lookups, 1)
+		return &sessions.ModelInfo{ID: "test-model-id", Name: handle}, nil
+	}
+
+	if resp := sendLimited(t, url, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first request to succeed, got %d", resp.StatusCode)
+	}
+
+	// Over the limit, a request is turned away before its body is even read
+	resp, err := http.Post(url+"/v1/chat/completions", "application/json", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	expectOpenAIError(t, resp, http.StatusTooManyRequests, "rate_limit_exceeded")
+	if got := atomic.LoadInt32(&lookups); got != 1 {
+		t.Errorf("Expected no model lookup for a rate limited request, got %d lookups", got)
+	}
+}
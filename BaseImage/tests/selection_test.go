@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+const (
+	providerA = "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	providerB = "0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	providerC = "0xcccccccccccccccccccccccccccccccccccccccc"
+)
+
+func testBids() []sessions.BidInfo {
+	return []sessions.BidInfo{
+		{ID: "bid-a", Provider: providerA, PricePerSecond: "300"},
+		{ID: "bid-b", Provider: providerB, PricePerSecond: "100"},
+		{ID: "bid-c", Provider: providerC, PricePerSecond: "200"},
+	}
+}
+
+// recordBidSessions starts a proxy that serves testBids and records the bids
+// sessions are opened on
+func recordBidSessions(t *testing.T, env map[string]string) (*[]string, *testProxy) {
+	mock, proxy := setupMockProxy(t, env)
+	mock.ListBidsFn = func(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+		return testBids(), nil
+	}
+	var opened []string
+	mock.CreateSessionForBidFn = func(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		opened = append(opened, bidId)
+		return &sessions.SessionResponse{SessionToken: "session-" + bidId, ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		t.Error("Expected the session to be opened on a selected bid")
+		return nil, nil
+	}
+	return &opened, proxy
+}
+
+func bidIDs(bids []sessions.BidInfo) []string {
+	ids := make([]string, len(bids))
+	for i, bid := range bids {
+		ids[i] = bid.ID
+	}
+	return ids
+}
+
+func TestCheapestSelectionPolicyHeader(t *testing.T) {
+	opened, proxy := recordBidSessions(t, map[string]string{})
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Selection-Policy": "cheapest"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if len(*opened) != 1 || (*opened)[0] != "bid-b" {
+		t.Errorf("Expected the session to be opened on the cheapest bid, got %v", *opened)
+	}
+}
+
+func TestPinnedProviderHeader(t *testing.T) {
+	opened, proxy := recordBidSessions(t, map[string]string{})
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Provider": providerC})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if len(*opened) != 1 || (*opened)[0] != "bid-c" {
+		t.Errorf("Expected the session to be opened on the pinned provider's bid, got %v", *opened)
+	}
+
+	resp = postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Provider": "0x0000000000000000000000000000000000000001"})
+	expectOpenAIError(t, resp, http.StatusServiceUnavailable, "no_provider")
+}
+
+func TestSelectionPolicyPerAPIKey(t *testing.T) {
+	keysFile := writeAPIKeys(t, "", `{"keys":[
+		{"key":"sk-cheap","tenant":"team-a","selection_policy":"cheapest"},
+		{"key":"sk-pinned","tenant":"team-b","provider":"`+providerA+`"}
+	]}`)
+	opened, proxy := recordBidSessions(t, map[string]string{"API_KEYS_FILE": keysFile})
+
+	postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-cheap"})
+	postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"Authorization": "Bearer sk-pinned"})
+	if len(*opened) != 2 || (*opened)[0] != "bid-b" || (*opened)[1] != "bid-a" {
+		t.Errorf("Expected each key's policy to pick its bid, got %v", *opened)
+	}
+
+	// Headers cannot change the key's selection, only repeat it
+	for _, headers := range []map[string]string{
+		{"Authorization": "Bearer sk-pinned", "X-Morpheus-Selection-Policy": "cheapest"},
+		{"Authorization": "Bearer sk-pinned", "X-Morpheus-Provider": providerB},
+		{"Authorization": "Bearer sk-cheap", "X-Morpheus-Provider": providerB},
+	} {
+		resp := postChat(t, proxy.chatURL(), helloRequest(), headers)
+		expectOpenAIError(t, resp, http.StatusBadRequest, "invalid_selection_policy")
+	}
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{
+		"Authorization":               "Bearer sk-pinned",
+		"X-Morpheus-Selection-Policy": "pinned",
+	})
+	if resp.StatusCode != http.StatusOK || len(*opened) != 2 {
+		t.Errorf("Expected a header matching the key's policy to reuse its session, got %d and %v", resp.StatusCode, *opened)
+	}
+}
+
+func TestInvalidSelectionPolicy(t *testing.T) {
+	_, proxy := setupMockProxy(t, map[string]string{})
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Selection-Policy": "fastest-please"})
+	expectOpenAIError(t, resp, http.StatusBadRequest, "invalid_selection_policy")
+
+	resp = postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Selection-Policy": "pinned"})
+	expectOpenAIError(t, resp, http.StatusBadRequest, "invalid_selection_policy")
+}
+
+// lastBidPolicy is a custom policy that prefers the last bid offered
+type lastBidPolicy struct{}
+
+func (lastBidPolicy) Name() string { return "last_bid" }
+
+func (lastBidPolicy) Order(bids []sessions.BidInfo, in sessions.SelectionInput) []sessions.BidInfo {
+	ordered := make([]sessions.BidInfo, 0, len(bids))
+	for i := len(bids) - 1; i >= 0; i-- {
+		ordered = append(ordered, bids[i])
+	}
+	return ordered
+}
+
+func TestCustomSelectionPolicy(t *testing.T) {
+	mock := mocks.NewMockSessionManager()
+	mock.ListBidsFn = func(ctx context.Context, modelId string) ([]sessions.BidInfo, error) {
+		return testBids(), nil
+	}
+	var opened []string
+	mock.CreateSessionForBidFn = func(ctx context.Context, bidId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		opened = append(opened, bidId)
+		return &sessions.SessionResponse{SessionToken: "session-" + bidId, ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+	proxy := startProxy(t, map[string]string{"CONSUMER_NODE_URL": "http://consumer.invalid"},
+		sessions.WithSessionManager(mock), sessions.WithSelectionPolicy(lastBidPolicy{}))
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Selection-Policy": "last_bid"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if len(opened) != 1 || opened[0] != "bid-c" {
+		t.Errorf("Expected the custom policy to open a session on bid-c, got %v", opened)
+	}
+
+	_, other := setupMockProxy(t, map[string]string{})
+	resp = postChat(t, other.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Selection-Policy": "last_bid"})
+	expectOpenAIError(t, resp, http.StatusBadRequest, "invalid_selection_policy")
+}
+
+func TestStatsBasedSelectionPolicies(t *testing.T) {
+	tracker := sessions.NewProviderTracker()
+	tracker.RecordSuccess(providerA, 100*time.Millisecond)
+	tracker.RecordSuccess(providerA, 100*time.Millisecond)
+	tracker.RecordSuccess(providerB, 900*time.Millisecond)
+	tracker.RecordFailure(providerB)
+	tracker.RecordFailure(providerB)
+	in := sessions.SelectionInput{Stats: tracker.Snapshot()}
+
+	latency, _ := sessions.LookupSelectionPolicy("lowest_latency")
+	if got := bidIDs(latency.Order(testBids(), in)); got[0] != "bid-a" || got[1] != "bid-b" || got[2] != "bid-c" {
+		t.Errorf("Expected measured providers by latency, then unmeasured ones, got %v", got)
+	}
+
+	successRate, _ := sessions.LookupSelectionPolicy("success_rate")
+	if got := bidIDs(successRate.Order(testBids(), in)); got[0] != "bid-a" || got[1] != "bid-c" || got[2] != "bid-b" {
+		t.Errorf("Expected providers by success rate, got %v", got)
+	}
+
+	weighted, _ := sessions.LookupSelectionPolicy("weighted_random")
+	if got := weighted.Order(testBids(), in); len(got) != 3 {
+		t.Errorf("Expected weighted random to keep every bid, got %v", bidIDs(got))
+	}
+}
@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// newEmbeddedServer creates a proxy with its own config file and session
+// manager, without touching the package defaults
+func newEmbeddedServer(t *testing.T, apiKey string, mock *mocks.MockSessionManager) *httptest.Server {
+	t.Helper()
+
+	path := writeConfig(t, "", fmt.Sprintf(`
+upstream:
+  consumer_node_url: http://consumer.invalid
+auth:
+  keys:
+    - key: %s
+      tenant: %s
+timeouts:
+  session_ready_poll_interval: 10ms
+`, apiKey, apiKey))
+	cfg, err := sessions.ReadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	proxy, err := sessions.NewServer(cfg, sessions.WithSessionManager(mock))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServersRunSideBySide(t *testing.T) {
+	mockA := mocks.NewMockSessionManager()
+	mockB := mocks.NewMockSessionManager()
+	var mu sync.Mutex
+	sent := map[string][]string{}
+	for name, mock := range map[string]*mocks.MockSessionManager{"a": mockA, "b": mockB} {
+		name := name
+		mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+			mu.Lock()
+			sent[name] = append(sent[name], sessionToken)
+			mu.Unlock()
+			w.Write([]byte("data: [DONE]\n\n"))
+			return &sessions.ChatResponse{}, nil
+		}
+	}
+	serverA := newEmbeddedServer(t, "sk-a", mockA)
+	serverB := newEmbeddedServer(t, "sk-b", mockB)
+
+	body, _ := json.Marshal(helloRequest())
+	var wg sync.WaitGroup
+	post := func(url, apiKey string) {
+		defer wg.Done()
+		req, _ := http.NewRequest("POST", url+"/v1/chat/completions", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go post(serverA.URL, "sk-a")
+		go post(serverB.URL, "sk-b")
+	}
+	wg.Wait()
+
+	if len(sent["a"]) != 4 || len(sent["b"]) != 4 {
+		t.Errorf("Expected each server to use its own session manager, got %v", sent)
+	}
+
+	// Keys are per server
+	resp := postChat(t, serverA.URL+"/v1/chat/completions", helloRequest(), map[string]string{"Authorization": "Bearer sk-b"})
+	expectOpenAIError(t, resp, http.StatusUnauthorized, "invalid_api_key")
+
+	resp, err := http.Get(serverB.URL + "/health")
+	if err != nil {
+		t.Fatalf("Failed to get health: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the embedded server to serve /health, got %d", resp.StatusCode)
+	}
+}
+
+func TestNewServerValidatesConfig(t *testing.T) {
+	if _, err := sessions.NewServer(&sessions.Config{}); err == nil {
+		t.Error("Expected an empty configuration to be rejected")
+	}
+}
@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/mocks"
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// startProxyServer runs a proxy on a mock session manager on a free port and
+// returns its URL
+func startProxyServer(t *testing.T, env map[string]string) (*mocks.MockSessionManager, *sessions.Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	env["INTERNAL_API_PORT"] = fmt.Sprint(port)
+	env["CONSUMER_NODE_URL"] = "http://consumer.invalid"
+	mock := mocks.NewMockSessionManager()
+	proxy := newProxy(t, env, sessions.WithSessionManager(mock))
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- proxy.ListenAndServe() }()
+	t.Cleanup(func() {
+		proxy.Shutdown()
+		if err := <-serverErr; err != nil {
+			t.Errorf("ListenAndServe returned an error: %v", err)
+		}
+	})
+
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err := http.Get(url + "/health"); err == nil {
+			resp.Body.Close()
+			return mock, proxy, url
+		}
+	}
+	t.Fatalf("Server did not start on port %d", port)
+	return nil, nil, ""
+}
+
+// blockingStream makes streams send one chunk, then wait for release
+func blockingStream(mock *mocks.MockSessionManager) (started, release chan struct{}) {
+	started = make(chan struct{})
+	release = make(chan struct{})
+	mock.SendChatMessageFn = func(ctx context.Context, sessionToken string, modelId string, chatReq *sessions.ChatCompletionRequest, w sessions.StreamWriter) (*sessions.ChatResponse, error) {
+		w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}` + "\n\n"))
+		w.Flush()
+		close(started)
+		<-release
+		w.Write([]byte("data: [DONE]\n\n"))
+		w.Flush()
+		return &sessions.ChatResponse{}, nil
+	}
+	return started, release
+}
+
+func TestShutdownDrainsStreams(t *testing.T) {
+	mock, proxy, url := startProxyServer(t, map[string]string{"SHUTDOWN_TIMEOUT": "5s"})
+	started, release := blockingStream(mock)
+	var closed int32
+	mock.CloseSessionFn = func(ctx context.Context, sessionToken string) error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(url+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"`+defaultModelHandle+`","messages":[{"role":"user","content":"Hello"}],"stream":true}`))
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- proxy.Shutdown() }()
+
+	// New requests are refused while the stream drains
+	time.Sleep(50 * time.Millisecond)
+	if resp, err := http.Get(url + "/health"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected new connections to be refused during shutdown, got %d", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&closed) != 0 {
+		t.Errorf("Expected sessions to stay open while streams drain")
+	}
+
+	close(release)
+	if got := <-body; !strings.HasSuffix(got, "data: [DONE]\n\n") {
+		t.Errorf("Expected the stream to complete, got %q", got)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("Expected the pooled session to be closed, got %d closes", closed)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	mock, proxy, url := startProxyServer(t, map[string]string{"SHUTDOWN_TIMEOUT": "100ms"})
+	started, release := blockingStream(mock)
+	defer close(release)
+	closed := make(chan string, 1)
+	mock.CloseSessionFn = func(ctx context.Context, sessionToken string) error {
+		closed <- sessionToken
+		return nil
+	}
+
+	go func() {
+		resp, err := http.Post(url+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"`+defaultModelHandle+`","messages":[{"role":"user","content":"Hello"}],"stream":true}`))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	start := time.Now()
+	if err := proxy.Shutdown(); err == nil {
+		t.Errorf("Expected the shutdown deadline to be reported")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected shutdown to give up on the stream after the deadline, took %s", elapsed)
+	}
+
+	select {
+	case <-closed:
+	default:
+		t.Errorf("Expected the pooled session to be closed after the deadline")
+	}
+}
@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// tracedConsumerNode is a fake consumer node recording the request ID and
+// trace context headers of every call
+type tracedConsumerNode struct {
+	*httptest.Server
+	mu         sync.Mutex
+	requestIDs map[string][]string // By path
+	parents    []string
+}
+
+func startTracedConsumerNode(t *testing.T) *tracedConsumerNode {
+	t.Helper()
+	node := &tracedConsumerNode{requestIDs: map[string][]string{}}
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`))
+	})
+	node.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node.mu.Lock()
+		node.requestIDs[r.URL.Path] = append(node.requestIDs[r.URL.Path], r.Header.Get("X-Request-ID"))
+		node.parents = append(node.parents, r.Header.Get("traceparent"))
+		node.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(node.Close)
+
+	t.Setenv("CONSUMER_NODE_URL", node.URL)
+	t.Setenv("CONSUMER_USERNAME", "admin")
+	t.Setenv("CONSUMER_PASSWORD", "mock-test-password")
+	t.Setenv("COOKIE_FILE_PATH", "/nonexistent/.cookie")
+	t.Setenv("SESSION_READY_POLL_INTERVAL", "10ms")
+	return node
+}
+
+// newTracedProxy creates a proxy for the consumer node set in the environment
+func newTracedProxy(t *testing.T, opts ...sessions.Option) (*sessions.Server, *httptest.Server) {
+	t.Helper()
+	t.Setenv("AUTH_DISABLED", "true")
+	cfg, err := sessions.ReadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	proxy, err := sessions.NewServer(cfg, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, server
+}
+
+func postNonStreaming(t *testing.T, url string, headers map[string]string) *http.Response {
+	t.Helper()
+	chatReq := helloRequest()
+	chatReq.Stream = false
+	resp := postChat(t, url+"/v1/chat/completions", chatReq, headers)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	return resp
+}
+
+func TestRequestIDIsPropagatedUpstream(t *testing.T) {
+	node := startTracedConsumerNode(t)
+	proxy, server := newTracedProxy(t)
+	defer proxy.Close()
+
+	resp := postNonStreaming(t, server.URL, map[string]string{"X-Request-ID": "client-req-42"})
+	if got := resp.Header.Get("X-Request-ID"); got != "client-req-42" {
+		t.Errorf("Expected the inbound request ID to be echoed, got %q", got)
+	}
+
+	node.mu.Lock()
+	for _, path := range []string{"/blockchain/models", "/blockchain/models/0xmodel/session", "/v1/chat/completions"} {
+		if ids := node.requestIDs[path]; len(ids) == 0 || ids[0] != "client-req-42" {
+			t.Errorf("Expected %s to receive the request ID, got %v", path, ids)
+		}
+	}
+	node.mu.Unlock()
+
+	// IDs that could inject into logs or headers are replaced
+	resp = postNonStreaming(t, server.URL, map[string]string{"X-Request-ID": "{\"injected\": true}"})
+	if got := resp.Header.Get("X-Request-ID"); got == "" || strings.ContainsAny(got, "{\" ") {
+		t.Errorf("Expected an unusable request ID to be replaced, got %q", got)
+	}
+}
+
+func TestChatCompletionSpans(t *testing.T) {
+	node := startTracedConsumerNode(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	proxy, server := newTracedProxy(t, sessions.WithTracerProvider(provider))
+	defer proxy.Close()
+
+	postNonStreaming(t, server.URL, nil)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["chat.completions"]
+	if !ok {
+		t.Fatalf("Expected a chat.completions span, got %v", spans)
+	}
+	phases := []string{"model.lookup", "session.acquire", "session.create", "session.ready", "chat.send",
+		"consumer_node models", "consumer_node session_open", "consumer_node chat"}
+	for _, name := range phases {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("Expected %s to belong to the request's trace", name)
+		}
+	}
+
+	traceID := root.SpanContext().TraceID().String()
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for _, parent := range node.parents {
+		if !strings.Contains(parent, traceID) {
+			t.Errorf("Expected every upstream call to carry the trace context, got traceparent %q", parent)
+		}
+	}
+}
+
+func TestSpansExportedOverOTLP(t *testing.T) {
+	startTracedConsumerNode(t)
+	var exports int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" && r.Header.Get("Content-Type") == "application/x-protobuf" {
+			var body bytes.Buffer
+			body.ReadFrom(r.Body)
+			if body.Len() > 0 {
+				atomic.AddInt32(&exports, 1)
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	proxy, server := newTracedProxy(t)
+	postNonStreaming(t, server.URL, nil)
+	proxy.Close() // Flushes the batched spans
+
+	if atomic.LoadInt32(&exports) == 0 {
+		t.Error("Expected spans to be exported to the collector")
+	}
+}
+
+func TestTracingConfigValidation(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:4318")
+	t.Setenv("TRACING_SAMPLE_RATIO", "2")
+	_, err := sessions.ReadConfig("")
+	if err == nil {
+		t.Fatal("Expected an invalid tracing configuration to be rejected")
+	}
+	for _, setting := range []string{"tracing.endpoint", "tracing.sample_ratio"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("Expected %s to be reported, got %v", setting, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+// startFakeConsumerNode serves the given consumer node routes and starts a
+// proxy on them, configured by env on top
+func startFakeConsumerNode(t *testing.T, mux *http.ServeMux, env map[string]string) *testProxy {
+	t.Helper()
+
+	node := httptest.NewServer(mux)
+	t.Cleanup(node.Close)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	env["CONSUMER_NODE_URL"] = node.URL
+	env["CONSUMER_USERNAME"] = "admin"
+	env["CONSUMER_PASSWORD"] = "mock-test-password"
+	env["COOKIE_FILE_PATH"] = "/nonexistent/.cookie"
+	return startProxy(t, env)
+}
+
+// discardWriter is a StreamWriter that drops everything written to it
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriter) Flush()                      {}
+
+func TestSendChatMessageForwardsConversation(t *testing.T) {
+	var upstream map[string]json.RawMessage
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &upstream); err != nil {
+			t.Errorf("Upstream received invalid JSON: %s", string(body))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	requestJSON := `{
+		"model": "LMR-Hermes-2-Theta-Llama-3-8B",
+		"messages": [
+			{"role": "system", "content": "You are terse."},
+			{"role": "user", "content": "What is 2+2?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "add", "arguments": "{\"a\":2,\"b\":2}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "4"},
+			{"role": "user", "content": [{"type": "text", "text": "Explain"}]}
+		],
+		"stream": true,
+		"temperature": 0.2,
+		"max_tokens": 64,
+		"stop": ["\n\n"],
+		"tools": [{"type": "function", "function": {"name": "add"}}],
+		"logit_bias": {"50256": -100},
+		"custom_provider_flag": {"keep": true},
+		"stake_amount": "5000000000000000000"
+	}`
+
+	var chatReq sessions.ChatCompletionRequest
+	if err := json.Unmarshal([]byte(requestJSON), &chatReq); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	if chatReq.StakeAmount != "5000000000000000000" {
+		t.Errorf("Expected stake amount to be decoded, got %q", chatReq.StakeAmount)
+	}
+
+	if _, err := proxy.SessionManager().SendChatMessage(context.Background(), "session-1", "0xmodel", &chatReq, discardWriter{}); err != nil {
+		t.Fatalf("SendChatMessage failed: %v", err)
+	}
+
+	var model string
+	json.Unmarshal(upstream["model"], &model)
+	if model != "0xmodel" {
+		t.Errorf("Expected upstream model 0xmodel, got %q", model)
+	}
+	if _, ok := upstream["stake_amount"]; ok {
+		t.Errorf("Expected stake_amount to be stripped from the upstream request")
+	}
+	for _, field := range []string{"temperature", "max_tokens", "stop", "tools", "logit_bias", "custom_provider_flag"} {
+		if _, ok := upstream[field]; !ok {
+			t.Errorf("Expected %s to be forwarded upstream", field)
+		}
+	}
+
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal(upstream["messages"], &messages); err != nil {
+		t.Fatalf("Failed to decode upstream messages: %v", err)
+	}
+	if len(messages) != 5 {
+		t.Fatalf("Expected 5 upstream messages, got %d", len(messages))
+	}
+	if string(messages[0]["content"]) != `"You are terse."` {
+		t.Errorf("Expected system prompt to be forwarded, got %s", messages[0]["content"])
+	}
+	if string(messages[2]["content"]) != "null" || len(messages[2]["tool_calls"]) == 0 {
+		t.Errorf("Expected assistant tool call to be forwarded, got %v", messages[2])
+	}
+	if string(messages[3]["tool_call_id"]) != `"call_1"` {
+		t.Errorf("Expected tool_call_id to be forwarded, got %s", messages[3]["tool_call_id"])
+	}
+	if string(messages[4]["content"]) != `[{"type":"text","text":"Explain"}]` {
+		t.Errorf("Expected content parts to be forwarded verbatim, got %s", messages[4]["content"])
+	}
+}
+
+// fakeConsumerNodeMux serves a single model whose sessions are ready as soon as
+// they are opened, answering chat requests with the given handler
+func fakeConsumerNodeMux(chat http.HandlerFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blockchain/models", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"models":[{"Id":"0xmodel","Name":"` + defaultModelHandle + `","Fee":"100","Stake":"200","Owner":"0xowner","Tags":["llama","chat"],"CreatedAt":1700000000,"IsDeleted":false}]}`))
+	})
+	mux.HandleFunc("/blockchain/models/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sessionID":"0xsession"}`))
+	})
+	mux.HandleFunc("/blockchain/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/close") {
+			w.Write([]byte(`{"tx":"0xtx"}`))
+			return
+		}
+		w.Write([]byte(`{"session":{"Id":"0xsession","Provider":"0x1111111111111111111111111111111111111111","OpenedAt":"1700000000","ClosedAt":"0"}}`))
+	})
+	if chat != nil {
+		mux.HandleFunc("/v1/chat/completions", chat)
+	}
+	return mux
+}
+
+func TestNonStreamingChatCompletion(t *testing.T) {
+	var upstreamStream bool
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstreamStream = body.Stream
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-upstream","object":"chat.completion","created":1700000000,"model":"hermes","choices":[{"index":0,"message":{"role":"assistant","content":"Hello world!"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	chatReq := helloRequest()
+	chatReq.Stream = false
+	resp := postChat(t, proxy.chatURL(), chatReq, nil)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, string(body))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %s", ct)
+	}
+	if upstreamStream {
+		t.Errorf("Expected a non-streaming upstream request")
+	}
+
+	var completion sessions.ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatalf("Failed to decode completion: %v", err)
+	}
+	if completion.Object != "chat.completion" || completion.ID != "chatcmpl-upstream" {
+		t.Errorf("Unexpected completion header: %+v", completion)
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "Hello world!" {
+		t.Errorf("Unexpected choices: %+v", completion.Choices)
+	}
+	if completion.Usage == nil || completion.Usage.TotalTokens != 8 {
+		t.Errorf("Expected usage to be passed through, got %+v", completion.Usage)
+	}
+}
+
+func TestNonStreamingChatCompletionFromStream(t *testing.T) {
+	// Some nodes stream regardless of the requested mode
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1700000000,"model":"hermes","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"}}]}` + "\n\n"))
+		w.Write([]byte(`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1700000000,"model":"hermes","choices":[{"index":0,"delta":{"content":" world!"}}]}` + "\n\n"))
+		w.Write([]byte(`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1700000000,"model":"hermes","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"add","arguments":"{\"a\":"}}]}}]}` + "\n\n"))
+		w.Write([]byte(`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1700000000,"model":"hermes","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"2}"}}]},"finish_reason":"tool_calls"}]}` + "\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	chatReq := helloRequest()
+	chatReq.Stream = false
+	resp := postChat(t, proxy.chatURL(), chatReq, nil)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, string(body))
+	}
+
+	var completion sessions.ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatalf("Failed to decode completion: %v", err)
+	}
+	if completion.Object != "chat.completion" || completion.ID != "chatcmpl-1" {
+		t.Errorf("Unexpected completion header: %+v", completion)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("Expected 1 choice, got %d", len(completion.Choices))
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Role != "assistant" || choice.Message.Content != "Hello world!" {
+		t.Errorf("Unexpected aggregated message: %+v", choice.Message)
+	}
+	if choice.FinishReason == nil || *choice.FinishReason != "tool_calls" {
+		t.Errorf("Expected finish_reason tool_calls, got %v", choice.FinishReason)
+	}
+	if !strings.Contains(string(choice.Message.ToolCalls), `"arguments":"{\"a\":2}"`) {
+		t.Errorf("Expected tool call arguments to be concatenated, got %s", choice.Message.ToolCalls)
+	}
+}
+
+func TestStreamingChatCompletionRelaysDone(t *testing.T) {
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"Hi"}}]}` + "\n\ndata: [DONE]\n\n"))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected Content-Type text/event-stream, got %s", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Errorf("Expected the stream to end with [DONE], got %q", string(body))
+	}
+}
@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MORpheusSoftware/NFA/BaseImage/sessions"
+)
+
+const diamondContract = "0xb8C55cD613af947E73E262F0d3C54b7211Af16CF"
+
+func TestPreflightRejectsInsufficientBalance(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"DIAMOND_CONTRACT": diamondContract})
+	mock.GetBalanceFn = func(ctx context.Context) (*sessions.WalletBalance, error) {
+		return &sessions.WalletBalance{ETH: "1", MOR: "1000"}, nil
+	}
+	var created int32
+	mock.CreateSessionFn = func(ctx context.Context, modelId string, params sessions.SessionParams) (*sessions.SessionResponse, error) {
+		atomic.AddInt32(&created, 1)
+		return nil, errors.New("unexpected session")
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPaymentRequired || !strings.Contains(string(body), `"code":"insufficient_funds"`) {
+		t.Errorf("Expected a 402 insufficient_funds error, got %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "300000000000 wei") || !strings.Contains(string(body), "1000 wei available") {
+		t.Errorf("Expected the required and available amounts in the error, got %s", body)
+	}
+	if created != 0 {
+		t.Error("Expected no session to be opened without the funds for it")
+	}
+}
+
+func TestPreflightAllowance(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"DIAMOND_CONTRACT": diamondContract})
+	var spender string
+	mock.GetAllowanceFn = func(ctx context.Context, s string) (*big.Int, error) {
+		spender = s
+		return big.NewInt(5), nil
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPaymentRequired || !strings.Contains(string(body), `"code":"insufficient_allowance"`) {
+		t.Errorf("Expected a 402 insufficient_allowance error without auto-approval, got %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "5 wei available") {
+		t.Errorf("Expected the available allowance in the error, got %s", body)
+	}
+	if spender != diamondContract {
+		t.Errorf("Expected the allowance of the diamond contract to be checked, got %q", spender)
+	}
+}
+
+func TestPreflightAutoApprove(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{
+		"DIAMOND_CONTRACT":     diamondContract,
+		"AUTO_APPROVE_CEILING": "1000000000000",
+	})
+	mock.GetAllowanceFn = func(ctx context.Context, spender string) (*big.Int, error) {
+		return big.NewInt(0), nil
+	}
+	var approved *big.Int
+	mock.ApproveFn = func(ctx context.Context, spender string, amount *big.Int) error {
+		approved = amount
+		return nil
+	}
+
+	resp := postChat(t, proxy.chatURL(), helloRequest(), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the session to open once approved, got %d", resp.StatusCode)
+	}
+	if approved == nil || approved.String() != "1000000000000" {
+		t.Errorf("Expected the allowance to be raised to the ceiling, got %v", approved)
+	}
+
+	// Sessions costing more than the ceiling are not approved
+	approved = nil
+	resp = postChat(t, proxy.chatURL(), helloRequest(), map[string]string{"X-Morpheus-Stake": "2000000000000"})
+	expectOpenAIError(t, resp, http.StatusPaymentRequired, "insufficient_allowance")
+	if approved != nil {
+		t.Errorf("Expected no approval above the ceiling, got %v", approved)
+	}
+}
+
+func TestPreflightLookupFailureDoesNotBlock(t *testing.T) {
+	mock, proxy := setupMockProxy(t, map[string]string{"DIAMOND_CONTRACT": diamondContract})
+	mock.GetBalanceFn = func(ctx context.Context) (*sessions.WalletBalance, error) {
+		return nil, errors.New("balance lookup failed, status: 404")
+	}
+
+	if resp := postChat(t, proxy.chatURL(), helloRequest(), nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the session to be opened when the balance cannot be looked up, got %d", resp.StatusCode)
+	}
+}
+
+func TestWalletEndpoints(t *testing.T) {
+	mux := fakeConsumerNodeMux(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	mux.HandleFunc("/blockchain/balance", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"eth":"1000000000000000","mor":"5000000000000000000"}`))
+	})
+	mux.HandleFunc("/blockchain/allowance", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("spender") != diamondContract {
+			http.Error(w, `{"error":"unknown spender"}`, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"allowance":"100"}`))
+	})
+	var approveQuery string
+	mux.HandleFunc("/blockchain/approve", func(w http.ResponseWriter, r *http.Request) {
+		approveQuery = r.Method + " " + r.URL.RawQuery
+		w.Write([]byte(`{"tx":"0xtx"}`))
+	})
+	proxy := startFakeConsumerNode(t, mux, nil)
+
+	ctx := context.Background()
+	balance, err := proxy.SessionManager().GetBalance(ctx)
+	if err != nil || balance.MOR != "5000000000000000000" || balance.ETH != "1000000000000000" {
+		t.Errorf("Expected the wallet balance, got %+v, %v", balance, err)
+	}
+	allowance, err := proxy.SessionManager().GetAllowance(ctx, diamondContract)
+	if err != nil || allowance.Int64() != 100 {
+		t.Errorf("Expected an allowance of 100, got %v, %v", allowance, err)
+	}
+	if err := proxy.SessionManager().Approve(ctx, diamondContract, big.NewInt(300)); err != nil {
+		t.Fatalf("Expected the approval to succeed, got %v", err)
+	}
+	if approveQuery != "POST amount=300&spender="+diamondContract {
+		t.Errorf("Expected the approval to name the spender and amount, got %q", approveQuery)
+	}
+}
+
+func TestWalletConfigValidation(t *testing.T) {
+	t.Setenv("CONSUMER_NODE_URL", "http://consumer:8082")
+	t.Setenv("AUTO_APPROVE_CEILING", "lots")
+	_, err := sessions.ReadConfig("")
+	if err == nil {
+		t.Fatal("Expected an invalid wallet configuration to be rejected")
+	}
+	for _, problem := range []string{"wallet.auto_approve_ceiling", "wallet.diamond_contract (DIAMOND_CONTRACT) is required"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to be reported, got %v", problem, err)
+		}
+	}
+
+	t.Setenv("AUTO_APPROVE_CEILING", "")
+	t.Setenv("DIAMOND_CONTRACT", "diamond")
+	if _, err := sessions.ReadConfig(""); err == nil || !strings.Contains(err.Error(), "wallet.diamond_contract") {
+		t.Errorf("Expected a malformed contract address to be rejected, got %v", err)
+	}
+}